@@ -1,28 +1,35 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
-	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/szatmary/sonos"
 	avtransport "github.com/szatmary/sonos/AVTransport"
 	"github.com/zanders3/music/pkg/music"
+	"github.com/zanders3/music/pkg/scheduler"
 	"github.com/zanders3/music/pkg/sonosevs"
 	"github.com/zanders3/music/static"
 )
 
 var sourceFolder = flag.String("folder", "D:\\Music", "where the music is hosted")
+var fetchArtistInfo = flag.Bool("artistinfo", false, "fetch artist images and biographies from theaudiodb.com")
+var sonosPlayers = flag.String("sonos", "", "comma separated device description URLs of sonos players that searching can't find, such as http://192.168.1.20:1400/xml/device_description.xml")
 
 type HttpError struct {
 	err  error
@@ -95,7 +102,10 @@ type MusicServer struct {
 	index         music.MusicIndex
 	sonos         *music.Sonos
 	subscriptions *music.Subscriptions
+	scheduler     *scheduler.Scheduler
 	internalAddr  string
+	// where uploaded announcements are kept while they play
+	announceFolder string
 }
 
 type ResultType string
@@ -114,18 +124,26 @@ type Result struct {
 	Link, Audio          string
 	Artist, Album, Image string
 	SongId               int
+	Plays                int  `json:",omitempty"`
+	Rating               int  `json:",omitempty"`
+	Favourite            bool `json:",omitempty"`
 }
 
 type ListMusicRes struct {
 	Results []Result
+	Artist  *music.ArtistInfo `json:",omitempty"`
 }
 
-func albumResult(album *music.Album, header bool) Result {
+func (m *MusicServer) albumResult(album *music.Album, header bool) Result {
 	t := ResultType_Album
 	if header {
 		t = ResultType_AlbumHeader
 	}
-	return Result{Name: album.Name, Type: t, Link: "albums/" + album.Name, Artist: album.Artist, Album: album.Name, Image: album.AlbumArtPath}
+	rating := m.index.AlbumRating(album.Artist, album.Name)
+	return Result{
+		Name: album.Name, Type: t, Link: "albums/" + album.Name, Artist: album.Artist, Album: album.Name, Image: album.AlbumArtPath,
+		Rating: rating.Stars, Favourite: rating.Favourite,
+	}
 }
 
 func (m *MusicServer) songResult(album *music.Album, songIdx int) Result {
@@ -134,9 +152,11 @@ func (m *MusicServer) songResult(album *music.Album, songIdx int) Result {
 		albumArtPath = "/content" + album.AlbumArtPath
 	}
 	song := m.index.Songs[songIdx]
+	rating := m.index.SongRating(song.Path)
 	return Result{
 		Name: song.Title, Type: ResultType_Song, SongId: songIdx,
 		Artist: song.Artist, Album: song.Album, Audio: "/content" + song.Path, Image: albumArtPath,
+		Plays: m.index.Plays(song.Path), Rating: rating.Stars, Favourite: rating.Favourite,
 	}
 }
 
@@ -145,10 +165,59 @@ func artistResult(artist *music.Artist) Result {
 		Name: artist.Name, Type: ResultType_Artist,
 		Artist: artist.Name,
 		Link:   "artists/" + artist.Name,
+		Image:  artist.ImagePath,
 	}
 }
 
+// ListMusic lists the library, optionally only including songs and albums rated at least ?rating=
+// stars or marked as a ?favourite=true.
 func (m *MusicServer) ListMusic(r *http.Request) (*ListMusicRes, error) {
+	minStars := 0
+	if ratingStr := r.URL.Query().Get("rating"); len(ratingStr) > 0 {
+		var err error
+		if minStars, err = strconv.Atoi(ratingStr); err != nil || minStars < 0 || minStars > music.MaxStars {
+			return nil, NewHttpError(fmt.Errorf("bad rating"), 400)
+		}
+	}
+	favourite := false
+	if favouriteStr := r.URL.Query().Get("favourite"); len(favouriteStr) > 0 {
+		var err error
+		if favourite, err = strconv.ParseBool(favouriteStr); err != nil {
+			return nil, NewHttpError(fmt.Errorf("bad favourite"), 400)
+		}
+	}
+	res, err := m.listMusic(r)
+	if err != nil || (minStars == 0 && !favourite) {
+		return res, err
+	}
+	rated := func(result *Result) bool {
+		return result.Rating >= minStars && (!favourite || result.Favourite)
+	}
+	results := make([]Result, 0, len(res.Results))
+	var header *Result
+	for idx := range res.Results {
+		result := &res.Results[idx]
+		switch result.Type {
+		case ResultType_AlbumHeader:
+			// only kept if one of the album's songs is
+			header = result
+			continue
+		case ResultType_Song, ResultType_Album:
+			if !rated(result) {
+				continue
+			}
+		}
+		if header != nil && result.Type == ResultType_Song {
+			results = append(results, *header)
+		}
+		header = nil
+		results = append(results, *result)
+	}
+	res.Results = results
+	return res, nil
+}
+
+func (m *MusicServer) listMusic(r *http.Request) (*ListMusicRes, error) {
 	if r.Method != "GET" {
 		return nil, NewHttpError(fmt.Errorf("bad method"), 400)
 	}
@@ -158,7 +227,14 @@ func (m *MusicServer) ListMusic(r *http.Request) (*ListMusicRes, error) {
 			{Name: "Artists", Type: ResultType_Folder, Link: "artists"},
 			{Name: "Albums", Type: ResultType_Folder, Link: "albums"},
 			{Name: "Songs", Type: ResultType_Folder, Link: "songs"},
+			{Name: "Recently Added", Type: ResultType_Folder, Link: "recent"},
 		}}, nil
+	} else if searchType == "artists" && strings.HasSuffix(path, "/info") {
+		info, err := m.index.ArtistInfo(strings.TrimSuffix(path, "/info"))
+		if err != nil {
+			return nil, indexError(err)
+		}
+		return &ListMusicRes{Results: []Result{}, Artist: info}, nil
 	} else if searchType == "artists" {
 		m.index.SongsMu.Lock()
 		defer m.index.SongsMu.Unlock()
@@ -173,7 +249,7 @@ func (m *MusicServer) ListMusic(r *http.Request) (*ListMusicRes, error) {
 			for _, artist := range m.index.Artists {
 				if artist.Name == path {
 					for _, album := range m.index.Albums[artist.StartAlbumIdx:artist.EndAlbumIdx] {
-						results = append(results, albumResult(&album, true))
+						results = append(results, m.albumResult(&album, true))
 						for songIdx := album.StartSongIdx; songIdx < album.EndSongIdx; songIdx++ {
 							results = append(results, m.songResult(&album, songIdx))
 						}
@@ -186,14 +262,14 @@ func (m *MusicServer) ListMusic(r *http.Request) (*ListMusicRes, error) {
 		if len(path) == 0 {
 			results := make([]Result, 0, len(m.index.Albums))
 			for _, album := range m.index.Albums {
-				results = append(results, albumResult(&album, false))
+				results = append(results, m.albumResult(&album, false))
 			}
 			return &ListMusicRes{Results: results}, nil
 		} else {
 			results := make([]Result, 0)
 			for _, album := range m.index.Albums {
 				if album.Name == path {
-					results = append(results, albumResult(&album, true))
+					results = append(results, m.albumResult(&album, true))
 					for songIdx := album.StartSongIdx; songIdx < album.EndSongIdx; songIdx++ {
 						results = append(results, m.songResult(&album, songIdx))
 					}
@@ -201,6 +277,24 @@ func (m *MusicServer) ListMusic(r *http.Request) (*ListMusicRes, error) {
 				}
 			}
 		}
+	} else if searchType == "recent" {
+		limit := 100
+		if limitStr := r.URL.Query().Get("limit"); len(limitStr) > 0 {
+			var err error
+			if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+				return nil, NewHttpError(fmt.Errorf("bad limit"), 400)
+			}
+		}
+		albumIds := m.index.RecentlyAdded(limit)
+		m.index.SongsMu.Lock()
+		defer m.index.SongsMu.Unlock()
+		results := make([]Result, 0, len(albumIds))
+		for _, albumId := range albumIds {
+			if albumId < len(m.index.Albums) {
+				results = append(results, m.albumResult(&m.index.Albums[albumId], false))
+			}
+		}
+		return &ListMusicRes{Results: results}, nil
 	} else if searchType == "songs" {
 		results := make([]Result, 0, len(m.index.Songs))
 		for _, album := range m.index.Albums {
@@ -219,18 +313,84 @@ type SonosState struct {
 	AlbumArtURI          string `json:",omitempty"`
 	Playing              *bool  `json:",omitempty"`
 	Volume               *int   `json:",omitempty"`
+	// Muted and the EQ of the room, with bass and treble from -10 to 10
+	Muted    *bool `json:",omitempty"`
+	Bass     *int  `json:",omitempty"`
+	Treble   *int  `json:",omitempty"`
+	Loudness *bool `json:",omitempty"`
+	// Queueing is set while the rest of a long queue is added in the background
+	Queueing *music.QueueProgress `json:",omitempty"`
+	// Group is the volume of the group and each room in it when the room is grouped
+	Group *music.GroupVolume `json:",omitempty"`
+	// PlayMode is one of music.PlayModes
+	PlayMode  string `json:",omitempty"`
+	Crossfade *bool  `json:",omitempty"`
+	// SleepTimer is how long the group has left before it stops
+	SleepTimer *music.SleepTimer `json:",omitempty"`
 }
 
 type ListSonosRes struct {
-	Rooms []string    `json:",omitempty"`
-	Sonos *SonosState `json:",omitempty"`
+	Rooms  []string           `json:",omitempty"`
+	Groups []music.SonosGroup `json:",omitempty"`
+	Sonos  *SonosState        `json:",omitempty"`
+}
+
+type GroupRequest struct {
+	Room string // the room whose group to join
+}
+
+type SleepRequest struct {
+	Minutes int  // stop playing after this many minutes
+	Fade    bool // turn the volume down over the last 30 seconds
+}
+
+// AnnounceRequest plays a clip from the library, such as "/Chimes/doorbell.mp3".
+type AnnounceRequest struct {
+	Path   string
+	Volume *int // the volume of every room in the group while the clip plays, or left alone if nil
+}
+
+// AlarmRequest creates or changes a sonos alarm. Fields left out keep their value, or a default for a new
+// alarm, and an alarm without an album or playlist plays the sonos chime.
+type AlarmRequest struct {
+	Room               *string
+	StartTime          *string // HH:MM or HH:MM:SS
+	Duration           *string // how long to play for, HH:MM:SS
+	Recurrence         *string // ONCE, WEEKDAYS, WEEKENDS, DAILY or ON_ and days of the week from 0 for Sunday
+	Enabled            *bool
+	Volume             *int
+	PlayMode           *string // one of music.AlarmPlayModes
+	IncludeLinkedZones *bool   // wake up the rest of the group too
+	Playlist           *int    // play the songs in a playlist
+	Album              *string // play the songs in an album
+}
+
+type AlarmsRes struct {
+	Alarms []music.SonosAlarm
+	Alarm  *music.SonosAlarm `json:",omitempty"`
 }
 
 type ActionRequest struct {
 	SongIDs     []int
+	Playlist    *int    // play the songs in a playlist
+	Album       *string // play the songs in an album
+	Artist      *string // play every song by an artist
+	FromTrack   int     // start playing from this track of the songs, counting from 1
 	Volume      *int
 	SetTimeSecs *int
 	Action      string // Play, Pause, Next, Prev
+	// change the volume of every room in the group, keeping them relative to each other
+	GroupVolume       *int
+	GroupVolumeChange *int
+	GroupMute         *bool
+	// shuffle and repeat with one of music.PlayModes, and crossfade between tracks
+	PlayMode  *string
+	Crossfade *bool
+	// mute the room and set its EQ, with bass and treble from -10 to 10
+	Mute     *bool
+	Bass     *int
+	Treble   *int
+	Loudness *bool
 }
 
 func (m *MusicServer) toSonosSongUri(songId int) string {
@@ -244,48 +404,183 @@ func (m *MusicServer) toSonosSongMetadata(songId int) string {
 	if album, ok := m.index.AlbumIdByName[song.Album]; ok && len(m.index.Albums[album].AlbumArtPath) > 0 {
 		albumArtUri = m.internalAddr + "/content" + strings.ReplaceAll(m.index.Albums[album].AlbumArtPath, " ", "%20")
 	}
+	escape := func(s string) string {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
 	songExt := path.Ext(songUri)
 	durationStr := fmt.Sprintf("%02d:%02d:%02d", song.DurationSecs/(60*60), song.DurationSecs/60, song.DurationSecs%60)
 	s := fmt.Sprintf("<DIDL-Lite xmlns:dc=\"http://purl.org/dc/elements/1.1/\" xmlns:upnp=\"urn:schemas-upnp-org:metadata-1-0/upnp/\" xmlns:r=\"urn:schemas-rinconnetworks-com:metadata-1-0/\" xmlns=\"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/\"><item id=\"-1\" parentID=\"-1\" restricted=\"true\"><res protocolInfo=\"http-get:*:audio/%s:*\" duration=\"%s\">%s</res><r:streamContent></r:streamContent><r:radioShowMd></r:radioShowMd><r:streamInfo>bd:16,sr:44100,c:3,l:0,d:0</r:streamInfo><dc:title>%s</dc:title><upnp:class>object.item.audioItem.musicTrack</upnp:class><dc:creator>%s</dc:creator><upnp:album>%s</upnp:album><upnp:originalTrackNumber>4</upnp:originalTrackNumber><r:narrator>%s</r:narrator><r:albumArtist>%s</r:albumArtist><upnp:albumArtURI>%s</upnp:albumArtURI></item></DIDL-Lite>",
 		songExt,
 		durationStr,
-		songUri,
-		song.Title,
-		song.Artist,
-		song.Album,
-		song.Artist,
-		song.Artist,
-		albumArtUri,
+		escape(songUri),
+		escape(song.Title),
+		escape(song.Artist),
+		escape(song.Album),
+		escape(song.Artist),
+		escape(song.Artist),
+		escape(albumArtUri),
 	)
-	log.Println(s)
 	return s
 }
 
+// sourceSongIds returns the songs in a playlist, album or by an artist if one is given, otherwise songIds.
+func (m *MusicServer) sourceSongIds(songIds []int, playlist *int, album, artist *string) ([]int, error) {
+	var err error
+	if playlist != nil {
+		_, songIds, err = m.index.Playlist(*playlist)
+	} else if album != nil {
+		songIds, err = m.index.AlbumSongIds(*album)
+	} else if artist != nil {
+		songIds, err = m.index.ArtistSongIds(*artist)
+	}
+	if err != nil {
+		return nil, indexError(err)
+	}
+	return songIds, nil
+}
+
+// sonosTracks returns the tracks to queue for songs, skipping any that are no longer in the index, and
+// where startIdx ends up once they have been skipped.
+func (m *MusicServer) sonosTracks(songIds []int, startIdx int) ([]music.QueueTrack, int, error) {
+	m.index.SongsMu.Lock()
+	defer m.index.SongsMu.Unlock()
+	tracks := make([]music.QueueTrack, 0, len(songIds))
+	for idx, songId := range songIds {
+		if songId < 0 || songId >= len(m.index.Songs) {
+			if idx < startIdx {
+				startIdx--
+			}
+			continue
+		}
+		tracks = append(tracks, music.QueueTrack{URI: m.toSonosSongUri(songId), MetaData: m.toSonosSongMetadata(songId)})
+	}
+	if len(tracks) == 0 {
+		return nil, 0, NewHttpError(errors.New("no songs to play"), 400)
+	}
+	return tracks, startIdx, nil
+}
+
+// queueSongs replaces the queue of a sonos with the songs and starts playing them from startIdx.
+func (m *MusicServer) queueSongs(zp *sonos.ZonePlayer, songIds []int, startIdx int) error {
+	tracks, startIdx, err := m.sonosTracks(songIds, startIdx)
+	if err != nil {
+		return err
+	}
+	return m.sonos.QueueTracks(zp, tracks, startIdx)
+}
+
+type QueueRequest struct {
+	SongIDs  []int
+	Playlist *int
+	Album    *string
+	Artist   *string
+	Next     bool // add after the playing track rather than at the end
+	// positions in the queue counting from 1, for moving, removing and playing tracks. Count
+	// defaults to one track.
+	Track, Count, Before int
+}
+
+// SonosQueue views and changes the queue of a sonos. GET queue lists it, POST queue adds songs, and
+// POST queue/move, queue/remove and queue/play move, remove and play from a queue position.
+func (m *MusicServer) SonosQueue(zp *sonos.ZonePlayer, action string, req *http.Request) (*music.SonosQueue, error) {
+	if req.Method == "GET" && action == "" {
+		start, count := 1, 100
+		var err error
+		if startStr := req.URL.Query().Get("start"); len(startStr) > 0 {
+			if start, err = strconv.Atoi(startStr); err != nil {
+				return nil, NewHttpError(fmt.Errorf("bad start"), 400)
+			}
+		}
+		if countStr := req.URL.Query().Get("count"); len(countStr) > 0 {
+			if count, err = strconv.Atoi(countStr); err != nil {
+				return nil, NewHttpError(fmt.Errorf("bad count"), 400)
+			}
+		}
+		return m.sonos.Queue(zp, start, count)
+	} else if req.Method != "POST" {
+		return nil, NewHttpError(fmt.Errorf("bad method"), 400)
+	}
+	var queueReq QueueRequest
+	if err := json.NewDecoder(req.Body).Decode(&queueReq); err != nil {
+		return nil, NewHttpError(err, 400)
+	}
+	if queueReq.Count == 0 {
+		queueReq.Count = 1
+	}
+	var err error
+	switch action {
+	case "":
+		var songIds []int
+		if songIds, err = m.sourceSongIds(queueReq.SongIDs, queueReq.Playlist, queueReq.Album, queueReq.Artist); err != nil {
+			return nil, err
+		}
+		var tracks []music.QueueTrack
+		if tracks, _, err = m.sonosTracks(songIds, 0); err != nil {
+			return nil, err
+		}
+		err = m.sonos.AddTracks(zp, tracks, queueReq.Next)
+	case "move":
+		err = m.sonos.MoveTracks(zp, queueReq.Track, queueReq.Count, queueReq.Before)
+	case "remove":
+		err = m.sonos.RemoveTracks(zp, queueReq.Track, queueReq.Count)
+	case "play":
+		err = m.sonos.PlayTrack(zp, queueReq.Track)
+	default:
+		return nil, NewHttpError(errors.New("bad request"), 400)
+	}
+	if errors.Is(err, music.ErrBadQueue) {
+		return nil, NewHttpError(err, 400)
+	} else if err != nil {
+		return nil, err
+	}
+	return m.sonos.Queue(zp, 1, 100)
+}
+
 func (m *MusicServer) GetSonos(w http.ResponseWriter, zp *sonos.ZonePlayer, req *http.Request) {
 	ctx := req.Context()
 	unsubscribe := make(chan struct{})
+	var unsubscribeOnce sync.Once
+	stop := func() {
+		unsubscribeOnce.Do(func() { close(unsubscribe) })
+	}
+	send := func(res *ListSonosRes) {
+		resBytes, err := json.Marshal(res)
+		if err != nil {
+			stop()
+			return
+		}
+		finalBytes := append([]byte("data: "), resBytes...)
+		finalBytes = append(finalBytes, []byte("\n\n")...)
+		if _, err := w.Write(finalBytes); err != nil {
+			stop()
+			return
+		}
+		w.(http.Flusher).Flush()
+	}
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-store")
-	m.subscriptions.Subscribe(zp.AVTransport.EventEndpoint, unsubscribe, func(e string) {
+	// grouped rooms play whatever their coordinator is playing
+	coordinator := m.sonos.Coordinator(zp)
+	members := m.sonos.GroupMembers(zp)
+	m.subscriptions.Subscribe(coordinator.AVTransport.EventEndpoint, unsubscribe, func(e string) {
 		var ev sonosevs.AudioTransportEvent
 		xml.Unmarshal([]byte(e), &ev)
 		var didl sonosevs.DIDLLite
 		xml.Unmarshal([]byte(ev.InstanceID.CurrentTrackMetaData.Val), &didl)
-		pos, err := zp.AVTransport.GetPositionInfo(http.DefaultClient, &avtransport.GetPositionInfoArgs{InstanceID: 0})
+		pos, err := coordinator.AVTransport.GetPositionInfo(http.DefaultClient, &avtransport.GetPositionInfoArgs{InstanceID: 0})
 		if err != nil {
-			close(unsubscribe)
+			stop()
 			return
 		}
 		playing := ev.InstanceID.TransportState.Val == "PLAYING"
-		var albumArtURI string
-		if len(didl.Item.AlbumArtURI) > 0 {
-			if strings.HasPrefix(didl.Item.AlbumArtURI, "http://") {
-				albumArtURI = didl.Item.AlbumArtURI
-			} else {
-				albumArtURI = "http://" + zp.AVTransport.ControlEndpoint.Host + didl.Item.AlbumArtURI
-			}
+		crossfade := ev.InstanceID.CurrentCrossfadeMode.Val == "1"
+		sleepTimer, err := m.sonos.SleepTimer(coordinator)
+		if err != nil {
+			log.Printf("failed to get the sleep timer of %s: %v", coordinator.RoomName(), err)
 		}
-		resBytes, err := json.Marshal(&ListSonosRes{
+		send(&ListSonosRes{
 			Sonos: &SonosState{
 				Track:       didl.Item.Title,
 				Artist:      didl.Item.Creator,
@@ -293,120 +588,196 @@ func (m *MusicServer) GetSonos(w http.ResponseWriter, zp *sonos.ZonePlayer, req
 				Duration:    ev.InstanceID.CurrentTrackDuration.Val,
 				Playing:     &playing,
 				Position:    pos.RelTime,
-				AlbumArtURI: albumArtURI,
+				AlbumArtURI: music.SonosAlbumArtURI(coordinator, didl.Item.AlbumArtURI),
+				Queueing:    m.sonos.QueueProgress(coordinator.RoomName()),
+				PlayMode:    ev.InstanceID.CurrentPlayMode.Val,
+				Crossfade:   &crossfade,
+				SleepTimer:  sleepTimer,
 			},
 		})
-		if err != nil {
-			close(unsubscribe)
+	})
+	// listen to the volume of every room in the group to show the group mixer
+	for _, member := range members {
+		member := member
+		m.subscriptions.Subscribe(member.RenderingControl.EventEndpoint, unsubscribe, func(e string) {
+			state := &SonosState{}
+			if member == zp {
+				var ev sonosevs.RenderingControlEvent
+				xml.Unmarshal([]byte(e), &ev)
+				// after the first event a sonos only sends what has changed
+				for _, volume := range ev.InstanceID.Volume {
+					if vol, err := strconv.Atoi(volume.Val); err == nil && volume.Channel == "Master" {
+						state.Volume = &vol
+					}
+				}
+				for _, mute := range ev.InstanceID.Mute {
+					if muted := mute.Val == "1"; mute.Channel == "Master" {
+						state.Muted = &muted
+					}
+				}
+				if bass, err := strconv.Atoi(ev.InstanceID.Bass.Val); err == nil {
+					state.Bass = &bass
+				}
+				if treble, err := strconv.Atoi(ev.InstanceID.Treble.Val); err == nil {
+					state.Treble = &treble
+				}
+				if len(ev.InstanceID.Loudness.Val) > 0 {
+					loudness := ev.InstanceID.Loudness.Val == "1"
+					state.Loudness = &loudness
+				}
+			}
+			if len(members) > 1 {
+				groupVolume, err := music.GroupVolumes(coordinator, members)
+				if err != nil {
+					log.Printf("failed to get the group volume of %s: %v", coordinator.RoomName(), err)
+				}
+				state.Group = groupVolume
+			}
+			send(&ListSonosRes{Sonos: state})
+		})
+	}
+	// stop streaming if the room is switched off or drops off the network
+	roomEvents, unwatch := m.sonos.Watch()
+	defer unwatch()
+	for {
+		select {
+		case <-ctx.Done():
+			stop()
 			return
-		}
-		finalBytes := append([]byte("data: "), resBytes...)
-		finalBytes = append(finalBytes, []byte("\n\n")...)
-		if _, err := w.Write(finalBytes); err != nil {
-			close(unsubscribe)
+		case <-unsubscribe:
 			return
+		case ev := <-roomEvents:
+			if ev.Event == music.SonosRoomRemoved && ev.Room == zp.RoomName() {
+				stop()
+				return
+			}
 		}
-		w.(http.Flusher).Flush()
-	})
-	m.subscriptions.Subscribe(zp.RenderingControl.EventEndpoint, unsubscribe, func(e string) {
-		var ev sonosevs.RenderingControlEvent
-		xml.Unmarshal([]byte(e), &ev)
-		var volume int64
-		if len(ev.InstanceID.Volume) > 0 {
-			volume, _ = strconv.ParseInt(ev.InstanceID.Volume[0].Val, 10, 32)
+	}
+}
+
+// how often to check for players that have moved while recording what the rooms play
+const sonosPlaysCheckInterval = time.Minute
+
+// trackSonosPlays listens to the events of every room, whether or not anyone has it open, to record the
+// songs played on them in the history. The rooms are checked when they come and go, and every so often
+// in case a player has moved to a new address.
+func (m *MusicServer) trackSonosPlays() {
+	roomEvents, unwatch := m.sonos.Watch()
+	defer unwatch()
+	subscribed := make(map[string]chan struct{})
+	for {
+		players := make(map[string]*sonos.ZonePlayer)
+		for _, room := range m.sonos.Rooms() {
+			if zp := m.sonos.Player(room); zp != nil {
+				players[zp.AVTransport.EventEndpoint.String()] = zp
+			}
 		}
-		vol := int(volume)
-		resBytes, err := json.Marshal(&ListSonosRes{
-			Sonos: &SonosState{Volume: &vol},
-		})
+		for endpoint, unsubscribe := range subscribed {
+			if _, ok := players[endpoint]; !ok {
+				close(unsubscribe)
+				delete(subscribed, endpoint)
+			}
+		}
+		for endpoint, zp := range players {
+			if _, ok := subscribed[endpoint]; ok {
+				continue
+			}
+			zp, unsubscribe := zp, make(chan struct{})
+			subscribed[endpoint] = unsubscribe
+			m.subscriptions.Subscribe(zp.AVTransport.EventEndpoint, unsubscribe, func(e string) {
+				// grouped rooms play whatever their coordinator is playing, which is only counted once
+				if m.sonos.Coordinator(zp) != zp {
+					return
+				}
+				var ev sonosevs.AudioTransportEvent
+				xml.Unmarshal([]byte(e), &ev)
+				m.index.TrackSonosPlay(zp.RoomName(), ev.InstanceID.CurrentTrackURI.Val, ev.InstanceID.TransportState.Val)
+			})
+		}
+		select {
+		case <-roomEvents:
+		case <-time.After(sonosPlaysCheckInterval):
+		}
+	}
+}
+
+// SonosRooms streams the rooms as they are found on the network or disappear from it, starting with
+// the rooms there are now.
+func (m *MusicServer) SonosRooms(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	roomEvents, unwatch := m.sonos.Watch()
+	defer unwatch()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	ev := music.SonosRoomEvent{Rooms: m.sonos.Rooms()}
+	for {
+		resBytes, err := json.Marshal(ev)
 		if err != nil {
-			close(unsubscribe)
 			return
 		}
 		finalBytes := append([]byte("data: "), resBytes...)
 		finalBytes = append(finalBytes, []byte("\n\n")...)
 		if _, err := w.Write(finalBytes); err != nil {
-			close(unsubscribe)
 			return
 		}
 		w.(http.Flusher).Flush()
-	})
-	select {
-	case <-ctx.Done():
-		close(unsubscribe)
-	case <-unsubscribe:
+		select {
+		case <-ctx.Done():
+			return
+		case ev = <-roomEvents:
+		}
 	}
 }
 
 func (m *MusicServer) ListSonos(w http.ResponseWriter, req *http.Request) {
 	sonosName, bit, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/api/sonos/"), "/")
-	m.sonos.ZonePlayersMu.RLock()
-	defer m.sonos.ZonePlayersMu.RUnlock()
+	if sonosName == "events" && len(bit) == 0 && req.Method == "GET" {
+		m.SonosRooms(w, req)
+		return
+	}
+	if sonosName == "alarms" {
+		WrapApi(func(req *http.Request) (*AlarmsRes, error) {
+			return m.SonosAlarms(bit, req)
+		})(w, req)
+		return
+	}
 	if len(sonosName) > 0 {
-		for _, zp := range m.sonos.ZonePlayers {
-			if zp.RoomName() == sonosName {
-				if req.Method == "POST" && bit == "action" {
-					WrapApi(func(req *http.Request) (*ListSonosRes, error) {
-						var actionReq ActionRequest
-						if err := json.NewDecoder(req.Body).Decode(&actionReq); err != nil {
-							return nil, NewHttpError(err, 400)
-						}
-						if actionReq.Volume != nil && *actionReq.Volume >= 0 && *actionReq.Volume <= 100 {
-							if err := zp.SetVolume(*actionReq.Volume); err != nil {
-								return nil, err
-							}
-						}
-						switch actionReq.Action {
-						case "Play":
-							if _, err := zp.AVTransport.Play(zp.HttpClient, &avtransport.PlayArgs{InstanceID: 0, Speed: "1"}); err != nil {
-								return nil, err
-							}
-						case "Pause":
-							if _, err := zp.AVTransport.Pause(zp.HttpClient, &avtransport.PauseArgs{InstanceID: 0}); err != nil {
-								return nil, err
-							}
-						case "Next":
-							if _, err := zp.AVTransport.Next(zp.HttpClient, &avtransport.NextArgs{InstanceID: 0}); err != nil {
-								return nil, err
-							}
-						case "Prev":
-							if _, err := zp.AVTransport.Previous(zp.HttpClient, &avtransport.PreviousArgs{InstanceID: 0}); err != nil {
-								return nil, err
-							}
-						}
-						if len(actionReq.SongIDs) > 0 {
-							if _, err := zp.AVTransport.RemoveAllTracksFromQueue(zp.HttpClient, &avtransport.RemoveAllTracksFromQueueArgs{InstanceID: 0}); err != nil {
-								return nil, err
-							}
-							if len(actionReq.SongIDs) > 30 {
-								actionReq.SongIDs = actionReq.SongIDs[0:30]
-							}
-							for _, songId := range actionReq.SongIDs {
-								if _, err := zp.AVTransport.AddURIToQueue(zp.HttpClient, &avtransport.AddURIToQueueArgs{InstanceID: 0, EnqueuedURI: m.toSonosSongUri(songId), EnqueuedURIMetaData: m.toSonosSongMetadata(songId)}); err != nil {
-									return nil, err
-								}
-							}
-							udn := strings.TrimPrefix(zp.Root.Device.UDN, "uuid:")
-							if _, err := zp.AVTransport.SetAVTransportURI(http.DefaultClient, &avtransport.SetAVTransportURIArgs{InstanceID: 0, CurrentURI: "x-rincon-queue:" + udn + "#0"}); err != nil {
-								return nil, err
-							}
-							if _, err := zp.AVTransport.Play(zp.HttpClient, &avtransport.PlayArgs{InstanceID: 0, Speed: "1"}); err != nil {
-								return nil, err
-							}
-						}
-						if actionReq.SetTimeSecs != nil {
-							seekStr := fmt.Sprintf("%02d:%02d:%02d", *actionReq.SetTimeSecs/(60*60), *actionReq.SetTimeSecs/60, *actionReq.SetTimeSecs%60)
-							if _, err := zp.AVTransport.Seek(zp.HttpClient, &avtransport.SeekArgs{InstanceID: 0, Unit: "REL_TIME", Target: seekStr}); err != nil {
-								return nil, err
-							}
-						}
-						return &ListSonosRes{}, nil
-					})(w, req)
-					return
-				} else if req.Method == "GET" && bit == "events" {
-					m.GetSonos(w, zp, req)
-					return
-				}
+		if zp := m.sonos.Player(sonosName); zp != nil {
+			if req.Method == "POST" && bit == "action" {
+				WrapApi(func(req *http.Request) (*ListSonosRes, error) {
+					var actionReq ActionRequest
+					if err := json.NewDecoder(req.Body).Decode(&actionReq); err != nil {
+						return nil, NewHttpError(err, 400)
+					}
+					if err := m.sonosAction(zp, &actionReq); err != nil {
+						return nil, err
+					}
+					return &ListSonosRes{}, nil
+				})(w, req)
+				return
+			} else if req.Method == "GET" && bit == "events" {
+				m.GetSonos(w, zp, req)
+				return
+			} else if bit == "queue" || strings.HasPrefix(bit, "queue/") {
+				WrapApi(func(req *http.Request) (*music.SonosQueue, error) {
+					return m.SonosQueue(m.sonos.Coordinator(zp), strings.TrimPrefix(strings.TrimPrefix(bit, "queue"), "/"), req)
+				})(w, req)
+				return
+			} else if req.Method == "POST" && (bit == "join" || bit == "leave" || bit == "party") {
+				WrapApi(func(req *http.Request) (*ListSonosRes, error) {
+					return m.SonosGroup(zp, bit, req)
+				})(w, req)
+				return
+			} else if bit == "sleep" {
+				WrapApi(func(req *http.Request) (*music.SleepTimer, error) {
+					return m.SonosSleep(m.sonos.Coordinator(zp), req)
+				})(w, req)
+				return
+			} else if req.Method == "POST" && bit == "announce" {
+				WrapApi(func(req *http.Request) (*ListSonosRes, error) {
+					return m.SonosAnnounce(w, zp, req)
+				})(w, req)
+				return
 			}
 		}
 		WrapApi(func(req *http.Request) (*ListSonosRes, error) {
@@ -415,37 +786,868 @@ func (m *MusicServer) ListSonos(w http.ResponseWriter, req *http.Request) {
 	} else {
 		WrapApi(func(req *http.Request) (*ListSonosRes, error) {
 			if req.Method == "GET" {
-				rooms := make([]string, 0, len(m.sonos.ZonePlayers))
-				for _, zp := range m.sonos.ZonePlayers {
-					rooms = append(rooms, zp.RoomName())
+				groups, err := m.sonos.Groups()
+				if err != nil {
+					log.Printf("failed to get sonos groups: %v", err)
 				}
-				sort.Strings(rooms)
-				return &ListSonosRes{Rooms: rooms}, nil
+				return &ListSonosRes{Rooms: m.sonos.Rooms(), Groups: groups}, nil
 			}
 			return nil, NewHttpError(fmt.Errorf("bad method"), 400)
 		})(w, req)
 	}
 }
 
+// sonosAction plays, pauses, queues songs on or changes the volume of a room, for a POST to its action
+// endpoint or a scheduled job.
+func (m *MusicServer) sonosAction(zp *sonos.ZonePlayer, actionReq *ActionRequest) error {
+	if actionReq.Volume != nil && *actionReq.Volume >= 0 && *actionReq.Volume <= 100 {
+		if err := zp.SetVolume(*actionReq.Volume); err != nil {
+			return err
+		}
+	}
+	if actionReq.Mute != nil {
+		if err := m.sonos.SetMute(zp, *actionReq.Mute); err != nil {
+			return err
+		}
+	}
+	if actionReq.Bass != nil {
+		if err := m.sonos.SetBass(zp, *actionReq.Bass); errors.Is(err, music.ErrBadEQ) {
+			return NewHttpError(err, 400)
+		} else if err != nil {
+			return err
+		}
+	}
+	if actionReq.Treble != nil {
+		if err := m.sonos.SetTreble(zp, *actionReq.Treble); errors.Is(err, music.ErrBadEQ) {
+			return NewHttpError(err, 400)
+		} else if err != nil {
+			return err
+		}
+	}
+	if actionReq.Loudness != nil {
+		if err := m.sonos.SetLoudness(zp, *actionReq.Loudness); err != nil {
+			return err
+		}
+	}
+	if actionReq.GroupVolume != nil && *actionReq.GroupVolume >= 0 && *actionReq.GroupVolume <= 100 {
+		if err := m.sonos.SetGroupVolume(zp, *actionReq.GroupVolume); err != nil {
+			return err
+		}
+	}
+	if actionReq.GroupVolumeChange != nil {
+		if err := m.sonos.AdjustGroupVolume(zp, *actionReq.GroupVolumeChange); err != nil {
+			return err
+		}
+	}
+	if actionReq.GroupMute != nil {
+		if err := m.sonos.SetGroupMute(zp, *actionReq.GroupMute); err != nil {
+			return err
+		}
+	}
+	// transport commands have to go to the coordinator of a group
+	coordinator := m.sonos.Coordinator(zp)
+	switch actionReq.Action {
+	case "Play":
+		if _, err := coordinator.AVTransport.Play(coordinator.HttpClient, &avtransport.PlayArgs{InstanceID: 0, Speed: "1"}); err != nil {
+			return err
+		}
+	case "Pause":
+		if _, err := coordinator.AVTransport.Pause(coordinator.HttpClient, &avtransport.PauseArgs{InstanceID: 0}); err != nil {
+			return err
+		}
+	case "Next":
+		if _, err := coordinator.AVTransport.Next(coordinator.HttpClient, &avtransport.NextArgs{InstanceID: 0}); err != nil {
+			return err
+		}
+	case "Prev":
+		if _, err := coordinator.AVTransport.Previous(coordinator.HttpClient, &avtransport.PreviousArgs{InstanceID: 0}); err != nil {
+			return err
+		}
+	}
+	if actionReq.PlayMode != nil {
+		if err := m.sonos.SetPlayMode(coordinator, *actionReq.PlayMode); errors.Is(err, music.ErrBadPlayMode) {
+			return NewHttpError(err, 400)
+		} else if err != nil {
+			return err
+		}
+	}
+	if actionReq.Crossfade != nil {
+		if err := m.sonos.SetCrossfade(coordinator, *actionReq.Crossfade); err != nil {
+			return err
+		}
+	}
+	var err error
+	if actionReq.SongIDs, err = m.sourceSongIds(actionReq.SongIDs, actionReq.Playlist, actionReq.Album, actionReq.Artist); err != nil {
+		return err
+	}
+	if len(actionReq.SongIDs) > 0 {
+		startIdx := 0
+		if actionReq.FromTrack > 0 {
+			startIdx = actionReq.FromTrack - 1
+		}
+		if err := m.queueSongs(coordinator, actionReq.SongIDs, startIdx); err != nil {
+			return err
+		}
+	}
+	if actionReq.SetTimeSecs != nil {
+		seekStr := fmt.Sprintf("%02d:%02d:%02d", *actionReq.SetTimeSecs/(60*60), *actionReq.SetTimeSecs/60, *actionReq.SetTimeSecs%60)
+		if _, err := coordinator.AVTransport.Seek(coordinator.HttpClient, &avtransport.SeekArgs{InstanceID: 0, Unit: "REL_TIME", Target: seekStr}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SonosGroup joins a room to the group of another room, takes it out of its group or joins every room
+// to its group for a party.
+func (m *MusicServer) SonosGroup(zp *sonos.ZonePlayer, action string, req *http.Request) (*ListSonosRes, error) {
+	var err error
+	switch action {
+	case "join":
+		var groupReq GroupRequest
+		if err := json.NewDecoder(req.Body).Decode(&groupReq); err != nil {
+			return nil, NewHttpError(err, 400)
+		}
+		other := m.sonos.Player(groupReq.Room)
+		if other == nil {
+			return nil, NewHttpError(fmt.Errorf("room %s not found", groupReq.Room), 404)
+		}
+		err = m.sonos.JoinGroup(zp, other)
+	case "leave":
+		err = m.sonos.LeaveGroup(zp)
+	case "party":
+		err = m.sonos.PartyMode(zp)
+	}
+	if errors.Is(err, music.ErrBadGroup) {
+		return nil, NewHttpError(err, 400)
+	} else if err != nil {
+		return nil, err
+	}
+	groups, err := m.sonos.Groups()
+	if err != nil {
+		return nil, err
+	}
+	return &ListSonosRes{Groups: groups}, nil
+}
+
+// SonosSleep gets, sets or cancels the sleep timer of a group.
+func (m *MusicServer) SonosSleep(zp *sonos.ZonePlayer, req *http.Request) (*music.SleepTimer, error) {
+	switch req.Method {
+	case "GET":
+	case "PUT", "POST":
+		var sleepReq SleepRequest
+		if err := json.NewDecoder(req.Body).Decode(&sleepReq); err != nil {
+			return nil, NewHttpError(err, 400)
+		}
+		if err := m.sonos.SetSleepTimer(zp, time.Duration(sleepReq.Minutes)*time.Minute, sleepReq.Fade); errors.Is(err, music.ErrBadSleepTimer) {
+			return nil, NewHttpError(err, 400)
+		} else if err != nil {
+			return nil, err
+		}
+	case "DELETE":
+		if err := m.sonos.SetSleepTimer(zp, 0, false); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, NewHttpError(fmt.Errorf("bad method"), 400)
+	}
+	return m.sonos.SleepTimer(zp)
+}
+
+// SonosAnnounce plays a clip on the group of a room and then puts back what it was playing, returning
+// once it has. The clip is either a file in the library given as JSON, or a multipart form with the
+// file as clip and an optional Volume.
+func (m *MusicServer) SonosAnnounce(w http.ResponseWriter, zp *sonos.ZonePlayer, req *http.Request) (*ListSonosRes, error) {
+	var announceReq AnnounceRequest
+	var clipPath, uri string
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		req.Body = http.MaxBytesReader(w, req.Body, 20<<20)
+		file, header, err := req.FormFile("clip")
+		if err != nil {
+			return nil, NewHttpError(err, 400)
+		}
+		defer file.Close()
+		if volume := req.FormValue("Volume"); len(volume) > 0 {
+			v, err := strconv.Atoi(volume)
+			if err != nil {
+				return nil, NewHttpError(fmt.Errorf("bad volume %q", volume), 400)
+			}
+			announceReq.Volume = &v
+		}
+		ext := path.Ext(header.Filename)
+		if len(ext) == 0 {
+			ext = ".mp3"
+		}
+		clip, err := os.CreateTemp(m.announceFolder, "clip-*"+ext)
+		if err != nil {
+			return nil, err
+		}
+		clipPath = clip.Name()
+		defer os.Remove(clipPath)
+		_, err = io.Copy(clip, file)
+		clip.Close()
+		if err != nil {
+			return nil, NewHttpError(err, 400)
+		}
+		announceReq.Path = header.Filename
+		uri = m.internalAddr + "/announcements/" + path.Base(clipPath)
+	} else {
+		if err := json.NewDecoder(req.Body).Decode(&announceReq); err != nil {
+			return nil, NewHttpError(err, 400)
+		}
+		libraryPath := path.Clean("/" + announceReq.Path)
+		clipPath = path.Join(*sourceFolder, libraryPath)
+		if info, err := os.Stat(clipPath); err != nil || info.IsDir() {
+			return nil, NewHttpError(fmt.Errorf("no clip at %s", libraryPath), 404)
+		}
+		uri = m.internalAddr + "/content" + strings.ReplaceAll(libraryPath, " ", "%20")
+	}
+	duration, err := music.ProbeDuration(clipPath)
+	if err != nil {
+		// the clip still plays, it just can't be cut short if the sonos doesn't stop by itself
+		log.Printf("failed to find how long %s is: %v", clipPath, err)
+	}
+	title := strings.TrimSuffix(path.Base(announceReq.Path), path.Ext(announceReq.Path))
+	err = m.sonos.Announce(zp, music.Announcement{URI: uri, Title: title, Duration: duration, Volume: announceReq.Volume})
+	if errors.Is(err, music.ErrBadAnnouncement) {
+		return nil, NewHttpError(err, 400)
+	} else if errors.Is(err, music.ErrAnnouncing) {
+		return nil, NewHttpError(err, 409)
+	} else if err != nil {
+		return nil, err
+	}
+	return &ListSonosRes{}, nil
+}
+
+// SonosAlarms lists the sonos alarms, creates one or changes or removes the alarm with id.
+func (m *MusicServer) SonosAlarms(id string, req *http.Request) (*AlarmsRes, error) {
+	var alarm *music.SonosAlarm
+	switch {
+	case req.Method == "GET" && len(id) == 0:
+	case req.Method == "POST" && len(id) == 0:
+		var alarmReq AlarmRequest
+		if err := json.NewDecoder(req.Body).Decode(&alarmReq); err != nil {
+			return nil, NewHttpError(err, 400)
+		}
+		newAlarm := music.SonosAlarm{Duration: "01:00:00", Recurrence: "DAILY", Enabled: true, Volume: 20, PlayMode: "NORMAL"}
+		alarmReq.apply(&newAlarm)
+		source, err := m.alarmSource(&alarmReq)
+		if err != nil {
+			return nil, err
+		}
+		if alarm, err = m.sonos.CreateAlarm(newAlarm, source); err != nil {
+			return nil, alarmError(err)
+		}
+	case (req.Method == "PUT" || req.Method == "DELETE") && len(id) > 0:
+		alarmID, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, NewHttpError(fmt.Errorf("bad alarm id %s", id), 400)
+		}
+		if req.Method == "DELETE" {
+			if err := m.sonos.DeleteAlarm(alarmID); err != nil {
+				return nil, alarmError(err)
+			}
+			break
+		}
+		var alarmReq AlarmRequest
+		if err := json.NewDecoder(req.Body).Decode(&alarmReq); err != nil {
+			return nil, NewHttpError(err, 400)
+		}
+		if alarm, err = m.sonos.Alarm(alarmID); err != nil {
+			return nil, alarmError(err)
+		}
+		alarmReq.apply(alarm)
+		source, err := m.alarmSource(&alarmReq)
+		if err != nil {
+			return nil, err
+		}
+		if alarm, err = m.sonos.UpdateAlarm(*alarm, source); err != nil {
+			return nil, alarmError(err)
+		}
+	default:
+		return nil, NewHttpError(fmt.Errorf("bad method"), 400)
+	}
+	alarms, err := m.sonos.Alarms()
+	if err != nil {
+		return nil, alarmError(err)
+	}
+	return &AlarmsRes{Alarms: alarms, Alarm: alarm}, nil
+}
+
+// apply sets the fields of an alarm included in the request.
+func (r *AlarmRequest) apply(alarm *music.SonosAlarm) {
+	if r.Room != nil {
+		alarm.Room = *r.Room
+	}
+	if r.StartTime != nil {
+		alarm.StartTime = *r.StartTime
+	}
+	if r.Duration != nil {
+		alarm.Duration = *r.Duration
+	}
+	if r.Recurrence != nil {
+		alarm.Recurrence = *r.Recurrence
+	}
+	if r.Enabled != nil {
+		alarm.Enabled = *r.Enabled
+	}
+	if r.Volume != nil {
+		alarm.Volume = *r.Volume
+	}
+	if r.PlayMode != nil {
+		alarm.PlayMode = *r.PlayMode
+	}
+	if r.IncludeLinkedZones != nil {
+		alarm.IncludeLinkedZones = *r.IncludeLinkedZones
+	}
+}
+
+// alarmSource returns the album or playlist an alarm should play, or nil if the request has neither.
+func (m *MusicServer) alarmSource(r *AlarmRequest) (*music.AlarmSource, error) {
+	var title string
+	if r.Playlist != nil {
+		playlist, _, err := m.index.Playlist(*r.Playlist)
+		if err != nil {
+			return nil, indexError(err)
+		}
+		title = playlist.Name
+	} else if r.Album != nil {
+		title = *r.Album
+	} else {
+		return nil, nil
+	}
+	songIds, err := m.sourceSongIds(nil, r.Playlist, r.Album, nil)
+	if err != nil {
+		return nil, err
+	}
+	tracks, _, err := m.sonosTracks(songIds, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &music.AlarmSource{Title: title, Tracks: tracks}, nil
+}
+
+func alarmError(err error) error {
+	if errors.Is(err, music.ErrBadAlarm) {
+		return NewHttpError(err, 400)
+	}
+	if errors.Is(err, music.ErrNotFound) {
+		return NewHttpError(err, 404)
+	}
+	return err
+}
+
 type SearchResponse struct {
-	Results []Result
+	Results   []Result
+	Counts    music.SearchCounts
+	Truncated bool
+	// Cursor fetches the next page of results when passed as ?cursor=
+	Cursor string `json:",omitempty"`
 }
 
 func (m *MusicServer) SearchMusic(req *http.Request) (*SearchResponse, error) {
-	res := m.index.Search(strings.TrimPrefix(req.URL.Path, "/api/search/"))
-	results := make([]Result, len(res))
-	for idx, r := range res {
+	resultType := req.URL.Query().Get("type")
+	switch resultType {
+	case "", music.SearchArtists, music.SearchAlbums, music.SearchSongs:
+	default:
+		return nil, NewHttpError(fmt.Errorf("bad result type %s", resultType), 400)
+	}
+	var offset int
+	if cursor := req.URL.Query().Get("cursor"); len(cursor) > 0 {
+		cursorBytes, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, NewHttpError(fmt.Errorf("bad cursor"), 400)
+		}
+		if offset, err = strconv.Atoi(string(cursorBytes)); err != nil || offset < 0 {
+			return nil, NewHttpError(fmt.Errorf("bad cursor"), 400)
+		}
+	}
+	var page *music.SearchPage
+	for {
+		var err error
+		page, err = m.index.Search(strings.TrimPrefix(req.URL.Path, "/api/search/"), resultType, offset, music.MaxSearchResults)
+		if err != nil {
+			var queryError *music.QueryError
+			if errors.As(err, &queryError) {
+				return nil, NewHttpError(err, 400)
+			}
+			return nil, err
+		}
+		m.index.SongsMu.Lock()
+		// a scan finishing since the search changes what the ids refer to, so search the new library
+		if page.Generation == m.index.Generation() {
+			break
+		}
+		m.index.SongsMu.Unlock()
+	}
+	defer m.index.SongsMu.Unlock()
+	results := make([]Result, len(page.Results))
+	for idx, r := range page.Results {
 		if r.SongId != -1 {
 			song := m.index.Songs[r.SongId]
 			album := &m.index.Albums[m.index.AlbumIdByName[song.Album]]
 			results[idx] = m.songResult(album, r.SongId)
 		} else if r.AlbumId != -1 {
-			results[idx] = albumResult(&m.index.Albums[r.AlbumId], false)
+			results[idx] = m.albumResult(&m.index.Albums[r.AlbumId], false)
 		} else if r.ArtistId != -1 {
 			results[idx] = artistResult(&m.index.Artists[r.ArtistId])
 		}
 	}
-	return &SearchResponse{Results: results}, nil
+	res := &SearchResponse{Results: results, Counts: page.Counts, Truncated: page.Next != -1}
+	if page.Next != -1 {
+		res.Cursor = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(page.Next)))
+	}
+	return res, nil
+}
+
+type AlbumArtRes struct {
+	Candidates []music.ArtCandidate `json:",omitempty"`
+}
+
+type AlbumArtRequest struct {
+	Candidate string
+}
+
+func indexError(err error) error {
+	if errors.Is(err, music.ErrNotFound) {
+		return NewHttpError(err, 404)
+	}
+	if errors.Is(err, music.ErrBadImage) || errors.Is(err, music.ErrBadPlaylist) || errors.Is(err, music.ErrBadPlay) || errors.Is(err, music.ErrBadRating) {
+		return NewHttpError(err, 400)
+	}
+	return err
+}
+
+func (m *MusicServer) AlbumArt(w http.ResponseWriter, req *http.Request) {
+	albumName := strings.TrimPrefix(req.URL.Path, "/api/albumart/")
+	if req.Method == "GET" && strings.HasSuffix(albumName, "/embedded") {
+		pic, err := m.index.EmbeddedAlbumArt(strings.TrimSuffix(albumName, "/embedded"))
+		if err != nil {
+			WrapApi(func(req *http.Request) (*AlbumArtRes, error) {
+				return nil, indexError(err)
+			})(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", pic.MIMEType)
+		_, _ = w.Write(pic.Data)
+		return
+	}
+	WrapApi(func(req *http.Request) (*AlbumArtRes, error) {
+		switch req.Method {
+		case "GET":
+			candidates, err := m.index.AlbumArtCandidates(albumName)
+			if err != nil {
+				return nil, indexError(err)
+			}
+			for idx := range candidates {
+				switch candidates[idx].Source {
+				case "folder":
+					candidates[idx].URL = "/content" + candidates[idx].Path
+				case "embedded":
+					candidates[idx].URL = "/api/albumart/" + albumName + "/embedded"
+				}
+			}
+			return &AlbumArtRes{Candidates: candidates}, nil
+		case "POST":
+			// an image is checked for being a jpeg or png whatever type it says it is
+			if strings.HasPrefix(req.Header.Get("Content-Type"), "image/") {
+				if err := m.index.UploadAlbumArt(albumName, http.MaxBytesReader(w, req.Body, 20<<20)); err != nil {
+					return nil, indexError(err)
+				}
+				return &AlbumArtRes{}, nil
+			}
+			var artReq AlbumArtRequest
+			if err := json.NewDecoder(req.Body).Decode(&artReq); err != nil {
+				return nil, NewHttpError(err, 400)
+			}
+			if err := m.index.SetAlbumArt(albumName, artReq.Candidate); err != nil {
+				return nil, indexError(err)
+			}
+			return &AlbumArtRes{}, nil
+		}
+		return nil, NewHttpError(fmt.Errorf("bad method"), 400)
+	})(w, req)
+}
+
+type ArtLookupsRes struct {
+	Failures []music.ArtLookup
+	Retrying int
+}
+
+type ArtLookupRetryRequest struct {
+	Album string // retry every failed lookup if empty
+}
+
+func (m *MusicServer) ArtLookups(req *http.Request) (*ArtLookupsRes, error) {
+	action := strings.TrimPrefix(req.URL.Path, "/api/artlookups/")
+	if req.Method == "GET" && action == "" {
+		return &ArtLookupsRes{Failures: m.index.ArtLookupFailures()}, nil
+	} else if req.Method == "POST" && action == "retry" {
+		var retryReq ArtLookupRetryRequest
+		if err := json.NewDecoder(req.Body).Decode(&retryReq); err != nil && !errors.Is(err, io.EOF) {
+			return nil, NewHttpError(err, 400)
+		}
+		numRetries, err := m.index.RetryArtLookups(retryReq.Album)
+		if err != nil {
+			return nil, err
+		}
+		return &ArtLookupsRes{Failures: []music.ArtLookup{}, Retrying: numRetries}, nil
+	}
+	return nil, NewHttpError(errors.New("bad request"), 400)
+}
+
+type PlaylistsRes struct {
+	Playlists []music.PlaylistInfo `json:",omitempty"`
+	Playlist  *music.Playlist      `json:",omitempty"`
+	Results   []Result             `json:",omitempty"`
+}
+
+type PlaylistRequest struct {
+	Name    string
+	SongIDs []int // leaves the songs alone when updating if missing
+	Smart   *music.SmartRules
+}
+
+// songResults returns the results for a list of songs, skipping any that are no longer in the index.
+func (m *MusicServer) songResults(songIds []int) []Result {
+	m.index.SongsMu.Lock()
+	defer m.index.SongsMu.Unlock()
+	results := make([]Result, 0, len(songIds))
+	for _, songId := range songIds {
+		if songId < 0 || songId >= len(m.index.Songs) {
+			continue
+		}
+		albumIdx, ok := m.index.AlbumIdByName[m.index.Songs[songId].Album]
+		if !ok {
+			continue
+		}
+		results = append(results, m.songResult(&m.index.Albums[albumIdx], songId))
+	}
+	return results
+}
+
+func (m *MusicServer) Playlists(w http.ResponseWriter, req *http.Request) {
+	idStr, action, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/api/playlists/"), "/")
+	if req.Method == "GET" && action == "export" {
+		id, err := strconv.Atoi(idStr)
+		if err == nil {
+			var playlist *music.Playlist
+			if playlist, _, err = m.index.Playlist(id); err == nil {
+				w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", playlist.Name+".m3u8"))
+				err = m.index.ExportPlaylist(id, w)
+			}
+		}
+		if err != nil {
+			WrapApi(func(req *http.Request) (*PlaylistsRes, error) {
+				return nil, indexError(err)
+			})(w, req)
+		}
+		return
+	}
+	WrapApi(func(req *http.Request) (*PlaylistsRes, error) {
+		if len(idStr) == 0 {
+			switch req.Method {
+			case "GET":
+				return &PlaylistsRes{Playlists: m.index.Playlists()}, nil
+			case "POST":
+				var playlistReq PlaylistRequest
+				if err := json.NewDecoder(req.Body).Decode(&playlistReq); err != nil {
+					return nil, NewHttpError(err, 400)
+				}
+				playlist, err := m.index.CreatePlaylist(playlistReq.Name, playlistReq.SongIDs, playlistReq.Smart)
+				if err != nil {
+					return nil, indexError(err)
+				}
+				return &PlaylistsRes{Playlist: playlist}, nil
+			}
+			return nil, NewHttpError(fmt.Errorf("bad method"), 400)
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil || len(action) > 0 {
+			return nil, NewHttpError(errors.New("bad request"), 400)
+		}
+		switch req.Method {
+		case "GET":
+			playlist, songIds, err := m.index.Playlist(id)
+			if err != nil {
+				return nil, indexError(err)
+			}
+			return &PlaylistsRes{Playlist: playlist, Results: m.songResults(songIds)}, nil
+		case "PUT":
+			var playlistReq PlaylistRequest
+			if err := json.NewDecoder(req.Body).Decode(&playlistReq); err != nil {
+				return nil, NewHttpError(err, 400)
+			}
+			playlist, err := m.index.UpdatePlaylist(id, playlistReq.Name, playlistReq.SongIDs, playlistReq.Smart)
+			if err != nil {
+				return nil, indexError(err)
+			}
+			return &PlaylistsRes{Playlist: playlist}, nil
+		case "DELETE":
+			if err := m.index.DeletePlaylist(id); err != nil {
+				return nil, indexError(err)
+			}
+			return &PlaylistsRes{}, nil
+		}
+		return nil, NewHttpError(fmt.Errorf("bad method"), 400)
+	})(w, req)
+}
+
+type PlayRequest struct {
+	SongId int
+	Event  string // start or complete
+}
+
+func (m *MusicServer) History(req *http.Request) (*ListMusicRes, error) {
+	view := strings.TrimPrefix(req.URL.Path, "/api/history/")
+	if req.Method == "POST" && view == "" {
+		var playReq PlayRequest
+		if err := json.NewDecoder(req.Body).Decode(&playReq); err != nil {
+			return nil, NewHttpError(err, 400)
+		}
+		if err := m.index.RecordPlay(playReq.SongId, playReq.Event); err != nil {
+			return nil, indexError(err)
+		}
+		return &ListMusicRes{Results: []Result{}}, nil
+	} else if req.Method == "GET" {
+		limit := 100
+		if limitStr := req.URL.Query().Get("limit"); len(limitStr) > 0 {
+			var err error
+			if limit, err = strconv.Atoi(limitStr); err != nil {
+				return nil, NewHttpError(fmt.Errorf("bad limit"), 400)
+			}
+		}
+		switch view {
+		case "recent":
+			return &ListMusicRes{Results: m.songResults(m.index.RecentlyPlayed(limit))}, nil
+		case "mostplayed":
+			return &ListMusicRes{Results: m.songResults(m.index.MostPlayed(limit))}, nil
+		}
+	}
+	return nil, NewHttpError(errors.New("bad request"), 400)
+}
+
+// ScheduleRequest creates or changes a scheduled job. Fields left out keep their value, and a new job is
+// enabled unless it says otherwise.
+type ScheduleRequest struct {
+	Name     *string
+	Schedule *string // cron expression such as "0 7 * * mon-fri"
+	Room     *string
+	// what to do, the same as a POST to /api/sonos/<room>/action
+	Action json.RawMessage
+	// turn the volume up from nothing to the Volume of the action over this many minutes
+	FadeMinutes *int
+	Enabled     *bool
+}
+
+type SchedulesRes struct {
+	Jobs []scheduler.JobStatus `json:",omitempty"`
+	Job  *scheduler.JobStatus  `json:",omitempty"`
+	Runs []scheduler.Run       `json:",omitempty"`
+}
+
+// Schedules lists, adds, changes, removes and runs the jobs the server runs on a schedule, and lists
+// the latest runs with GET /api/schedules/runs.
+func (m *MusicServer) Schedules(req *http.Request) (*SchedulesRes, error) {
+	idStr, bit, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/api/schedules/"), "/")
+	if len(idStr) == 0 {
+		switch req.Method {
+		case "GET":
+			return &SchedulesRes{Jobs: m.scheduler.Jobs()}, nil
+		case "POST":
+			job := scheduler.Job{Enabled: true}
+			if err := decodeSchedule(req, &job); err != nil {
+				return nil, err
+			}
+			status, err := m.scheduler.AddJob(job)
+			if err != nil {
+				return nil, scheduleError(err)
+			}
+			return &SchedulesRes{Job: status}, nil
+		}
+		return nil, NewHttpError(fmt.Errorf("bad method"), 400)
+	}
+	if idStr == "runs" && req.Method == "GET" {
+		limit := 100
+		if limitStr := req.URL.Query().Get("limit"); len(limitStr) > 0 {
+			var err error
+			if limit, err = strconv.Atoi(limitStr); err != nil || limit < 0 {
+				return nil, NewHttpError(fmt.Errorf("bad limit"), 400)
+			}
+		}
+		runs, err := m.scheduler.Runs(limit)
+		if err != nil {
+			return nil, err
+		}
+		return &SchedulesRes{Runs: runs}, nil
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return nil, NewHttpError(fmt.Errorf("bad schedule id %s", idStr), 400)
+	}
+	status, err := m.scheduler.Job(id)
+	if err != nil {
+		return nil, scheduleError(err)
+	}
+	switch {
+	case req.Method == "GET" && len(bit) == 0:
+	case req.Method == "PUT" && len(bit) == 0:
+		if err := decodeSchedule(req, &status.Job); err != nil {
+			return nil, err
+		}
+		if status, err = m.scheduler.UpdateJob(status.Job); err != nil {
+			return nil, scheduleError(err)
+		}
+	case req.Method == "DELETE" && len(bit) == 0:
+		if err := m.scheduler.DeleteJob(id); err != nil {
+			return nil, scheduleError(err)
+		}
+		return &SchedulesRes{Jobs: m.scheduler.Jobs()}, nil
+	case req.Method == "POST" && bit == "run":
+		run, err := m.scheduler.RunJob(id)
+		var httpError *HttpError
+		if errors.Is(err, scheduler.ErrNotFound) || errors.As(err, &httpError) {
+			return nil, scheduleError(err)
+		} else if err != nil {
+			// the sonos failed to do the action
+			return nil, NewHttpError(err, 502)
+		}
+		return &SchedulesRes{Job: status, Runs: []scheduler.Run{*run}}, nil
+	default:
+		return nil, NewHttpError(errors.New("bad request"), 400)
+	}
+	return &SchedulesRes{Job: status}, nil
+}
+
+// decodeSchedule sets the fields of a job included in a ScheduleRequest.
+func decodeSchedule(req *http.Request, job *scheduler.Job) error {
+	var scheduleReq ScheduleRequest
+	if err := json.NewDecoder(req.Body).Decode(&scheduleReq); err != nil {
+		return NewHttpError(err, 400)
+	}
+	if scheduleReq.Name != nil {
+		job.Name = *scheduleReq.Name
+	}
+	if scheduleReq.Schedule != nil {
+		job.Schedule = *scheduleReq.Schedule
+	}
+	if scheduleReq.Room != nil {
+		job.Room = *scheduleReq.Room
+	}
+	if len(scheduleReq.Action) > 0 {
+		job.Action = scheduleReq.Action
+	}
+	if scheduleReq.FadeMinutes != nil {
+		job.FadeMinutes = *scheduleReq.FadeMinutes
+	}
+	if scheduleReq.Enabled != nil {
+		job.Enabled = *scheduleReq.Enabled
+	}
+	if len(job.Action) == 0 {
+		return NewHttpError(errors.New("no action to schedule"), 400)
+	}
+	var action ActionRequest
+	if err := json.Unmarshal(job.Action, &action); err != nil {
+		return NewHttpError(fmt.Errorf("bad action: %w", err), 400)
+	}
+	if action.Volume != nil && (*action.Volume < 0 || *action.Volume > 100) {
+		return NewHttpError(fmt.Errorf("bad action: volume %d must be between 0 and 100", *action.Volume), 400)
+	}
+	if job.FadeMinutes > 0 && action.Volume == nil {
+		return NewHttpError(errors.New("fading needs a Volume to fade up to"), 400)
+	}
+	return nil
+}
+
+func scheduleError(err error) error {
+	if errors.Is(err, scheduler.ErrNotFound) {
+		return NewHttpError(err, 404)
+	}
+	if errors.Is(err, scheduler.ErrBadJob) {
+		return NewHttpError(err, 400)
+	}
+	return err
+}
+
+// runSchedule does the action of a scheduled job in its room, and then fades the volume up in the
+// background if the job asks to.
+func (m *MusicServer) runSchedule(job scheduler.Job) error {
+	zp := m.sonos.Player(job.Room)
+	if zp == nil {
+		return NewHttpError(fmt.Errorf("no sonos in %s", job.Room), 404)
+	}
+	var actionReq ActionRequest
+	if err := json.Unmarshal(job.Action, &actionReq); err != nil {
+		return NewHttpError(err, 400)
+	}
+	fadeTo := actionReq.Volume
+	if job.FadeMinutes > 0 && fadeTo != nil {
+		silent := 0
+		actionReq.Volume = &silent
+	}
+	if err := m.sonosAction(zp, &actionReq); err != nil {
+		return err
+	}
+	if job.FadeMinutes > 0 && fadeTo != nil {
+		go func() {
+			if err := m.sonos.FadeVolume(zp, *fadeTo, time.Duration(job.FadeMinutes)*time.Minute, nil); err != nil {
+				log.Printf("failed to fade up %s for schedule %s: %v", job.Room, job.Name, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// Ratings sets the rating of a song with PUT /api/ratings/songs/<id> or an album with
+// PUT /api/ratings/albums/<name>, returning its result with the new rating.
+func (m *MusicServer) Ratings(req *http.Request) (*ListMusicRes, error) {
+	if req.Method != "PUT" {
+		return nil, NewHttpError(fmt.Errorf("bad method"), 400)
+	}
+	kind, name, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/api/ratings/"), "/")
+	var rating music.Rating
+	if err := json.NewDecoder(req.Body).Decode(&rating); err != nil {
+		return nil, NewHttpError(err, 400)
+	}
+	switch kind {
+	case "songs":
+		songId, err := strconv.Atoi(name)
+		if err != nil {
+			return nil, NewHttpError(fmt.Errorf("bad song id"), 400)
+		}
+		if err := m.index.RateSong(songId, rating); err != nil {
+			return nil, indexError(err)
+		}
+		return &ListMusicRes{Results: m.songResults([]int{songId})}, nil
+	case "albums":
+		if err := m.index.RateAlbum(name, rating); err != nil {
+			return nil, indexError(err)
+		}
+		m.index.SongsMu.Lock()
+		defer m.index.SongsMu.Unlock()
+		results := make([]Result, 0, 1)
+		if albumIdx, ok := m.index.AlbumIdByName[name]; ok {
+			results = append(results, m.albumResult(&m.index.Albums[albumIdx], false))
+		}
+		return &ListMusicRes{Results: results}, nil
+	}
+	return nil, NewHttpError(errors.New("bad request"), 400)
+}
+
+func (m *MusicServer) GetLyrics(req *http.Request) (*music.Lyrics, error) {
+	if req.Method != "GET" {
+		return nil, NewHttpError(fmt.Errorf("bad method"), 400)
+	}
+	songId, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/api/lyrics/"))
+	if err != nil {
+		return nil, NewHttpError(fmt.Errorf("bad song id"), 400)
+	}
+	lyrics, err := m.index.Lyrics(songId)
+	if err != nil {
+		return nil, indexError(err)
+	}
+	return lyrics, nil
 }
 
 func main() {
@@ -466,18 +1668,50 @@ func main() {
 
 	log.Println("music server 🎵 serving music from " + *sourceFolder + " at http://" + internalAddr + ":3000")
 	ms := MusicServer{}
+	ms.index.Open(*sourceFolder)
+	if *fetchArtistInfo {
+		ms.index.ArtistInfoProvider = music.AudioDBProvider{}
+	}
 	ms.sonos = music.NewSonos()
+	for _, location := range strings.Split(*sonosPlayers, ",") {
+		if len(location) == 0 {
+			continue
+		}
+		locationUrl, err := url.Parse(location)
+		if err != nil {
+			log.Fatalf("bad sonos url %s: %v", location, err)
+		}
+		go ms.sonos.AddPlayer(locationUrl)
+	}
 	ms.internalAddr = "http://" + internalAddr + ":3000"
 	ms.subscriptions = music.ListenForSubscriptionEvents(internalAddr)
+	go ms.trackSonosPlays()
+	ms.scheduler, err = scheduler.New(*sourceFolder, scheduler.SystemClock{}, ms.runSchedule)
+	if err != nil {
+		log.Fatalf("failed to load schedules: %v", err)
+	}
+	ms.scheduler.Start()
+	ms.announceFolder, err = os.MkdirTemp("", "musicbox-announcements")
+	if err != nil {
+		log.Fatalf("failed to make a folder for announcements: %v", err)
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/music/", WrapApi(ms.ListMusic))
 	mux.HandleFunc("/api/sonos/", ms.ListSonos)
 	mux.HandleFunc("/api/search/", WrapApi(ms.SearchMusic))
+	mux.HandleFunc("/api/albumart/", ms.AlbumArt)
+	mux.HandleFunc("/api/artlookups/", WrapApi(ms.ArtLookups))
+	mux.HandleFunc("/api/lyrics/", WrapApi(ms.GetLyrics))
+	mux.HandleFunc("/api/playlists/", ms.Playlists)
+	mux.HandleFunc("/api/history/", WrapApi(ms.History))
+	mux.HandleFunc("/api/ratings/", WrapApi(ms.Ratings))
+	mux.HandleFunc("/api/schedules/", WrapApi(ms.Schedules))
 	mux.Handle("/content/", http.StripPrefix("/content/", http.FileServer(&NoListFs{base: http.Dir(*sourceFolder)})))
+	mux.Handle("/announcements/", http.StripPrefix("/announcements/", http.FileServer(&NoListFs{base: http.Dir(ms.announceFolder)})))
 	static.ServeHTML(mux)
 
-	go ms.index.Scan(*sourceFolder)
+	go ms.index.Scan()
 	log.Println("listening on :3000")
 	if err := http.ListenAndServe(":3000", mux); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zanders3/music/pkg/music"
+	"github.com/zanders3/music/pkg/scheduler"
+	"github.com/zanders3/music/pkg/sonosfake"
+)
+
+// the events from sonos players always come back to the same port, so the tests share one listener
+var (
+	subscriptionsOnce sync.Once
+	subscriptions     *music.Subscriptions
+)
+
+// testSonos starts a server for a library of three songs, One, Two and Three, with fake sonos players in
+// the rooms. Announcement clips, from /Chimes in the library or uploaded, are a second long.
+func testSonos(t *testing.T, rooms ...string) (*MusicServer, *httptest.Server, []*sonosfake.ZonePlayer) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffprobe is a shell script")
+	}
+	bin := t.TempDir()
+	ffprobe := "#!/bin/sh\ncase \"$*\" in\n*/Chimes/*|*/clip-*) echo '{\"format\":{\"duration\":\"1.0\"}}' ;;\n*) echo '{\"format\":{\"duration\":\"183.5\"}}' ;;\nesac\n"
+	if err := os.WriteFile(filepath.Join(bin, "ffprobe"), []byte(ffprobe), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	folder := t.TempDir()
+	album := filepath.Join(folder, "Artist", "Album")
+	if err := os.MkdirAll(album, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"01 One.mp3", "02 Two.mp3", "03 Three.mp3"} {
+		if err := os.WriteFile(filepath.Join(album, name), []byte("ID3"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// with a Folder.jpg the scan doesn't go looking for art online
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, image.NewRGBA(image.Rect(0, 0, 1, 1)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(album, "Folder.jpg"), jpg.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptionsOnce.Do(func() {
+		subscriptions = music.ListenForSubscriptionEvents("127.0.0.1")
+	})
+	ms := &MusicServer{sonos: music.NewSonos(), subscriptions: subscriptions, announceFolder: t.TempDir()}
+	// clips in the library are found in the source folder
+	libraryFolder := *sourceFolder
+	*sourceFolder = folder
+	t.Cleanup(func() { *sourceFolder = libraryFolder })
+	ms.index.Open(folder)
+	ms.index.Scan()
+	var err error
+	if ms.scheduler, err = scheduler.New(folder, scheduler.SystemClock{}, ms.runSchedule); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/music/", WrapApi(ms.ListMusic))
+	mux.HandleFunc("/api/sonos/", ms.ListSonos)
+	mux.HandleFunc("/api/schedules/", WrapApi(ms.Schedules))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	ms.internalAddr = srv.URL
+
+	network := sonosfake.NewNetwork()
+	t.Cleanup(network.Close)
+	var players []*sonosfake.ZonePlayer
+	for _, room := range rooms {
+		zp, err := network.Add(room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ms.sonos.AddPlayer(zp.URL()); err != nil {
+			t.Fatal(err)
+		}
+		players = append(players, zp)
+	}
+	return ms, srv, players
+}
+
+// sonosAPI sends a request to the sonos API and decodes its response into res, failing the test if it
+// fails.
+func sonosAPI(t *testing.T, srv *httptest.Server, method, path string, body, res interface{}) {
+	t.Helper()
+	if errRes := callAPI(t, srv, method, "/api/sonos/"+path, body, res); errRes != nil {
+		t.Fatalf("%s %s failed with %d: %s", method, path, errRes.Code, errRes.Message)
+	}
+}
+
+// callAPI sends a request to the API and decodes its response into res, or returns the error it got.
+func callAPI(t *testing.T, srv *httptest.Server, method, path string, body, res interface{}) *ErrorRes {
+	t.Helper()
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, srv.URL+path, &reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpRes, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpRes.Body.Close()
+	resBytes, err := io.ReadAll(httpRes.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// errors come back as an ErrorRes with the code in it
+	var errRes ErrorRes
+	if err := json.Unmarshal(resBytes, &errRes); err != nil {
+		t.Fatalf("%s %s returned %q: %v", method, path, resBytes, err)
+	}
+	if errRes.Code != 0 {
+		return &errRes
+	}
+	if res != nil {
+		if err := json.Unmarshal(resBytes, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nil
+}
+
+// hasActions reports whether actions includes want in the same order, with anything in between.
+func hasActions(actions []string, want ...string) bool {
+	for _, action := range actions {
+		if len(want) > 0 && action == want[0] {
+			want = want[1:]
+		}
+	}
+	return len(want) == 0
+}
+
+func TestSonosPlay(t *testing.T) {
+	_, srv, players := testSonos(t, "Office")
+	office := players[0]
+
+	sonosAPI(t, srv, "POST", "Office/action", &ActionRequest{SongIDs: []int{0, 1, 2}, FromTrack: 2}, nil)
+	var uris []string
+	for _, track := range office.Queue() {
+		uris = append(uris, track.URI)
+	}
+	wantURIs := []string{
+		srv.URL + "/content/Artist/Album/01%20One.mp3",
+		srv.URL + "/content/Artist/Album/02%20Two.mp3",
+		srv.URL + "/content/Artist/Album/03%20Three.mp3",
+	}
+	if strings.Join(uris, " ") != strings.Join(wantURIs, " ") {
+		t.Errorf("got queue %q, want %q", uris, wantURIs)
+	}
+	if state, track := office.State(); state != "PLAYING" || track != 2 {
+		t.Errorf("got %s track %d, want PLAYING track 2", state, track)
+	}
+	if actions := office.Actions(); !hasActions(actions, "AVTransport#RemoveAllTracksFromQueue", "AVTransport#AddMultipleURIsToQueue", "AVTransport#Play") {
+		t.Errorf("got actions %q", actions)
+	}
+
+	sonosAPI(t, srv, "POST", "Office/action", &ActionRequest{Action: "Pause"}, nil)
+	if state, _ := office.State(); state != "PAUSED_PLAYBACK" {
+		t.Errorf("got %s after pausing", state)
+	}
+	volume := 35
+	sonosAPI(t, srv, "POST", "Office/action", &ActionRequest{Volume: &volume}, nil)
+	if got, _ := office.Volume(); got != volume {
+		t.Errorf("got volume %d, want %d", got, volume)
+	}
+
+	sonosAPI(t, srv, "POST", "Office/queue", &QueueRequest{SongIDs: []int{0}, Next: true}, nil)
+	var queue music.SonosQueue
+	sonosAPI(t, srv, "GET", "Office/queue", nil, &queue)
+	var titles []string
+	for _, track := range queue.Tracks {
+		titles = append(titles, track.Title)
+	}
+	if strings.Join(titles, " ") != "One Two One Three" || queue.Current != 2 {
+		t.Errorf("got queue %q playing %d, want One Two One Three playing 2", titles, queue.Current)
+	}
+}
+
+func TestSonosGroup(t *testing.T) {
+	_, srv, players := testSonos(t, "Office", "Kitchen")
+	office, kitchen := players[0], players[1]
+
+	sonosAPI(t, srv, "POST", "Kitchen/join", &GroupRequest{Room: "Office"}, nil)
+	if got := kitchen.Coordinator(); got != office {
+		t.Fatalf("kitchen is coordinated by %s after joining the office", got.Room)
+	}
+	// the songs are played by the coordinator of the group
+	sonosAPI(t, srv, "POST", "Kitchen/action", &ActionRequest{SongIDs: []int{0}}, nil)
+	if got := len(office.Queue()); got != 1 {
+		t.Errorf("got %d tracks in the office queue, want 1", got)
+	}
+	if actions := kitchen.Actions(); hasActions(actions, "AVTransport#Play") {
+		t.Errorf("kitchen was sent %q rather than the office", actions)
+	}
+
+	sonosAPI(t, srv, "POST", "Kitchen/leave", nil, nil)
+	if got := kitchen.Coordinator(); got != kitchen {
+		t.Errorf("kitchen is coordinated by %s after leaving", got.Room)
+	}
+}
+
+// sonosEvents streams the events of a room until the test ends, returning a func that waits for an event
+// matching want.
+func sonosEvents(t *testing.T, srv *httptest.Server, room string) func(what string, want func(state *SonosState) bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"/api/sonos/"+room+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	states := make(chan *SonosState, 100)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			var ev ListSonosRes
+			if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() && json.Unmarshal([]byte(data), &ev) == nil && ev.Sonos != nil {
+				states <- ev.Sonos
+			}
+		}
+	}()
+	return func(what string, want func(state *SonosState) bool) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case state := <-states:
+				if want(state) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+}
+
+func TestSonosEvents(t *testing.T) {
+	_, srv, _ := testSonos(t, "Office")
+	waitFor := sonosEvents(t, srv, "Office")
+	playing := func(track string) func(state *SonosState) bool {
+		return func(state *SonosState) bool {
+			return state.Track == track && state.Playing != nil && *state.Playing
+		}
+	}
+
+	waitFor("the room to be stopped", func(state *SonosState) bool {
+		return state.Playing != nil && !*state.Playing
+	})
+	sonosAPI(t, srv, "POST", "Office/action", &ActionRequest{SongIDs: []int{0, 1, 2}}, nil)
+	waitFor("One to play", playing("One"))
+	sonosAPI(t, srv, "POST", "Office/action", &ActionRequest{Action: "Next"}, nil)
+	waitFor("Two to play", playing("Two"))
+	volume := 45
+	sonosAPI(t, srv, "POST", "Office/action", &ActionRequest{Volume: &volume}, nil)
+	waitFor("the volume to change", func(state *SonosState) bool {
+		return state.Volume != nil && *state.Volume == volume
+	})
+}
+
+func TestSonosPlayMode(t *testing.T) {
+	_, srv, players := testSonos(t, "Office")
+	office := players[0]
+	waitFor := sonosEvents(t, srv, "Office")
+
+	playMode, crossfade := "SHUFFLE_NOREPEAT", true
+	sonosAPI(t, srv, "POST", "Office/action", &ActionRequest{PlayMode: &playMode, Crossfade: &crossfade}, nil)
+	if gotPlayMode, gotCrossfade := office.PlayMode(); gotPlayMode != playMode || !gotCrossfade {
+		t.Errorf("got play mode %s crossfade %v", gotPlayMode, gotCrossfade)
+	}
+	waitFor("the play mode to change", func(state *SonosState) bool {
+		return state.PlayMode == playMode && state.Crossfade != nil && *state.Crossfade
+	})
+	playMode, crossfade = "REPEAT_ONE", false
+	sonosAPI(t, srv, "POST", "Office/action", &ActionRequest{PlayMode: &playMode, Crossfade: &crossfade}, nil)
+	waitFor("the play mode to change back", func(state *SonosState) bool {
+		return state.PlayMode == playMode && state.Crossfade != nil && !*state.Crossfade
+	})
+
+	// play modes a sonos doesn't have are refused before they get to it
+	bogus := "BOGUS"
+	numActions := len(office.Actions())
+	errRes := callAPI(t, srv, "POST", "/api/sonos/Office/action", &ActionRequest{PlayMode: &bogus}, nil)
+	if errRes == nil || errRes.Code != 400 {
+		t.Errorf("got error %+v setting a bogus play mode, want 400", errRes)
+	}
+	if actions := office.Actions()[numActions:]; hasActions(actions, "AVTransport#SetPlayMode") {
+		t.Errorf("a bogus play mode was sent to the sonos, got actions %v", actions)
+	}
+}
+
+func TestSonosEQ(t *testing.T) {
+	_, srv, players := testSonos(t, "Office")
+	office := players[0]
+	waitFor := sonosEvents(t, srv, "Office")
+
+	mute, bass, treble, loudness := true, 4, -3, false
+	sonosAPI(t, srv, "POST", "Office/action", &ActionRequest{Mute: &mute, Bass: &bass, Treble: &treble, Loudness: &loudness}, nil)
+	if _, muted := office.Volume(); !muted {
+		t.Error("the room wasn't muted")
+	}
+	if gotBass, gotTreble, gotLoudness := office.EQ(); gotBass != bass || gotTreble != treble || gotLoudness {
+		t.Errorf("got bass %d treble %d loudness %v", gotBass, gotTreble, gotLoudness)
+	}
+	waitFor("the mute and eq to change", func(state *SonosState) bool {
+		return state.Muted != nil && *state.Muted && state.Bass != nil && *state.Bass == bass &&
+			state.Treble != nil && *state.Treble == treble && state.Loudness != nil && !*state.Loudness
+	})
+	mute = false
+	sonosAPI(t, srv, "POST", "Office/action", &ActionRequest{Mute: &mute}, nil)
+	waitFor("the room to be unmuted", func(state *SonosState) bool {
+		return state.Muted != nil && !*state.Muted
+	})
+
+	// a sonos only goes from -10 to 10
+	tooHigh, tooLow := 11, -11
+	for _, req := range []*ActionRequest{{Bass: &tooHigh}, {Treble: &tooLow}} {
+		if errRes := callAPI(t, srv, "POST", "/api/sonos/Office/action", req, nil); errRes == nil || errRes.Code != 400 {
+			t.Errorf("got error %+v setting the eq beyond 10, want 400", errRes)
+		}
+	}
+	if gotBass, gotTreble, _ := office.EQ(); gotBass != bass || gotTreble != treble {
+		t.Errorf("got bass %d treble %d after setting them beyond 10, want %d %d", gotBass, gotTreble, bass, treble)
+	}
+}
+
+func TestSonosAlarms(t *testing.T) {
+	ms, srv, players := testSonos(t, "Office", "Bedroom")
+	office, bedroom := players[0], players[1]
+	network := office.Network()
+	// alarmQueue returns the id of the saved queue an alarm plays
+	alarmQueue := func(alarm sonosfake.Alarm) string {
+		t.Helper()
+		const savedQueueURI = "file:///jffs/settings/savedqueues.rsq#"
+		if !strings.HasPrefix(alarm.ProgramURI, savedQueueURI) {
+			t.Fatalf("alarm %d plays %s rather than a saved queue", alarm.ID, alarm.ProgramURI)
+		}
+		return "SQ:" + strings.TrimPrefix(alarm.ProgramURI, savedQueueURI)
+	}
+
+	var created AlarmsRes
+	sonosAPI(t, srv, "POST", "alarms", map[string]interface{}{
+		"Room": "Office", "StartTime": "07:30", "Recurrence": "WEEKDAYS", "Volume": 30, "Album": "Album",
+	}, &created)
+	if created.Alarm == nil {
+		t.Fatalf("got alarms %+v without the new one", created.Alarms)
+	}
+	want := music.SonosAlarm{ID: created.Alarm.ID, Room: "Office", StartTime: "07:30:00", Duration: "01:00:00",
+		Recurrence: "WEEKDAYS", Enabled: true, Volume: 30, PlayMode: "NORMAL", Title: "Album"}
+	if *created.Alarm != want || len(created.Alarms) != 1 {
+		t.Fatalf("got alarm %+v of %+v, want %+v", created.Alarm, created.Alarms, want)
+	}
+	alarms := network.Alarms()
+	if len(alarms) != 1 || alarms[0].RoomUUID != office.UUID || alarms[0].StartTime != "07:30:00" || alarms[0].Volume != 30 {
+		t.Fatalf("got sonos alarms %+v", alarms)
+	}
+	albumQueue := alarmQueue(alarms[0])
+	if queue := network.SavedQueue(albumQueue); len(queue) != 3 || !strings.HasSuffix(queue[0].URI, "/01%20One.mp3") || !strings.HasSuffix(queue[2].URI, "/03%20Three.mp3") {
+		t.Errorf("got saved queue %+v for the album", queue)
+	}
+
+	// playing something else replaces the queue made for the alarm
+	playlist, err := ms.index.CreatePlaylist("Wake Up", []int{2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alarmPath := fmt.Sprintf("alarms/%d", want.ID)
+	var updated AlarmsRes
+	sonosAPI(t, srv, "PUT", alarmPath, map[string]interface{}{"Playlist": playlist.ID, "Volume": 40}, &updated)
+	if updated.Alarm == nil || updated.Alarm.Title != "Wake Up" || updated.Alarm.Volume != 40 || updated.Alarm.StartTime != "07:30:00" {
+		t.Errorf("got updated alarm %+v", updated.Alarm)
+	}
+	alarms = network.Alarms()
+	if len(alarms) != 1 || alarms[0].RoomUUID != office.UUID || alarms[0].Volume != 40 {
+		t.Fatalf("got sonos alarms %+v after updating", alarms)
+	}
+	if queue := network.SavedQueue(albumQueue); queue != nil {
+		t.Errorf("the queue for the album is still there with %+v", queue)
+	}
+	playlistQueue := alarmQueue(alarms[0])
+	if queue := network.SavedQueue(playlistQueue); len(queue) != 1 || !strings.HasSuffix(queue[0].URI, "/03%20Three.mp3") {
+		t.Errorf("got saved queue %+v for the playlist", queue)
+	}
+
+	for _, test := range []struct {
+		method, path string
+		body         interface{}
+		wantCode     int
+	}{
+		{"POST", "alarms", map[string]string{"Room": "Nowhere", "StartTime": "07:00"}, 400},
+		{"POST", "alarms", map[string]string{"Room": "Office", "StartTime": "25:00"}, 400},
+		{"PUT", alarmPath, map[string]string{"Recurrence": "FORTNIGHTLY"}, 400},
+		{"PUT", alarmPath, map[string]string{"PlayMode": "REPEAT_ONE"}, 400},
+		{"PUT", "alarms/first", map[string]int{"Volume": 10}, 400},
+		{"PUT", "alarms/999", map[string]int{"Volume": 10}, 404},
+		{"DELETE", "alarms/999", nil, 404},
+	} {
+		errRes := callAPI(t, srv, test.method, "/api/sonos/"+test.path, test.body, nil)
+		if errRes == nil || errRes.Code != test.wantCode {
+			t.Errorf("%s %s %v got error %+v, want %d", test.method, test.path, test.body, errRes, test.wantCode)
+		}
+	}
+
+	// alarms in rooms the server doesn't know show the id of the room, and can still be changed
+	var bedroomAlarm AlarmsRes
+	sonosAPI(t, srv, "POST", "alarms", map[string]string{"Room": "Bedroom", "StartTime": "08:00"}, &bedroomAlarm)
+	if bedroomAlarm.Alarm == nil {
+		t.Fatalf("got alarms %+v without the new one", bedroomAlarm.Alarms)
+	}
+	ms.sonos.ZonePlayersMu.Lock()
+	for idx, zp := range ms.sonos.ZonePlayers {
+		if zp.RoomName() == "Bedroom" {
+			ms.sonos.ZonePlayers = append(ms.sonos.ZonePlayers[:idx], ms.sonos.ZonePlayers[idx+1:]...)
+			break
+		}
+	}
+	ms.sonos.ZonePlayersMu.Unlock()
+	var changed AlarmsRes
+	sonosAPI(t, srv, "PUT", fmt.Sprintf("alarms/%d", bedroomAlarm.Alarm.ID), map[string]int{"Volume": 10}, &changed)
+	if changed.Alarm == nil || changed.Alarm.Room != bedroom.UUID || changed.Alarm.Volume != 10 {
+		t.Errorf("got alarm %+v in a room the server doesn't know", changed.Alarm)
+	}
+
+	sonosAPI(t, srv, "DELETE", alarmPath, nil, nil)
+	alarms = network.Alarms()
+	if len(alarms) != 1 || alarms[0].ID != bedroomAlarm.Alarm.ID || alarms[0].RoomUUID != bedroom.UUID || alarms[0].Volume != 10 {
+		t.Errorf("got sonos alarms %+v after deleting", alarms)
+	}
+	if queue := network.SavedQueue(playlistQueue); queue != nil {
+		t.Errorf("the queue for the playlist is still there with %+v", queue)
+	}
+}
+
+func TestSonosAnnounce(t *testing.T) {
+	ms, srv, players := testSonos(t, "Office")
+	office := players[0]
+	chimes := filepath.Join(*sourceFolder, "Chimes")
+	if err := os.MkdirAll(chimes, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(chimes, "doorbell.mp3"), []byte("ID3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	volume, mute, seek := 35, true, 42
+	sonosAPI(t, srv, "POST", "Office/action", &ActionRequest{SongIDs: []int{0, 1, 2}, FromTrack: 2, SetTimeSecs: &seek, Volume: &volume, Mute: &mute}, nil)
+	queueURI, position := office.Media()
+	if !strings.HasPrefix(queueURI, "x-rincon-queue:") || position != "00:00:42" {
+		t.Fatalf("got %s at %s before announcing", queueURI, position)
+	}
+	// checkRestored checks the room went back to the queue where it was, as loud and muted as it was
+	checkRestored := func(after string) {
+		t.Helper()
+		if uri, pos := office.Media(); uri != queueURI || pos != position {
+			t.Errorf("got %s at %s after %s, want %s at %s", uri, pos, after, queueURI, position)
+		}
+		if state, track := office.State(); state != "PLAYING" || track != 2 {
+			t.Errorf("got %s track %d after %s, want PLAYING track 2", state, track, after)
+		}
+		if vol, muted := office.Volume(); vol != volume || !muted {
+			t.Errorf("got volume %d muted %v after %s, want %d muted", vol, muted, after, volume)
+		}
+	}
+
+	// announce posts a clip to the room from another goroutine than the test's, so it can't fail the test
+	announce := func(contentType string, body io.Reader) (*ErrorRes, error) {
+		res, err := http.Post(srv.URL+"/api/sonos/Office/announce", contentType, body)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		var errRes ErrorRes
+		if err := json.NewDecoder(res.Body).Decode(&errRes); err != nil {
+			return nil, err
+		}
+		if errRes.Code != 0 {
+			return &errRes, nil
+		}
+		return nil, nil
+	}
+
+	announced := make(chan error)
+	go func() {
+		errRes, err := announce("application/json", strings.NewReader(`{"Path":"/Chimes/doorbell.mp3","Volume":60}`))
+		if errRes != nil {
+			err = fmt.Errorf("announcing failed with %d: %s", errRes.Code, errRes.Message)
+		}
+		announced <- err
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if uri, _ := office.Media(); strings.HasSuffix(uri, "/content/Chimes/doorbell.mp3") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the announcement to play")
+		}
+	}
+	if vol, muted := office.Volume(); vol != 60 || muted {
+		t.Errorf("got volume %d muted %v during the announcement, want 60 unmuted", vol, muted)
+	}
+	// one announcement plays at a time
+	errRes := callAPI(t, srv, "POST", "/api/sonos/Office/announce", &AnnounceRequest{Path: "/Chimes/doorbell.mp3"}, nil)
+	if errRes == nil || errRes.Code != 409 {
+		t.Errorf("got error %+v announcing during an announcement, want 409", errRes)
+	}
+	select {
+	case err := <-announced:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("timed out waiting for the announcement to finish")
+	}
+	checkRestored("announcing a clip from the library")
+
+	// uploaded clips are kept until they have played
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	clip, err := form.CreateFormFile("clip", "message.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clip.Write([]byte("ID3"))
+	form.WriteField("Volume", "50")
+	form.Close()
+	numActions := len(office.Actions())
+	if errRes, err := announce(form.FormDataContentType(), &body); err != nil {
+		t.Fatal(err)
+	} else if errRes != nil {
+		t.Fatalf("announcing an upload failed with %d: %s", errRes.Code, errRes.Message)
+	}
+	// the upload plays at its volume and then the queue is put back
+	if actions := office.Actions()[numActions:]; !hasActions(actions, "RenderingControl#SetVolume", "AVTransport#SetAVTransportURI", "AVTransport#Play",
+		"AVTransport#SetAVTransportURI", "AVTransport#Seek", "AVTransport#Play") {
+		t.Errorf("got actions %v announcing an upload", actions)
+	}
+	checkRestored("announcing an upload")
+	if clips, err := os.ReadDir(ms.announceFolder); err != nil || len(clips) != 0 {
+		t.Errorf("got announcements %v %v left after playing", clips, err)
+	}
+}
+
+// TestSubscribeCallingBack handles an event slowly and calls the player back while the player has
+// plenty more to send, as the event stream of a room does.
+func TestSubscribeCallingBack(t *testing.T) {
+	ms, _, _ := testSonos(t, "Office")
+	zp := ms.sonos.Player("Office")
+
+	unsubscribe := make(chan struct{})
+	defer close(unsubscribe)
+	handling, release := make(chan struct{}), make(chan struct{})
+	var handlingOnce sync.Once
+	volumes := make(chan string, 200)
+	ms.subscriptions.Subscribe(zp.RenderingControl.EventEndpoint, unsubscribe, func(e string) {
+		handlingOnce.Do(func() { close(handling) })
+		<-release
+		if _, err := zp.GetVolume(); err != nil {
+			t.Errorf("failed to get the volume while handling an event: %v", err)
+		}
+		volumes <- e
+	})
+	select {
+	case <-handling:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the first event")
+	}
+
+	// the player has to carry on while the first event is being handled
+	const changes = 100
+	done := make(chan error)
+	go func() {
+		for volume := 1; volume <= changes; volume++ {
+			if err := zp.SetVolume(volume); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		close(release)
+		t.Fatal("setting the volume got stuck while an event was being handled")
+	}
+	close(release)
+
+	last := fmt.Sprintf(`<Volume channel="Master" val="%d"/>`, changes)
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-volumes:
+			if strings.Contains(e, last) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the last volume change")
+		}
+	}
+}
+
+func TestRunSchedule(t *testing.T) {
+	_, srv, players := testSonos(t, "Office")
+	office := players[0]
+
+	var added SchedulesRes
+	if errRes := callAPI(t, srv, "POST", "/api/schedules/", map[string]interface{}{
+		"Name": "Morning", "Schedule": "0 7 * * *", "Room": "Office", "Action": &ActionRequest{SongIDs: []int{1}},
+	}, &added); errRes != nil {
+		t.Fatalf("adding a schedule failed: %s", errRes.Message)
+	}
+	var ran SchedulesRes
+	if errRes := callAPI(t, srv, "POST", fmt.Sprintf("/api/schedules/%d/run", added.Job.ID), nil, &ran); errRes != nil {
+		t.Fatalf("running the schedule failed: %s", errRes.Message)
+	}
+	if len(ran.Runs) != 1 || ran.Runs[0].JobID != added.Job.ID || ran.Runs[0].Error != "" {
+		t.Errorf("got runs %+v", ran.Runs)
+	}
+	if state, _ := office.State(); state != "PLAYING" {
+		t.Errorf("got %s after running the schedule", state)
+	}
+
+	// a schedule that fails returns its error rather than the latest run
+	if errRes := callAPI(t, srv, "PUT", fmt.Sprintf("/api/schedules/%d", added.Job.ID), map[string]string{"Room": "Nowhere"}, nil); errRes != nil {
+		t.Fatalf("changing the schedule failed: %s", errRes.Message)
+	}
+	errRes := callAPI(t, srv, "POST", fmt.Sprintf("/api/schedules/%d/run", added.Job.ID), nil, nil)
+	if errRes == nil || errRes.Code != 404 || errRes.Message != "no sonos in Nowhere" {
+		t.Errorf("got error %+v running a schedule for a missing room", errRes)
+	}
+
+	// volumes a sonos can't be set to are refused when the schedule is saved rather than when it runs
+	for _, volume := range []int{-1, 101} {
+		errRes := callAPI(t, srv, "POST", "/api/schedules/", map[string]interface{}{
+			"Schedule": "0 7 * * *", "Room": "Office", "Action": &ActionRequest{Volume: &volume},
+		}, nil)
+		if errRes == nil || errRes.Code != 400 {
+			t.Errorf("adding a schedule with volume %d got error %+v, want 400", volume, errRes)
+		}
+		errRes = callAPI(t, srv, "PUT", fmt.Sprintf("/api/schedules/%d", added.Job.ID), map[string]interface{}{
+			"Action": &ActionRequest{Volume: &volume},
+		}, nil)
+		if errRes == nil || errRes.Code != 400 {
+			t.Errorf("changing a schedule to volume %d got error %+v, want 400", volume, errRes)
+		}
+	}
+}
+
+func TestRecentlyAddedLimit(t *testing.T) {
+	_, srv, _ := testSonos(t)
+	var res ListMusicRes
+	if errRes := callAPI(t, srv, "GET", "/api/music/recent?limit=1", nil, &res); errRes != nil {
+		t.Fatalf("listing recently added albums failed: %s", errRes.Message)
+	}
+	if len(res.Results) != 1 || res.Results[0].Name != "Album" {
+		t.Errorf("got results %+v", res.Results)
+	}
+	for _, limit := range []string{"0", "-1", "ten"} {
+		errRes := callAPI(t, srv, "GET", "/api/music/recent?limit="+limit, nil, nil)
+		if errRes == nil || errRes.Code != 400 {
+			t.Errorf("limit %s got error %+v, want 400", limit, errRes)
+		}
+	}
+}
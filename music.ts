@@ -6,6 +6,8 @@ type Result = {
     Link: string, Audio: string,
     Artist: string, Album: string, Image: string,
     SongId: number,
+    Plays?: number,
+    Rating?: number, Favourite?: boolean,
 }
 
 type ListMusicResult = {
@@ -48,6 +50,9 @@ audio.ontimeupdate = function () {
         el("player-curtime").innerText = formatTime(parseFloat((el("player-range") as HTMLInputElement).value));
     }
     if (audio.currentTime >= audio.duration) {
+        if (playlistIdx < playlist.length) {
+            reportplay(playlist[playlistIdx], "complete");
+        }
         nexttrack();
     }
 };
@@ -61,12 +66,14 @@ audio.onloadedmetadata = function () {
 audio.onvolumechange = function () {
     console.log(audio.volume);
     (el("player-volume") as HTMLInputElement).value = (audio.volume * 100).toString();
-    el("player-mute").innerHTML = `<i class="material-icons">${audio.volume > 0 ? 'volume_up' : 'volume_mute'}</i>`;
+    showmute();
 };
 
 let sonosRoom = "";
 let playlist: Result[] = [];
 let playlistIdx = 0;
+// the album or artist the playlist came from, so a sonos can queue all of it
+let playlistSource: ActionReq = {};
 function nexttrack() {
     if (playlistIdx < playlist.length && sonosRoom.length == 0) {
         playlistIdx++;
@@ -87,9 +94,18 @@ function prevtrack() {
 }
 type ActionReq = {
     SongIDs?: number[]
+    Album?: string,
+    Artist?: string,
+    FromTrack?: number,
     Volume?: number,
     SetTimeSecs?: number,
-    Action?: "Play" | "Pause" | "Next" | "Prev"
+    Action?: "Play" | "Pause" | "Next" | "Prev",
+    PlayMode?: string,
+    Crossfade?: boolean,
+    Mute?: boolean,
+    Bass?: number,
+    Treble?: number,
+    Loudness?: boolean
 };
 
 function sonoscommand(actionReq: ActionReq) {
@@ -104,6 +120,11 @@ function sonoscommand(actionReq: ActionReq) {
     }
     req.send(JSON.stringify(actionReq));
 }
+function reportplay(song: Result, event: "start" | "complete") {
+    var req = new XMLHttpRequest();
+    req.open("POST", "/api/history/");
+    req.send(JSON.stringify({ SongId: song.SongId, Event: event }));
+}
 function playsong() {
     if (playlistIdx < 0 || playlist.length == 0 || playlistIdx >= playlist.length) {
         audio.pause();
@@ -115,6 +136,7 @@ function playsong() {
         audio.src = song.Audio;
         audio.load();
         audio.play();
+        reportplay(song, "start");
 
         el("player-info").innerHTML = `<a href="#artists/${song.Artist}">${song.Artist}</a><br/><a href="#albums/${song.Album}">${song.Album}</a><br/>${song.Name}`;
         el("player-albumcover").innerHTML = (song.Image as string).length > 0 ? `<img class="easeload" onload="this.style.opacity=1" src="${song.Image}">` : ``;
@@ -130,14 +152,49 @@ function playsong() {
         }
     } else {
         audio.pause();
-        let songIds: number[] = [];
-        for (let idx = playlistIdx; idx < playlist.length; idx++) {
-            songIds.push(playlist[idx].SongId);
+        if (playlistSource.Album || playlistSource.Artist) {
+            sonoscommand({ Album: playlistSource.Album, Artist: playlistSource.Artist, FromTrack: playlistIdx + 1 });
+        } else {
+            sonoscommand({ SongIDs: playlist.map((song) => song.SongId), FromTrack: playlistIdx + 1 });
         }
-        sonoscommand({ SongIDs: songIds });
     }
 }
 
+function ratingicon(result: Result, stars: number): string {
+    if (stars == 0) {
+        return result.Favourite ? "favorite" : "favorite_border";
+    }
+    return stars <= (result.Rating ?? 0) ? "star" : "star_border";
+}
+function ratinghtml(result: Result, idx: string): string {
+    let html = `<span class="rating" data-idx="${idx}">`;
+    for (let stars = 0; stars <= 5; stars++) {
+        html += `<i class="material-icons" data-stars="${stars}">${ratingicon(result, stars)}</i>`;
+    }
+    return html + `</span>`;
+}
+function rate(node: HTMLElement, result: Result, stars: number) {
+    let rating = { Stars: result.Rating ?? 0, Favourite: result.Favourite ?? false };
+    if (stars == 0) {
+        rating.Favourite = !rating.Favourite;
+    } else {
+        rating.Stars = rating.Stars == stars ? 0 : stars;
+    }
+    var req = new XMLHttpRequest();
+    req.open("PUT", result.Type == "Song" ? "/api/ratings/songs/" + result.SongId : "/api/ratings/albums/" + encodeURIComponent(result.Album));
+    req.onload = function () {
+        if (JSON.parse(req.response).Code) {
+            return;
+        }
+        result.Rating = rating.Stars;
+        result.Favourite = rating.Favourite;
+        for (let icon of node.querySelectorAll("i")) {
+            icon.innerHTML = ratingicon(result, parseInt((icon as HTMLElement).dataset.stars as string));
+        }
+    };
+    req.send(JSON.stringify(rating));
+}
+
 let prevApi = "";
 let cachedScrolls: Record<string, number> = {};
 
@@ -158,7 +215,7 @@ function getmusic(api: string) {
     req.onload = function () {
         let res = JSON.parse(req.response) as ListMusicResult;
         let html = "";
-        if (api == "albums") {
+        if (api == "albums" || api == "recent") {
             html += `<div class="albumcontainer">`;
             for (let result of res.Results) {
                 html += `<div class="album"><a href="#${result.Link}">`;
@@ -176,7 +233,7 @@ function getmusic(api: string) {
                 let result = res.Results[idx];
                 if (result.Type == "Song") {
                     html += `<div class="song ${first ? 'firstpad' : ''}">
-                        <a class="play" data-idx="${idx}">${result.Name}</a>
+                        <a class="play" data-idx="${idx}">${result.Name}</a>${ratinghtml(result, idx)}
                     </div>`;
                 } else if (result.Type == "AlbumHeader") {
                     html += `<div class="albumheader ${first ? '' : 'albumheaderpad'}"><div>`;
@@ -185,7 +242,7 @@ function getmusic(api: string) {
                     } else {
                         html += `<div class="albumbox"></div>`;
                     }
-                    html += `</div><div><h1>${result.Name}</h1><a href="#artists/${result.Artist}">${result.Artist}</a></div></div>`;
+                    html += `</div><div><h1>${result.Name}</h1><a href="#artists/${result.Artist}">${result.Artist}</a><br/>${ratinghtml(result, idx)}</div></div>`;
                 } else {
                     let icon = "folder";
                     if (result.Type == "Artist" || result.Name == "Artists") {
@@ -194,6 +251,8 @@ function getmusic(api: string) {
                         icon = "album";
                     } else if (result.Name == "Songs") {
                         icon = "music_note";
+                    } else if (result.Name == "Recently Added") {
+                        icon = "new_releases";
                     }
                     html += `<div class="folder ${first ? 'firstpad' : ''}"><a href="#${result.Link}"><i class="material-icons">${icon}</i><span>${result.Name}</span></a></div>`;
                 }
@@ -205,6 +264,13 @@ function getmusic(api: string) {
             let idx = parseInt((node as HTMLElement).dataset.idx as string);
             (node as HTMLElement).onclick = function () {
                 playlist = [];
+                if (api.startsWith("albums/")) {
+                    playlistSource = { Album: decodeURIComponent(api.slice("albums/".length)) };
+                } else if (api.startsWith("artists/")) {
+                    playlistSource = { Artist: decodeURIComponent(api.slice("artists/".length)) };
+                } else {
+                    playlistSource = {};
+                }
                 for (let rx in res.Results) {
                     let ridx = parseInt(rx);
                     if (res.Results[ridx].Type == "Song") {
@@ -217,6 +283,14 @@ function getmusic(api: string) {
                 playsong();
             };
         }
+        for (let node of document.querySelectorAll(".rating")) {
+            let result = res.Results[parseInt((node as HTMLElement).dataset.idx as string)];
+            for (let icon of node.querySelectorAll("i")) {
+                (icon as HTMLElement).onclick = function () {
+                    rate(node as HTMLElement, result, parseInt((icon as HTMLElement).dataset.stars as string));
+                };
+            }
+        }
         if (cachedScrolls[api]) {
             el("results").scrollTop = cachedScrolls[api];
         }
@@ -235,7 +309,15 @@ type SonosResponse = {
         Playing: boolean | undefined,
         Position: string | undefined,
         Track: string | undefined,
-        Volume: number | undefined
+        Volume: number | undefined,
+        Queueing: { Queued: number, Total: number } | undefined,
+        PlayMode: string | undefined,
+        Crossfade: boolean | undefined,
+        SleepTimer: { Remaining: string, Fade: boolean } | undefined,
+        Muted: boolean | undefined,
+        Bass: number | undefined,
+        Treble: number | undefined,
+        Loudness: boolean | undefined,
     },
 };
 
@@ -247,6 +329,86 @@ function sonosroomhtml(sonosRoom: string): string {
     }
     return html;
 }
+let sonosPlayMode = "NORMAL";
+let sonosCrossfade = false;
+function playmode(shuffle: boolean, repeat: "" | "all" | "one"): string {
+    if (shuffle) {
+        return repeat == "all" ? "SHUFFLE" : repeat == "one" ? "SHUFFLE_REPEAT_ONE" : "SHUFFLE_NOREPEAT";
+    }
+    return repeat == "all" ? "REPEAT_ALL" : repeat == "one" ? "REPEAT_ONE" : "NORMAL";
+}
+function isshuffle(mode: string): boolean {
+    return mode.startsWith("SHUFFLE");
+}
+function repeatmode(mode: string): "" | "all" | "one" {
+    if (mode.endsWith("REPEAT_ONE")) {
+        return "one";
+    }
+    return mode == "REPEAT_ALL" || mode == "SHUFFLE" ? "all" : "";
+}
+function showplaymode(show: boolean) {
+    for (let id of ["player-shuffle", "player-repeat", "player-crossfade", "player-sleep", "player-eq"]) {
+        el(id).style.display = show ? "" : "none";
+    }
+    let repeat = repeatmode(sonosPlayMode);
+    el("player-shuffle").innerHTML = `<i class="material-icons ${isshuffle(sonosPlayMode) ? 'selected' : ''}">shuffle</i>`;
+    el("player-repeat").innerHTML = `<i class="material-icons ${repeat.length > 0 ? 'selected' : ''}">${repeat == 'one' ? 'repeat_one' : 'repeat'}</i>`;
+    el("player-crossfade").innerHTML = `<i class="material-icons ${sonosCrossfade ? 'selected' : ''}">swap_horiz</i>`;
+}
+let sonosSleepSecs = 0;
+function showsleep() {
+    el("player-sleep").innerHTML = `<span class="valign-wrapper"><i class="material-icons ${sonosSleepSecs > 0 ? 'selected' : ''}">bedtime</i>${sonosSleepSecs > 0 ? formatTime(sonosSleepSecs) : ''}</span>`;
+}
+function sleephtml(): string {
+    let html = "";
+    for (let minutes of [0, 15, 30, 45, 60, 90]) {
+        html += `<div onclick="setsleep(this)" data-minutes="${minutes}">${minutes == 0 ? 'Off' : minutes + ' minutes'}</div>`;
+    }
+    return html;
+}
+(window as any).setsleep = function (elem) {
+    let minutes = parseInt((elem as HTMLElement).dataset.minutes as string);
+    var req = new XMLHttpRequest();
+    req.open(minutes > 0 ? "PUT" : "DELETE", "/api/sonos/" + sonosRoom + "/sleep");
+    req.onload = function () {
+        let remaining = (JSON.parse(req.response) as { Remaining: string }).Remaining;
+        sonosSleepSecs = remaining ? parseTime(remaining) : 0;
+        showsleep();
+    };
+    req.send(JSON.stringify({ Minutes: minutes, Fade: true }));
+};
+let sonosMuted = false;
+function showmute() {
+    let muted = sonosRoom.length > 0 ? sonosMuted : audio.volume == 0;
+    el("player-mute").innerHTML = `<i class="material-icons ${sonosRoom.length > 0 && muted ? 'selected' : ''}">${muted ? 'volume_off' : 'volume_up'}</i>`;
+}
+let sonosBass = 0, sonosTreble = 0, sonosLoudness = true;
+function eqhtml(): string {
+    return `<div><label>Bass</label><input id="eq-bass" type="range" min="-10" max="10" value="0" oninput="seteq(this)" data-eq="Bass" /></div>` +
+        `<div><label>Treble</label><input id="eq-treble" type="range" min="-10" max="10" value="0" oninput="seteq(this)" data-eq="Treble" /></div>` +
+        `<div id="eq-loudness" onclick="setloudness()"></div>`;
+}
+function showeq() {
+    (el("eq-bass") as HTMLInputElement).value = sonosBass.toString();
+    (el("eq-treble") as HTMLInputElement).value = sonosTreble.toString();
+    el("eq-loudness").innerHTML = `<span class="valign-wrapper"><i class="material-icons ${sonosLoudness ? 'selected' : ''}">${sonosLoudness ? 'check_box' : 'check_box_outline_blank'}</i> Loudness</span>`;
+}
+(window as any).seteq = function (elem) {
+    let input = elem as HTMLInputElement;
+    let level = parseInt(input.value);
+    sonoscommand(input.dataset.eq == "Bass" ? { Bass: level } : { Treble: level });
+};
+(window as any).setloudness = function () {
+    sonoscommand({ Loudness: !sonosLoudness });
+};
+function showmenu(menu: string, button: string, e: MouseEvent) {
+    let style = el(menu).style;
+    let rect = el(button).getBoundingClientRect();
+    style.left = Math.min(window.innerWidth - 210, rect.x) + "px";
+    style.bottom = (window.innerHeight - rect.y + 15) + "px";
+    style.display = "block";
+    e.stopPropagation();
+}
 let evts: EventSource | null = null;
 let sonosTimeSecs = 0;
 let sonosTickId = 0;
@@ -260,6 +422,10 @@ function tickSonosTime() {
         (el("player-range") as HTMLInputElement).value = sonosTimeSecs.toString();
     }
     sonosTimeSecs++;
+    if (sonosSleepSecs > 0) {
+        sonosSleepSecs--;
+        showsleep();
+    }
 }
 
 (window as any).setspeaker = function (elem) {
@@ -297,6 +463,9 @@ function setspeaker(room: string) {
                     sonosTickId = setInterval(tickSonosTime, 1000);
                 }
                 el("player-info").innerHTML = `<a href="#artists/${res.Sonos.Artist ?? ''}">${res.Sonos.Artist ?? ''}</a><br/><a href="#albums/${res.Sonos.Album ?? ''}">${res.Sonos.Album ?? ''}</a><br/>${res.Sonos.Track ?? ''}`;
+                if (res.Sonos.Queueing) {
+                    el("player-info").innerHTML += `<br/>queueing ${res.Sonos.Queueing.Queued} of ${res.Sonos.Queueing.Total}`;
+                }
                 let newArt = res.Sonos.AlbumArtURI ? `<img class="easeload" onload="this.style.opacity=1" src="${res.Sonos.AlbumArtURI}">` : ``;
                 if (el("player-albumcover").innerHTML != newArt) {
                     el("player-albumcover").innerHTML = newArt;
@@ -305,18 +474,44 @@ function setspeaker(room: string) {
             if (res.Sonos.Volume && enable_volume_update) {
                 (el("player-volume") as HTMLInputElement).value = res.Sonos.Volume.toString();
             }
+            if (res.Sonos.PlayMode) {
+                sonosPlayMode = res.Sonos.PlayMode;
+                sonosCrossfade = res.Sonos.Crossfade ?? false;
+                showplaymode(true);
+            }
+            if (res.Sonos.SleepTimer) {
+                sonosSleepSecs = res.Sonos.SleepTimer.Remaining ? parseTime(res.Sonos.SleepTimer.Remaining) : 0;
+                showsleep();
+            }
+            if (res.Sonos.Muted !== undefined) {
+                sonosMuted = res.Sonos.Muted;
+                showmute();
+            }
+            if (res.Sonos.Bass !== undefined || res.Sonos.Treble !== undefined || res.Sonos.Loudness !== undefined) {
+                sonosBass = res.Sonos.Bass ?? sonosBass;
+                sonosTreble = res.Sonos.Treble ?? sonosTreble;
+                sonosLoudness = res.Sonos.Loudness ?? sonosLoudness;
+                showeq();
+            }
         };
         evts.onerror = () => {
             console.log("connection lost - connecting to " + room + " in 1 second");
             setspeaker("");
             setTimeout(() => {
+                if (sonosRooms.indexOf(room) == -1) {
+                    console.log(room + " has gone");
+                    return;
+                }
                 console.log("attempting reconnect to " + room);
                 setspeaker(room);
             }, 1000);
         };
     } else {
         el("player-speakers").innerHTML = `<span class="valign-wrapper"><i class="material-icons">speaker</i></span>`;
+        sonosRoom = "";
         el("player-right").classList.add("player-right-volume");
+        showplaymode(false);
+        showmute();
         el("player-albumcover").innerHTML = "";
         el("player-info").innerHTML = "";
         (el("player-range") as HTMLInputElement).max = "1";
@@ -332,20 +527,24 @@ function refreshsonos() {
         sonosRooms = (JSON.parse(req.response) as SonosResponse).Rooms ?? [];
         el("sonos-list").innerHTML = sonosroomhtml(sonosRoom);
         el("player-speakers").onclick = (e) => {
-            let style = el("sonos-list").style;
-            let button = el("player-speakers").getBoundingClientRect();
-            style.left = Math.min(window.innerWidth - 210, button.x) + "px";
-            style.bottom = (window.innerHeight - button.y + 15) + "px";
-            style.display = "block";
-            e.stopPropagation();
+            showmenu("sonos-list", "player-speakers", e);
         };
         document.body.onclick = function () {
             el("sonos-list").style.display = 'none';
+            el("sleep-list").style.display = 'none';
+            el("eq-list").style.display = 'none';
         };
     };
     el("sonos-list").innerHTML = "";
     req.send();
 }
+function watchsonos() {
+    let roomEvts = new EventSource("/api/sonos/events");
+    roomEvts.onmessage = (event) => {
+        sonosRooms = (JSON.parse(event.data) as SonosResponse).Rooms ?? [];
+        el("sonos-list").innerHTML = sonosroomhtml(sonosRoom);
+    };
+}
 
 window.onhashchange = function () {
     getmusic(window.location.hash.slice(1));
@@ -362,6 +561,7 @@ window.onload = function () {
     };
     getmusic(window.location.hash.slice(1));
     refreshsonos();
+    watchsonos();
     el("player-play").onclick = function () {
         if (is_playing) {
             if (sonosRoom.length > 0) {
@@ -393,7 +593,9 @@ window.onload = function () {
         }
     };
     el("player-mute").onclick = function () {
-        if (audio.volume == 0) {
+        if (sonosRoom.length > 0) {
+            sonoscommand({ Mute: !sonosMuted });
+        } else if (audio.volume == 0) {
             audio.volume = unmute_volume;
         } else {
             unmute_volume = audio.volume;
@@ -420,4 +622,27 @@ window.onload = function () {
     el("player-next").onclick = function () {
         nexttrack();
     };
+    el("player-shuffle").onclick = function () {
+        sonoscommand({ PlayMode: playmode(!isshuffle(sonosPlayMode), repeatmode(sonosPlayMode)) });
+    };
+    el("player-repeat").onclick = function () {
+        let repeat = repeatmode(sonosPlayMode);
+        sonoscommand({ PlayMode: playmode(isshuffle(sonosPlayMode), repeat == "" ? "all" : repeat == "all" ? "one" : "") });
+    };
+    el("player-crossfade").onclick = function () {
+        sonoscommand({ Crossfade: !sonosCrossfade });
+    };
+    el("sleep-list").innerHTML = sleephtml();
+    el("player-sleep").onclick = (e) => {
+        showmenu("sleep-list", "player-sleep", e);
+    };
+    el("eq-list").innerHTML = eqhtml();
+    showeq();
+    el("eq-list").onclick = (e) => {
+        // keep the menu open while the sliders are moved
+        e.stopPropagation();
+    };
+    el("player-eq").onclick = (e) => {
+        showmenu("eq-list", "player-eq", e);
+    };
 };
@@ -0,0 +1,388 @@
+package music
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dhowden/tag"
+)
+
+const albumArtName = "Folder.jpg"
+
+// coverArtArchive is where album art is downloaded from by musicbrainz id.
+var coverArtArchive = "http://coverartarchive.org"
+
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrBadImage   = errors.New("bad image")
+	errNoAlbumArt = errors.New("no album art found")
+)
+
+// ArtCandidate is an image that could be used as the album art for an album.
+// Folder candidates have a Path relative to the music folder, online candidates have a URL.
+type ArtCandidate struct {
+	ID, Source, Name string
+	Path, URL        string `json:",omitempty"`
+}
+
+type musicBrainzRelease struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Date  string `json:"date"`
+}
+
+func isImageFile(ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	default:
+		return false
+	}
+}
+
+// imageType returns the type of an image from its bytes, as tags and uploads often give the wrong one.
+func imageType(data []byte) string {
+	return http.DetectContentType(data)
+}
+
+func readEmbeddedArt(folder string, song *Song) (*tag.Picture, error) {
+	songFile, err := os.Open(path.Join(folder, song.Path))
+	if err != nil {
+		return nil, err
+	}
+	defer songFile.Close()
+	m, err := tag.ReadFrom(songFile)
+	if err != nil {
+		return nil, err
+	}
+	pic := m.Picture()
+	if pic == nil || len(pic.Data) == 0 {
+		return nil, errNoAlbumArt
+	}
+	// tags often say image/jpg or leave the type out, so go by the picture itself
+	pic.MIMEType = imageType(pic.Data)
+	return pic, nil
+}
+
+func searchMusicBrainz(artist, album string, limit int) ([]musicBrainzRelease, error) {
+	url := strings.ReplaceAll(fmt.Sprintf("https://musicbrainz.org/ws/2/release?query=artist=%s AND Album=%s&fmt=json&limit=%d", artist, album, limit), " ", "%20")
+	req, err := http.NewRequest("GET", url, bytes.NewReader([]byte{}))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-Agent", "MusicBox/0.0.1 ( 3zanders@gmail.com )")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("musicbrainz returned %d", res.StatusCode)
+	}
+	var releases struct {
+		Releases []musicBrainzRelease `json:"releases"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&releases); err != nil {
+		return nil, err
+	}
+	return releases.Releases, nil
+}
+
+func fetchCoverArt(mbid string) (io.ReadCloser, error) {
+	imageUrl := fmt.Sprintf("%s/release/%s/front", coverArtArchive, mbid)
+	imageRes, err := http.Get(imageUrl)
+	if err != nil {
+		return nil, err
+	}
+	if imageRes.StatusCode == 404 {
+		imageRes.Body.Close()
+		// the release has no cover, which is worth waiting longer to ask about again than an error
+		return nil, fmt.Errorf("%w: coverartarchive has none for %s", errNoAlbumArt, mbid)
+	}
+	if imageRes.StatusCode != 200 {
+		imageResBytes, _ := io.ReadAll(imageRes.Body)
+		imageRes.Body.Close()
+		return nil, fmt.Errorf("%d: %s", imageRes.StatusCode, string(imageResBytes))
+	}
+	return imageRes.Body, nil
+}
+
+// writeAlbumArt writes a jpeg to dst, converting png images to jpeg with a white background. The type
+// is worked out from the image itself, and anything that isn't a jpeg or png that decodes is ErrBadImage.
+func writeAlbumArt(dst string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	switch contentType := imageType(data); contentType {
+	case "image/jpeg":
+		if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("%w: %v", ErrBadImage, err)
+		}
+	case "image/png":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBadImage, err)
+		}
+		newImg := image.NewRGBA(img.Bounds())
+		draw.Draw(newImg, newImg.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+		draw.Draw(newImg, newImg.Bounds(), img, image.Point{}, draw.Over)
+		var jpg bytes.Buffer
+		if err := jpeg.Encode(&jpg, newImg, &jpeg.Options{Quality: 80}); err != nil {
+			return err
+		}
+		data = jpg.Bytes()
+	default:
+		return fmt.Errorf("%w: %s", ErrBadImage, contentType)
+	}
+	tmpPath := dst + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, dst)
+}
+
+// lookupAlbumArt extracts the album art from the album's first song or downloads it from musicbrainz,
+// returning which of those it tried last.
+func lookupAlbumArt(album *Album, songs []Song, folder string) (string, error) {
+	albumArtPath := path.Join(path.Dir(songs[album.StartSongIdx].Path), albumArtName)
+
+	pic, err := readEmbeddedArt(folder, &songs[album.StartSongIdx])
+	if err != nil && !errors.Is(err, errNoAlbumArt) {
+		return "embedded", err
+	}
+	if pic != nil && pic.MIMEType == "image/jpeg" {
+		if err := os.WriteFile(path.Join(folder, albumArtPath), pic.Data, 0644); err != nil {
+			return "embedded", err
+		}
+		album.AlbumArtPath = albumArtPath
+		return "embedded", nil
+	}
+
+	log.Printf("fetching %s %s", album.Artist, album.Name)
+	releases, err := searchMusicBrainz(album.Artist, album.Name, 1)
+	if err != nil {
+		return "musicbrainz", err
+	}
+	if len(releases) == 0 {
+		log.Printf("%s %s has no results", album.Artist, album.Name)
+		return "musicbrainz", errNoAlbumArt
+	}
+	mbid := releases[0].ID
+	log.Printf("%s %s has mbid %s", album.Artist, album.Name, mbid)
+	log.Printf("downloading %s %s: %s to %s", album.Artist, album.Name, mbid, albumArtPath)
+	body, err := fetchCoverArt(mbid)
+	if err != nil {
+		return "musicbrainz", err
+	}
+	defer body.Close()
+	if err := writeAlbumArt(path.Join(folder, albumArtPath), body); err != nil {
+		return "musicbrainz", err
+	}
+	log.Printf("downloaded ok!")
+	time.Sleep(time.Second)
+	album.AlbumArtPath = albumArtPath
+	return "musicbrainz", nil
+}
+
+// lookupMissingAlbumArt looks up the album art of every album without any that the art ledger says is due a lookup.
+func (mi *MusicIndex) lookupMissingAlbumArt() {
+	mi.artLookupMu.Lock()
+	defer mi.artLookupMu.Unlock()
+	mi.SongsMu.Lock()
+	albums := make([]Album, len(mi.Albums))
+	copy(albums, mi.Albums)
+	songs := mi.Songs
+	mi.SongsMu.Unlock()
+
+	numLookups := 0
+	for idx := range albums {
+		album := &albums[idx]
+		if len(album.AlbumArtPath) > 0 || !mi.artLedger.shouldLookup(album) {
+			continue
+		}
+		provider, err := lookupAlbumArt(album, songs, mi.folder)
+		mi.artLedger.record(album.Artist, album.Name, provider, err)
+		if err != nil && !errors.Is(err, errNoAlbumArt) {
+			log.Printf("failed to lookup %s %s: %v", album.Artist, album.Name, err)
+		}
+		mi.SongsMu.Lock()
+		if albumIdx, ok := mi.AlbumIdByName[album.Name]; ok && mi.Albums[albumIdx].Artist == album.Artist {
+			if len(album.AlbumArtPath) > 0 {
+				mi.Albums[albumIdx].AlbumArtPath = album.AlbumArtPath
+			}
+			mi.Albums[albumIdx].ProcessedAlbumArt = true
+		}
+		mi.SongsMu.Unlock()
+		numLookups++
+	}
+	if err := mi.artLedger.save(); err != nil {
+		log.Printf("failed to save album art ledger: %v", err)
+	}
+	if numLookups > 0 {
+		log.Printf("looked up album art for %d albums", numLookups)
+		// keep the art found in music.dat, or it's looked up again after a restart
+		if err := mi.save(); err != nil {
+			log.Printf("failed to save index to disk: %v", err)
+		}
+	}
+}
+
+// lookupAlbum returns a copy of the named album and its first song.
+func (mi *MusicIndex) lookupAlbum(albumName string) (Album, Song, error) {
+	mi.SongsMu.Lock()
+	defer mi.SongsMu.Unlock()
+	albumIdx, ok := mi.AlbumIdByName[albumName]
+	if !ok || albumIdx >= len(mi.Albums) {
+		return Album{}, Song{}, ErrNotFound
+	}
+	album := mi.Albums[albumIdx]
+	if album.StartSongIdx >= len(mi.Songs) {
+		return Album{}, Song{}, ErrNotFound
+	}
+	return album, mi.Songs[album.StartSongIdx], nil
+}
+
+// AlbumArtCandidates lists the images found in the album folder, embedded in the album's
+// songs and the covers of matching releases on musicbrainz.
+func (mi *MusicIndex) AlbumArtCandidates(albumName string) ([]ArtCandidate, error) {
+	album, song, err := mi.lookupAlbum(albumName)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]ArtCandidate, 0)
+	albumDir := path.Dir(song.Path)
+	if entries, err := os.ReadDir(path.Join(mi.folder, albumDir)); err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() && isImageFile(filepath.Ext(entry.Name())) {
+				candidates = append(candidates, ArtCandidate{
+					ID: "folder:" + entry.Name(), Source: "folder", Name: entry.Name(),
+					Path: path.Join(albumDir, entry.Name()),
+				})
+			}
+		}
+	}
+	if _, err := readEmbeddedArt(mi.folder, &song); err == nil {
+		candidates = append(candidates, ArtCandidate{ID: "embedded", Source: "embedded", Name: path.Base(song.Path)})
+	}
+	releases, err := searchMusicBrainz(album.Artist, album.Name, 5)
+	if err != nil {
+		log.Printf("failed to search musicbrainz for %s %s: %v", album.Artist, album.Name, err)
+	}
+	for _, release := range releases {
+		name := release.Title
+		if len(release.Date) > 0 {
+			name += " (" + release.Date + ")"
+		}
+		candidates = append(candidates, ArtCandidate{
+			ID: "online:" + release.ID, Source: "online", Name: name,
+			URL: fmt.Sprintf("https://coverartarchive.org/release/%s/front-250", release.ID),
+		})
+	}
+	return candidates, nil
+}
+
+// EmbeddedAlbumArt returns the picture embedded in the first song of the album.
+func (mi *MusicIndex) EmbeddedAlbumArt(albumName string) (*tag.Picture, error) {
+	_, song, err := mi.lookupAlbum(albumName)
+	if err != nil {
+		return nil, err
+	}
+	pic, err := readEmbeddedArt(mi.folder, &song)
+	if errors.Is(err, errNoAlbumArt) {
+		return nil, ErrNotFound
+	}
+	return pic, err
+}
+
+// SetAlbumArt replaces the album art with one of the candidates returned by AlbumArtCandidates.
+func (mi *MusicIndex) SetAlbumArt(albumName, candidateID string) error {
+	_, song, err := mi.lookupAlbum(albumName)
+	if err != nil {
+		return err
+	}
+	source, name, _ := strings.Cut(candidateID, ":")
+	switch source {
+	case "embedded":
+		pic, err := readEmbeddedArt(mi.folder, &song)
+		if err != nil {
+			return err
+		}
+		return mi.UploadAlbumArt(albumName, bytes.NewReader(pic.Data))
+	case "folder":
+		if name != path.Base(name) || !isImageFile(filepath.Ext(name)) {
+			return fmt.Errorf("%w: %s", ErrBadImage, name)
+		}
+		if name == albumArtName {
+			return mi.setAlbumArtPath(albumName, path.Join(path.Dir(song.Path), albumArtName))
+		}
+		f, err := os.Open(path.Join(mi.folder, path.Dir(song.Path), name))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return mi.UploadAlbumArt(albumName, f)
+	case "online":
+		body, err := fetchCoverArt(name)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		return mi.UploadAlbumArt(albumName, body)
+	default:
+		return fmt.Errorf("%w: unknown album art candidate %s", ErrBadImage, candidateID)
+	}
+}
+
+// UploadAlbumArt replaces the album's Folder.jpg with the given jpeg or png image, or returns
+// ErrBadImage if it is neither.
+func (mi *MusicIndex) UploadAlbumArt(albumName string, r io.Reader) error {
+	_, song, err := mi.lookupAlbum(albumName)
+	if err != nil {
+		return err
+	}
+	albumArtPath := path.Join(path.Dir(song.Path), albumArtName)
+	if err := writeAlbumArt(path.Join(mi.folder, albumArtPath), r); err != nil {
+		return err
+	}
+	return mi.setAlbumArtPath(albumName, albumArtPath)
+}
+
+func (mi *MusicIndex) setAlbumArtPath(albumName, albumArtPath string) error {
+	mi.SongsMu.Lock()
+	albumIdx, ok := mi.AlbumIdByName[albumName]
+	var artist string
+	if ok {
+		mi.Albums[albumIdx].AlbumArtPath = albumArtPath
+		mi.Albums[albumIdx].ProcessedAlbumArt = true
+		artist = mi.Albums[albumIdx].Artist
+	}
+	mi.SongsMu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	log.Printf("album art for %s set to %s", albumName, albumArtPath)
+	if mi.artLedger != nil {
+		mi.artLedger.record(artist, albumName, "manual", nil)
+		if err := mi.artLedger.save(); err != nil {
+			return err
+		}
+	}
+	return mi.save()
+}
@@ -0,0 +1,213 @@
+package music
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// id3WithPicture returns an ID3v2.3 tag holding a front cover picture, followed by a little audio.
+func id3WithPicture(mimeType string, pic []byte) []byte {
+	var frame bytes.Buffer
+	frame.WriteByte(0) // ISO-8859-1
+	frame.WriteString(mimeType)
+	frame.WriteByte(0)
+	frame.WriteByte(3) // front cover
+	frame.WriteByte(0) // no description
+	frame.Write(pic)
+
+	var frames bytes.Buffer
+	frames.WriteString("APIC")
+	binary.Write(&frames, binary.BigEndian, uint32(frame.Len()))
+	frames.Write([]byte{0, 0})
+	frames.Write(frame.Bytes())
+
+	size := frames.Len()
+	tag := []byte{'I', 'D', '3', 3, 0, 0, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	tag = append(tag, frames.Bytes()...)
+	return append(tag, make([]byte, 128)...)
+}
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(1, 1, color.RGBA{R: 255, A: 255})
+	return img
+}
+
+// testLibrary makes a library folder with one album of one song and opens an index of it.
+func testLibrary(t *testing.T, song []byte) *MusicIndex {
+	folder := t.TempDir()
+	songPath := "/Artist/Album/01 Song.mp3"
+	if err := os.MkdirAll(path.Join(folder, path.Dir(songPath)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(folder, songPath), song, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var mi MusicIndex
+	mi.Open(folder)
+	mi.setIndex(
+		[]Song{{Path: songPath, Title: "Song", Artist: "Artist", Album: "Album"}},
+		[]Album{{StartSongIdx: 0, EndSongIdx: 1, Name: "Album", Artist: "Artist"}},
+		[]Artist{{StartAlbumIdx: 0, EndAlbumIdx: 1, Name: "Artist"}},
+		map[string]int{"Album": 0},
+	)
+	return &mi
+}
+
+func TestSetEmbeddedAlbumArt(t *testing.T) {
+	var jpg, pngData bytes.Buffer
+	if err := jpeg.Encode(&jpg, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&pngData, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, mimeType string
+		pic            []byte
+		wantType       string
+	}{
+		{"jpg", "image/jpg", jpg.Bytes(), "image/jpeg"},
+		{"jpeg", "image/jpeg", jpg.Bytes(), "image/jpeg"},
+		{"png without a type", "", pngData.Bytes(), "image/png"},
+		{"png said to be jpeg", "image/jpeg", pngData.Bytes(), "image/png"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mi := testLibrary(t, id3WithPicture(test.mimeType, test.pic))
+			pic, err := mi.EmbeddedAlbumArt("Album")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pic.MIMEType != test.wantType {
+				t.Errorf("got type %q, want %q", pic.MIMEType, test.wantType)
+			}
+			if err := mi.SetAlbumArt("Album", "embedded"); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path.Join(mi.folder, "Artist", "Album", albumArtName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err := jpeg.Decode(f); err != nil {
+				t.Errorf("album art isn't a jpeg: %v", err)
+			}
+			if got := mi.Albums[0].AlbumArtPath; got != "/Artist/Album/"+albumArtName {
+				t.Errorf("got album art path %q", got)
+			}
+		})
+	}
+}
+
+func TestUploadAlbumArt(t *testing.T) {
+	var jpg, pngData bytes.Buffer
+	if err := jpeg.Encode(&jpg, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&pngData, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{"jpeg", jpg.Bytes(), nil},
+		{"png", pngData.Bytes(), nil},
+		{"text", []byte("<html>not an image</html>"), ErrBadImage},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), ErrBadImage},
+		{"cut off jpeg", jpg.Bytes()[:jpg.Len()/2], ErrBadImage},
+		{"cut off png", pngData.Bytes()[:pngData.Len()/2], ErrBadImage},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mi := testLibrary(t, nil)
+			artPath := path.Join(mi.folder, "Artist", "Album", albumArtName)
+			// what's already there is kept if the upload is bad
+			if err := os.WriteFile(artPath, jpg.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := mi.UploadAlbumArt("Album", bytes.NewReader(test.data))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			f, err := os.Open(artPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err := jpeg.Decode(f); err != nil {
+				t.Errorf("album art isn't a jpeg: %v", err)
+			}
+		})
+	}
+}
+
+// TestScanWhileServing reads the index while it is scanned, for go test -race to check.
+func TestScanWhileServing(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffprobe is a shell script")
+	}
+	bin := t.TempDir()
+	ffprobe := "#!/bin/sh\necho '{\"format\":{\"duration\":\"61.5\",\"tags\":{\"track\":\"1/1\"}}}'\n"
+	if err := os.WriteFile(filepath.Join(bin, "ffprobe"), []byte(ffprobe), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	mi := testLibrary(t, id3WithPicture("image/jpeg", jpg.Bytes()))
+	// with a Folder.jpg the scan doesn't go looking for art online
+	if err := os.WriteFile(path.Join(mi.folder, "Artist", "Album", albumArtName), jpg.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mi.Scan()
+	}()
+	for scanning := true; scanning; {
+		select {
+		case <-done:
+			scanning = false
+		default:
+		}
+		mi.EmbeddedAlbumArt("Album")
+		mi.ArtLookupFailures()
+	}
+	mi.SongsMu.Lock()
+	defer mi.SongsMu.Unlock()
+	if len(mi.Songs) != 1 || mi.Songs[0].DurationSecs != 61 {
+		t.Errorf("got songs %+v", mi.Songs)
+	}
+}
+
+func TestLookupMissingAlbumArtSaves(t *testing.T) {
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	mi := testLibrary(t, id3WithPicture("image/jpeg", jpg.Bytes()))
+	mi.lookupMissingAlbumArt()
+	index, err := loadIndex(mi.folder)
+	if err != nil {
+		t.Fatalf("music.dat wasn't saved: %v", err)
+	}
+	if got := index.Albums[0].AlbumArtPath; got != "/Artist/Album/"+albumArtName {
+		t.Errorf("got saved album art path %q", got)
+	}
+}
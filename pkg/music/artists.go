@@ -0,0 +1,214 @@
+package music
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	artistImageName = "artist.jpg"
+	// how long to wait before asking the provider again about an artist it knew nothing about
+	artistInfoRetry = 30 * 24 * time.Hour
+)
+
+// ArtistInfo is the biography and image of an artist as reported by an ArtistInfoProvider.
+type ArtistInfo struct {
+	Name, Biography string
+	ImageURL        string
+	Source          string
+	Fetched         time.Time
+}
+
+// ArtistInfoProvider looks up artist imagery and biographies from an online source.
+// It returns a nil ArtistInfo if the artist is unknown.
+type ArtistInfoProvider interface {
+	ArtistInfo(name string) (*ArtistInfo, error)
+}
+
+// AudioDBProvider looks up artists on theaudiodb.com using the public test api key. URL is where the
+// api is, which is theaudiodb if it is empty.
+type AudioDBProvider struct {
+	URL string
+}
+
+func (p AudioDBProvider) ArtistInfo(name string) (*ArtistInfo, error) {
+	apiURL := p.URL
+	if len(apiURL) == 0 {
+		apiURL = "https://www.theaudiodb.com/api/v1/json/2"
+	}
+	res, err := http.Get(apiURL + "/search.php?s=" + url.QueryEscape(name))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("theaudiodb returned %d", res.StatusCode)
+	}
+	var result struct {
+		Artists []struct {
+			Artist      string `json:"strArtist"`
+			BiographyEN string `json:"strBiographyEN"`
+			ArtistThumb string `json:"strArtistThumb"`
+		} `json:"artists"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Artists) == 0 {
+		return nil, nil
+	}
+	artist := result.Artists[0]
+	return &ArtistInfo{Name: artist.Artist, Biography: artist.BiographyEN, ImageURL: artist.ArtistThumb, Source: "theaudiodb"}, nil
+}
+
+// artistFolder returns the <Artist> folder of a song stored as <Artist>/<Album>/<Track>, or an empty string.
+func artistFolder(songPath string) string {
+	dir := path.Dir(path.Dir(songPath))
+	if dir == "/" || dir == "." {
+		return ""
+	}
+	return dir
+}
+
+func loadArtistInfo(folder string) (map[string]ArtistInfo, error) {
+	f, err := os.Open(path.Join(folder, "artists.dat"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var infos map[string]ArtistInfo
+	if err := gob.NewDecoder(f).Decode(&infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+func saveArtistInfo(folder string, infos map[string]ArtistInfo) error {
+	f, err := os.Create(path.Join(folder, "artists.dat"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return gob.NewEncoder(f).Encode(infos)
+}
+
+// ArtistInfo returns the cached information for an artist, asking the provider if it is missing.
+func (mi *MusicIndex) ArtistInfo(name string) (*ArtistInfo, error) {
+	mi.SongsMu.Lock()
+	found := false
+	for _, artist := range mi.Artists {
+		if artist.Name == name {
+			found = true
+			break
+		}
+	}
+	mi.SongsMu.Unlock()
+	if !found {
+		return nil, ErrNotFound
+	}
+	mi.artistInfoMu.Lock()
+	info, ok := mi.artistInfo[name]
+	mi.artistInfoMu.Unlock()
+	if !ok && mi.ArtistInfoProvider != nil {
+		if err := mi.fetchArtistInfo(name); err != nil {
+			return nil, err
+		}
+		mi.artistInfoMu.Lock()
+		info = mi.artistInfo[name]
+		mi.artistInfoMu.Unlock()
+	}
+	if len(info.Name) == 0 {
+		info.Name = name
+	}
+	return &info, nil
+}
+
+// fetchArtistInfo asks the provider about an artist, caches the result and saves the artist
+// image as artist.jpg in the artist folder if there isn't one already.
+func (mi *MusicIndex) fetchArtistInfo(name string) error {
+	info, err := mi.ArtistInfoProvider.ArtistInfo(name)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		info = &ArtistInfo{Name: name}
+	}
+	info.Fetched = time.Now()
+
+	mi.artistInfoMu.Lock()
+	if mi.artistInfo == nil {
+		mi.artistInfo = make(map[string]ArtistInfo)
+	}
+	mi.artistInfo[name] = *info
+	err = saveArtistInfo(mi.folder, mi.artistInfo)
+	mi.artistInfoMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if len(info.ImageURL) > 0 {
+		if err := mi.downloadArtistImage(name, info.ImageURL); err != nil {
+			log.Printf("failed to download artist image for %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (mi *MusicIndex) downloadArtistImage(name, imageURL string) error {
+	mi.SongsMu.Lock()
+	var folderPath string
+	for _, artist := range mi.Artists {
+		if artist.Name == name && len(artist.ImagePath) == 0 {
+			folderPath = artist.FolderPath
+			break
+		}
+	}
+	mi.SongsMu.Unlock()
+	if len(folderPath) == 0 {
+		return nil
+	}
+	res, err := http.Get(imageURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("%s returned %d", imageURL, res.StatusCode)
+	}
+	imagePath := path.Join(folderPath, artistImageName)
+	if err := writeAlbumArt(path.Join(mi.folder, imagePath), res.Body); err != nil {
+		return err
+	}
+	mi.SongsMu.Lock()
+	for idx := range mi.Artists {
+		if mi.Artists[idx].Name == name {
+			mi.Artists[idx].ImagePath = imagePath
+		}
+	}
+	mi.SongsMu.Unlock()
+	log.Printf("downloaded artist image for %s to %s", name, imagePath)
+	return mi.save()
+}
+
+// lookupArtistInfo fetches any artist information missing from the cache.
+func (mi *MusicIndex) lookupArtistInfo(artists []Artist) {
+	for _, artist := range artists {
+		mi.artistInfoMu.Lock()
+		info, ok := mi.artistInfo[artist.Name]
+		mi.artistInfoMu.Unlock()
+		if ok && (len(info.Source) > 0 || time.Since(info.Fetched) < artistInfoRetry) {
+			continue
+		}
+		if err := mi.fetchArtistInfo(artist.Name); err != nil {
+			log.Printf("failed to lookup artist info for %s: %v", artist.Name, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
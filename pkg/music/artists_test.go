@@ -0,0 +1,104 @@
+package music
+
+import (
+	"bytes"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLookupArtistInfo(t *testing.T) {
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	var searchesMu sync.Mutex
+	searches := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/search.php":
+			name := r.URL.Query().Get("s")
+			searchesMu.Lock()
+			searches[name]++
+			searchesMu.Unlock()
+			if name == "Radiohead" {
+				w.Write([]byte(`{"artists":[{"strArtist":"Radiohead","strBiographyEN":"A band from Abingdon.","strArtistThumb":"http://` + r.Host + `/thumb.jpg"}]}`))
+			} else {
+				w.Write([]byte(`{"artists":null}`))
+			}
+		case "/thumb.jpg":
+			w.Write(jpg.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	var mi MusicIndex
+	mi.Open(t.TempDir())
+	mi.ArtistInfoProvider = AudioDBProvider{URL: srv.URL}
+	for _, folder := range []string{"Radiohead", "Nobody"} {
+		if err := os.MkdirAll(path.Join(mi.folder, folder), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mi.setIndex(
+		[]Song{
+			{Path: "/Nobody/Album/01 Song.mp3", Title: "Song", Artist: "Nobody", Album: "Album"},
+			{Path: "/Radiohead/OK Computer/01 Airbag.mp3", Title: "Airbag", Artist: "Radiohead", Album: "OK Computer"},
+		},
+		[]Album{
+			{StartSongIdx: 0, EndSongIdx: 1, Name: "Album", Artist: "Nobody"},
+			{StartSongIdx: 1, EndSongIdx: 2, Name: "OK Computer", Artist: "Radiohead"},
+		},
+		[]Artist{
+			{StartAlbumIdx: 0, EndAlbumIdx: 1, Name: "Nobody", FolderPath: "/Nobody"},
+			{StartAlbumIdx: 1, EndAlbumIdx: 2, Name: "Radiohead", FolderPath: "/Radiohead"},
+		},
+		map[string]int{"Album": 0, "OK Computer": 1},
+	)
+
+	info, err := mi.ArtistInfo("Radiohead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Biography != "A band from Abingdon." || info.Source != "theaudiodb" {
+		t.Errorf("got artist info %+v", info)
+	}
+	f, err := os.Open(path.Join(mi.folder, "Radiohead", artistImageName))
+	if err != nil {
+		t.Fatalf("artist image wasn't saved: %v", err)
+	}
+	defer f.Close()
+	if _, err := jpeg.Decode(f); err != nil {
+		t.Errorf("artist image isn't a jpeg: %v", err)
+	}
+	mi.SongsMu.Lock()
+	imagePath := mi.Artists[1].ImagePath
+	mi.SongsMu.Unlock()
+	if imagePath != "/Radiohead/"+artistImageName {
+		t.Errorf("got artist image path %q", imagePath)
+	}
+
+	// artists the provider doesn't know are only asked about again once the retry window has passed
+	artists := []Artist{{Name: "Nobody", FolderPath: "/Nobody"}, {Name: "Radiohead", FolderPath: "/Radiohead"}}
+	mi.lookupArtistInfo(artists)
+	mi.lookupArtistInfo(artists)
+	if searches["Nobody"] != 1 || searches["Radiohead"] != 1 {
+		t.Errorf("got searches %v, want one for each artist", searches)
+	}
+	mi.artistInfoMu.Lock()
+	nobody := mi.artistInfo["Nobody"]
+	nobody.Fetched = time.Now().Add(-artistInfoRetry - time.Hour)
+	mi.artistInfo["Nobody"] = nobody
+	mi.artistInfoMu.Unlock()
+	mi.lookupArtistInfo(artists)
+	if searches["Nobody"] != 2 || searches["Radiohead"] != 1 {
+		t.Errorf("got searches %v after the retry window, want Nobody searched again", searches)
+	}
+}
@@ -0,0 +1,213 @@
+package music
+
+import (
+	"encoding/csv"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ArtOutcomeFound    = "found"
+	ArtOutcomeNotFound = "notfound"
+	ArtOutcomeError    = "error"
+
+	// retry delays double with each failed attempt up to artRetryMax
+	artRetryNotFound = 7 * 24 * time.Hour
+	artRetryError    = 24 * time.Hour
+	artRetryMax      = 90 * 24 * time.Hour
+)
+
+// ArtLookup records the album art lookups made for an album.
+type ArtLookup struct {
+	Artist, Album string
+	Attempts      int
+	LastAttempt   time.Time
+	Outcome       string
+	Provider      string
+	RetryAfter    time.Time
+	Error         string `json:",omitempty"`
+}
+
+// artLedger is the albums.csv file next to music.dat, recording album art lookups so we
+// don't keep asking musicbrainz about albums it doesn't know about.
+type artLedger struct {
+	mu      sync.Mutex
+	folder  string
+	lookups map[string]*ArtLookup
+}
+
+var artLedgerHeader = []string{"artist", "album", "attempts", "last_attempt", "outcome", "provider", "retry_after", "error"}
+
+func artLedgerKey(artist, album string) string {
+	return artist + ":" + album
+}
+
+func loadArtLedger(folder string) (*artLedger, error) {
+	l := &artLedger{folder: folder, lookups: make(map[string]*ArtLookup)}
+	f, err := os.Open(path.Join(folder, "albums.csv"))
+	if err != nil {
+		return l, err
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return l, err
+	}
+	for idx, record := range records {
+		if idx == 0 || len(record) != len(artLedgerHeader) {
+			continue
+		}
+		attempts, _ := strconv.Atoi(record[2])
+		lastAttempt, _ := time.Parse(time.RFC3339, record[3])
+		retryAfter, _ := time.Parse(time.RFC3339, record[6])
+		l.lookups[artLedgerKey(record[0], record[1])] = &ArtLookup{
+			Artist: record[0], Album: record[1],
+			Attempts: attempts, LastAttempt: lastAttempt,
+			Outcome: record[4], Provider: record[5],
+			RetryAfter: retryAfter, Error: record[7],
+		}
+	}
+	return l, nil
+}
+
+func (l *artLedger) save() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keys := make([]string, 0, len(l.lookups))
+	for key := range l.lookups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	f, err := os.Create(path.Join(l.folder, "albums.csv"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	if err := w.Write(artLedgerHeader); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		lookup := l.lookups[key]
+		if err := w.Write([]string{
+			lookup.Artist, lookup.Album,
+			strconv.Itoa(lookup.Attempts), lookup.LastAttempt.Format(time.RFC3339),
+			lookup.Outcome, lookup.Provider,
+			lookup.RetryAfter.Format(time.RFC3339), lookup.Error,
+		}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// shouldLookup returns true if we have never looked for the album's art or the retry time has passed.
+func (l *artLedger) shouldLookup(album *Album) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lookup, ok := l.lookups[artLedgerKey(album.Artist, album.Name)]
+	if !ok {
+		if album.ProcessedAlbumArt {
+			// looked up before the ledger existed, treat it as not found
+			l.lookups[artLedgerKey(album.Artist, album.Name)] = &ArtLookup{
+				Artist: album.Artist, Album: album.Name, Attempts: 1,
+				LastAttempt: time.Now(), Outcome: ArtOutcomeNotFound,
+				RetryAfter: time.Now().Add(artRetryNotFound),
+			}
+			return false
+		}
+		return true
+	}
+	return lookup.Outcome != ArtOutcomeFound && time.Now().After(lookup.RetryAfter)
+}
+
+func (l *artLedger) record(artist, album, provider string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := artLedgerKey(artist, album)
+	lookup, ok := l.lookups[key]
+	if !ok {
+		lookup = &ArtLookup{Artist: artist, Album: album}
+		l.lookups[key] = lookup
+	}
+	lookup.Attempts++
+	lookup.LastAttempt = time.Now()
+	lookup.Provider = provider
+	lookup.Error = ""
+	retryDelay := time.Duration(0)
+	if err == nil {
+		lookup.Outcome = ArtOutcomeFound
+	} else if errors.Is(err, errNoAlbumArt) {
+		lookup.Outcome = ArtOutcomeNotFound
+		retryDelay = artRetryNotFound
+	} else {
+		lookup.Outcome = ArtOutcomeError
+		lookup.Error = err.Error()
+		retryDelay = artRetryError
+	}
+	for i := 1; i < lookup.Attempts && retryDelay < artRetryMax; i++ {
+		retryDelay *= 2
+	}
+	if retryDelay > artRetryMax {
+		retryDelay = artRetryMax
+	}
+	lookup.RetryAfter = lookup.LastAttempt.Add(retryDelay)
+}
+
+func (l *artLedger) failures() []ArtLookup {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	failures := make([]ArtLookup, 0)
+	for _, lookup := range l.lookups {
+		if lookup.Outcome != ArtOutcomeFound {
+			failures = append(failures, *lookup)
+		}
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return artLedgerKey(failures[i].Artist, failures[i].Album) < artLedgerKey(failures[j].Artist, failures[j].Album)
+	})
+	return failures
+}
+
+// retryNow clears the retry time of failed lookups matching the album name, or every failed lookup
+// if albumName is empty. It returns the number of lookups that will be retried.
+func (l *artLedger) retryNow(albumName string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	numRetries := 0
+	for _, lookup := range l.lookups {
+		if lookup.Outcome != ArtOutcomeFound && (len(albumName) == 0 || lookup.Album == albumName) {
+			lookup.RetryAfter = time.Time{}
+			numRetries++
+		}
+	}
+	return numRetries
+}
+
+// ArtLookupFailures lists the albums we failed to find album art for.
+func (mi *MusicIndex) ArtLookupFailures() []ArtLookup {
+	if mi.artLedger == nil {
+		return []ArtLookup{}
+	}
+	return mi.artLedger.failures()
+}
+
+// RetryArtLookups retries failed album art lookups for the named album, or all albums if albumName
+// is empty, in the background.
+func (mi *MusicIndex) RetryArtLookups(albumName string) (int, error) {
+	if mi.artLedger == nil {
+		return 0, errors.New("index not loaded yet")
+	}
+	numRetries := mi.artLedger.retryNow(albumName)
+	if numRetries == 0 {
+		return 0, nil
+	}
+	go mi.lookupMissingAlbumArt()
+	return numRetries, nil
+}
@@ -0,0 +1,49 @@
+package music
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestArtLedgerRecord(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/release/no-cover/front":
+			http.NotFound(w, r)
+		default:
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	defer func(url string) { coverArtArchive = url }(coverArtArchive)
+	coverArtArchive = srv.URL
+	_, noCover := fetchCoverArt("no-cover")
+	_, down := fetchCoverArt("down")
+
+	tests := []struct {
+		name        string
+		err         error
+		wantOutcome string
+		wantRetry   time.Duration
+	}{
+		{"found", nil, ArtOutcomeFound, 0},
+		{"no cover", noCover, ArtOutcomeNotFound, artRetryNotFound},
+		{"no musicbrainz results", errNoAlbumArt, ArtOutcomeNotFound, artRetryNotFound},
+		{"coverartarchive down", down, ArtOutcomeError, artRetryError},
+		{"no network", errors.New("dial tcp: connection refused"), ArtOutcomeError, artRetryError},
+	}
+	for _, test := range tests {
+		l := &artLedger{folder: t.TempDir(), lookups: make(map[string]*ArtLookup)}
+		l.record("Artist", "Album", "musicbrainz", test.err)
+		lookup := l.lookups[artLedgerKey("Artist", "Album")]
+		if lookup.Outcome != test.wantOutcome {
+			t.Errorf("%s: got outcome %s, want %s", test.name, lookup.Outcome, test.wantOutcome)
+		}
+		if got := lookup.RetryAfter.Sub(lookup.LastAttempt); got != test.wantRetry {
+			t.Errorf("%s: got retry after %s, want %s", test.name, got, test.wantRetry)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package music
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PlayStart    = "start"
+	PlayComplete = "complete"
+
+	// a song played on a sonos counts as played once half of it, or four minutes of it, has been heard
+	sonosPlayThreshold = 4 * time.Minute
+)
+
+// ErrBadPlay is returned when recording a play with an unknown event.
+var ErrBadPlay = errors.New("bad play event")
+
+// PlayEvent is a song starting or finishing in the browser or on a sonos.
+type PlayEvent struct {
+	Time  time.Time
+	Path  string
+	Room  string `json:",omitempty"` // empty if played in the browser
+	Event string
+}
+
+// playHistory is the history.jsonl file next to music.dat, with a PlayEvent on each line.
+type playHistory struct {
+	mu     sync.Mutex
+	folder string
+}
+
+// sonosPlay tracks the song playing in a sonos room, to work out when it has been played.
+type sonosPlay struct {
+	trackURI, state string
+	path            string
+	playing         time.Duration
+	playingSince    time.Time
+}
+
+func loadPlayHistory(folder string) (map[string]PlayStats, error) {
+	stats := make(map[string]PlayStats)
+	f, err := os.Open(path.Join(folder, "history.jsonl"))
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev PlayEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			// skip a line that was only partly written
+			continue
+		}
+		stats[ev.Path] = addPlayEvent(stats[ev.Path], &ev)
+	}
+	return stats, scanner.Err()
+}
+
+func addPlayEvent(stats PlayStats, ev *PlayEvent) PlayStats {
+	if ev.Event == PlayComplete {
+		stats.Plays++
+	}
+	if ev.Time.After(stats.LastPlayed) {
+		stats.LastPlayed = ev.Time
+	}
+	return stats
+}
+
+func (h *playHistory) append(ev *PlayEvent) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(path.Join(h.folder, "history.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// songPlayStats returns how often and when a song was played.
+func (mi *MusicIndex) songPlayStats(songPath string) PlayStats {
+	mi.playStatsMu.Lock()
+	defer mi.playStatsMu.Unlock()
+	return mi.playStats[songPath]
+}
+
+// Plays returns how many times a song has been played.
+func (mi *MusicIndex) Plays(songPath string) int {
+	return mi.songPlayStats(songPath).Plays
+}
+
+func (mi *MusicIndex) recordPlay(songPath, room, event string) error {
+	mi.playStatsMu.Lock()
+	history := mi.history
+	mi.playStatsMu.Unlock()
+	if history == nil {
+		return errors.New("index not loaded yet")
+	}
+	ev := PlayEvent{Time: time.Now(), Path: songPath, Room: room, Event: event}
+	if err := history.append(&ev); err != nil {
+		return err
+	}
+	mi.playStatsMu.Lock()
+	mi.playStats[songPath] = addPlayEvent(mi.playStats[songPath], &ev)
+	mi.playsVersion++
+	mi.playStatsMu.Unlock()
+	return nil
+}
+
+// RecordPlay records a song starting or completing in the browser.
+func (mi *MusicIndex) RecordPlay(songId int, event string) error {
+	if event != PlayStart && event != PlayComplete {
+		return fmt.Errorf("%w: %q", ErrBadPlay, event)
+	}
+	mi.SongsMu.Lock()
+	if songId < 0 || songId >= len(mi.Songs) {
+		mi.SongsMu.Unlock()
+		return ErrNotFound
+	}
+	songPath := mi.Songs[songId].Path
+	mi.SongsMu.Unlock()
+	return mi.recordPlay(songPath, "", event)
+}
+
+// songPathFromURI returns the path of the song a sonos is playing, which is served from /content.
+func songPathFromURI(trackURI string) (string, bool) {
+	u, err := url.Parse(trackURI)
+	if err != nil || !strings.HasPrefix(u.Path, "/content/") {
+		return "", false
+	}
+	return strings.TrimPrefix(u.Path, "/content"), true
+}
+
+// TrackSonosPlay is given the track and transport state from the AVTransport events of a sonos room,
+// recording a start when one of our songs starts playing and a completion if enough of it was heard
+// before the track changed or the room stopped. Events may only contain the values that changed, and
+// repeat values that haven't, so repeated events are ignored.
+func (mi *MusicIndex) TrackSonosPlay(room, trackURI, state string) {
+	mi.sonosPlaysMu.Lock()
+	if mi.sonosPlays == nil {
+		mi.sonosPlays = make(map[string]*sonosPlay)
+	}
+	play, ok := mi.sonosPlays[room]
+	if !ok {
+		play = &sonosPlay{}
+		mi.sonosPlays[room] = play
+	}
+	if len(trackURI) == 0 {
+		trackURI = play.trackURI
+	}
+	if len(state) == 0 {
+		state = play.state
+	}
+	now := time.Now()
+	var finishedPath string
+	var finishedPlaying time.Duration
+	// stopping finishes the track, so playing it again counts as another play
+	if trackURI != play.trackURI || (state == "STOPPED" && play.state != "STOPPED") {
+		if !play.playingSince.IsZero() {
+			play.playing += now.Sub(play.playingSince)
+		}
+		finishedPath, finishedPlaying = play.path, play.playing
+		play.path, _ = songPathFromURI(trackURI)
+		play.playing, play.playingSince = 0, time.Time{}
+		play.trackURI, play.state = trackURI, ""
+	}
+	started := false
+	if state != play.state {
+		if state == "PLAYING" {
+			started = play.playing == 0 && play.playingSince.IsZero()
+			play.playingSince = now
+		} else if !play.playingSince.IsZero() {
+			play.playing += now.Sub(play.playingSince)
+			play.playingSince = time.Time{}
+		}
+		play.state = state
+	}
+	startedPath := play.path
+	mi.sonosPlaysMu.Unlock()
+
+	if len(finishedPath) > 0 {
+		threshold := sonosPlayThreshold
+		mi.SongsMu.Lock()
+		if songId, ok := mi.songIdByPath[finishedPath]; ok && mi.Songs[songId].DurationSecs > 0 {
+			if half := time.Duration(mi.Songs[songId].DurationSecs) * time.Second / 2; half < threshold {
+				threshold = half
+			}
+		}
+		mi.SongsMu.Unlock()
+		if finishedPlaying >= threshold {
+			if err := mi.recordPlay(finishedPath, room, PlayComplete); err != nil {
+				log.Printf("failed to record play of %s: %v", finishedPath, err)
+			}
+		}
+	}
+	if started && len(startedPath) > 0 {
+		if err := mi.recordPlay(startedPath, room, PlayStart); err != nil {
+			log.Printf("failed to record play of %s: %v", startedPath, err)
+		}
+	}
+}
+
+// playedSongIds returns the ids of the songs in the library with play stats matching include, sorted by less.
+func (mi *MusicIndex) playedSongIds(include func(stats PlayStats) bool, less func(a, b PlayStats) bool, limit int) []int {
+	mi.SongsMu.Lock()
+	defer mi.SongsMu.Unlock()
+	mi.playStatsMu.Lock()
+	defer mi.playStatsMu.Unlock()
+	songIds := make([]int, 0)
+	for songPath, stats := range mi.playStats {
+		if songId, ok := mi.songIdByPath[songPath]; ok && include(stats) {
+			songIds = append(songIds, songId)
+		}
+	}
+	sort.Slice(songIds, func(i, j int) bool {
+		a, b := mi.playStats[mi.Songs[songIds[i]].Path], mi.playStats[mi.Songs[songIds[j]].Path]
+		if less(a, b) {
+			return true
+		} else if less(b, a) {
+			return false
+		}
+		return songIds[i] < songIds[j]
+	})
+	if limit > 0 && len(songIds) > limit {
+		songIds = songIds[:limit]
+	}
+	return songIds
+}
+
+// RecentlyPlayed returns the ids of the most recently played songs.
+func (mi *MusicIndex) RecentlyPlayed(limit int) []int {
+	return mi.playedSongIds(
+		func(stats PlayStats) bool { return !stats.LastPlayed.IsZero() },
+		func(a, b PlayStats) bool { return a.LastPlayed.After(b.LastPlayed) },
+		limit,
+	)
+}
+
+// MostPlayed returns the ids of the most played songs.
+func (mi *MusicIndex) MostPlayed(limit int) []int {
+	return mi.playedSongIds(
+		func(stats PlayStats) bool { return stats.Plays > 0 },
+		func(a, b PlayStats) bool {
+			if a.Plays != b.Plays {
+				return a.Plays > b.Plays
+			}
+			return a.LastPlayed.After(b.LastPlayed)
+		},
+		limit,
+	)
+}
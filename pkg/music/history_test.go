@@ -0,0 +1,51 @@
+package music
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrackSonosPlayStopped(t *testing.T) {
+	var mi MusicIndex
+	mi.Open(t.TempDir())
+	mi.playStats = make(map[string]PlayStats)
+	mi.history = &playHistory{folder: mi.folder}
+	mi.setIndex([]Song{{Path: "/a/1.mp3", Title: "One", DurationSecs: 200}}, nil, nil, map[string]int{})
+	const trackURI = "http://192.0.2.1:3000/content/a/1.mp3"
+	// pretend the room has been playing for longer than it has
+	playFor := func(d time.Duration) {
+		mi.sonosPlaysMu.Lock()
+		mi.sonosPlays["Office"].playingSince = time.Now().Add(-d)
+		mi.sonosPlaysMu.Unlock()
+	}
+
+	tests := []struct {
+		name      string
+		state     string
+		playFor   time.Duration
+		wantPlays int
+	}{
+		{"starting", "PLAYING", 3 * time.Minute, 0},
+		{"stopping after most of it", "STOPPED", 0, 1},
+		{"stopping again", "STOPPED", 0, 1},
+		{"playing it again", "PLAYING", 0, 1},
+		{"stopping straight away", "STOPPED", 0, 1},
+		{"playing it once more", "PLAYING", 2 * time.Minute, 1},
+		{"pausing", "PAUSED_PLAYBACK", 0, 1},
+		{"stopping after pausing", "STOPPED", 0, 2},
+	}
+	for _, test := range tests {
+		// the track is only sent when it changes
+		uri := ""
+		if test.name == "starting" {
+			uri = trackURI
+		}
+		mi.TrackSonosPlay("Office", uri, test.state)
+		if test.playFor > 0 {
+			playFor(test.playFor)
+		}
+		if got := mi.Plays("/a/1.mp3"); got != test.wantPlays {
+			t.Errorf("%s: got %d plays, want %d", test.name, got, test.wantPlays)
+		}
+	}
+}
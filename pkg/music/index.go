@@ -1,18 +1,11 @@
 package music
 
 import (
-	"bytes"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"image"
-	"image/color"
-	"image/draw"
-	"image/jpeg"
-	"image/png"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"path"
@@ -26,8 +19,6 @@ import (
 	"time"
 
 	"github.com/dhowden/tag"
-	"golang.org/x/text/language"
-	"golang.org/x/text/search"
 )
 
 func IsMusicFile(ext string) bool {
@@ -41,21 +32,34 @@ func IsMusicFile(ext string) bool {
 
 type Song struct {
 	Path, Title, Artist, Album string
+	Genre                      string
+	// Lyrics are the contents of the LyricsPath .lrc file if there is one, otherwise the embedded lyrics
+	Lyrics, LyricsPath         string
 	TrackNum, TrackTotal, Year int
 	DurationSecs               int
 	ProcessedFFProbe           bool
+	FFProbeVersion             int
+	// AddedAt is when the song was found in the library, or the file modification time for
+	// songs found by the first scan
+	AddedAt time.Time
 }
 
+// ffprobeVersion is bumped whenever we start reading more from ffprobe so existing songs are probed again.
+const ffprobeVersion = 3
+
 type Album struct {
 	StartSongIdx, EndSongIdx int
 	Name, Artist             string
 	AlbumArtPath             string
 	ProcessedAlbumArt        bool
+	// AddedAt is when the first song in the album was added, kept from the first scan that found it
+	AddedAt time.Time
 }
 
 type Artist struct {
 	StartAlbumIdx, EndAlbumIdx int
 	Name                       string
+	FolderPath, ImagePath      string
 }
 
 type MusicIndex struct {
@@ -65,6 +69,35 @@ type MusicIndex struct {
 	Albums  []Album
 
 	AlbumIdByName map[string]int
+	songIdByPath  map[string]int
+	search        *searchIndex
+	// generation is bumped every time the index changes, and playsVersion and ratingsVersion every time a
+	// song is played or rated, invalidating any cached smart playlists that depend on them
+	generation int
+	smartCache map[int]smartResult
+
+	history      *playHistory
+	playStats    map[string]PlayStats
+	playsVersion int
+	playStatsMu  sync.Mutex
+	sonosPlays   map[string]*sonosPlay
+	sonosPlaysMu sync.Mutex
+
+	ratings        *ratingsData
+	ratingsVersion int
+	ratingsMu      sync.Mutex
+
+	// ArtistInfoProvider is used to fetch artist images and biographies if set.
+	ArtistInfoProvider ArtistInfoProvider
+	artistInfo         map[string]ArtistInfo
+	artistInfoMu       sync.Mutex
+
+	folder      string
+	saveMu      sync.Mutex
+	artLedger   *artLedger
+	artLookupMu sync.Mutex
+	playlists   *playlistData
+	playlistsMu sync.Mutex
 }
 
 type ffprobeTags struct {
@@ -73,6 +106,7 @@ type ffprobeTags struct {
 	Title  string `json:"title"`
 	Track  string `json:"track"`
 	Date   string `json:"date"`
+	Genre  string `json:"genre"`
 }
 
 type ffprobeFormat struct {
@@ -84,7 +118,7 @@ type ffprobeResult struct {
 	Format ffprobeFormat `json:"format"`
 }
 
-func scanFolder(songs []Song, rootFolder, folder string, ffprobePath string) ([]Song, error) {
+func scanFolder(songs []Song, playlistFiles *[]string, rootFolder, folder string, ffprobePath string) ([]Song, error) {
 	entries, err := os.ReadDir(folder)
 	if err != nil {
 		return nil, err
@@ -92,11 +126,12 @@ func scanFolder(songs []Song, rootFolder, folder string, ffprobePath string) ([]
 
 	foundSongs, foundTrackNums := false, false
 	numSongs := len(songs)
+	lrcFiles := make(map[string]string)
 	for _, entry := range entries {
 		name := entry.Name()
 		if entry.IsDir() {
 			var err error
-			songs, err = scanFolder(songs, rootFolder, path.Join(folder, name), ffprobePath)
+			songs, err = scanFolder(songs, playlistFiles, rootFolder, path.Join(folder, name), ffprobePath)
 			if err != nil {
 				return nil, fmt.Errorf("%s: %w", name, err)
 			}
@@ -104,6 +139,14 @@ func scanFolder(songs []Song, rootFolder, folder string, ffprobePath string) ([]
 			ext := filepath.Ext(name)
 			fullPath := path.Join(folder, entry.Name())
 			relativePath := strings.ReplaceAll(fullPath, rootFolder, "")
+			if ext == ".lrc" {
+				lrcFiles[strings.TrimSuffix(relativePath, ext)] = relativePath
+				continue
+			}
+			if IsPlaylistFile(ext) {
+				*playlistFiles = append(*playlistFiles, relativePath)
+				continue
+			}
 			if !IsMusicFile(ext) {
 				switch ext {
 				case ".jpg", ".ini", ".DS_Store", ".db", ".png", ".html", ".wpl", ".js", ".pdf", ".m4p", ".wma":
@@ -119,6 +162,7 @@ func scanFolder(songs []Song, rootFolder, folder string, ffprobePath string) ([]
 	if foundSongs {
 		for i := range songs[numSongs:] {
 			song := &songs[i+numSongs]
+			song.LyricsPath = lyricsSidecar(song.Path, lrcFiles)
 			bits := strings.Split(song.Path, "/")
 			if len(bits) >= 2 && len(song.Artist) == 0 {
 				if len(bits) >= 3 {
@@ -156,6 +200,16 @@ type musicIndexData struct {
 	Albums  []Album
 }
 
+// readTags reads the tags of a song with the tag library.
+func readTags(fullPath string) (tag.Metadata, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return tag.ReadFrom(f)
+}
+
 func loadIndex(folder string) (*musicIndexData, error) {
 	f, err := os.Open(path.Join(folder, "music.dat"))
 	if err != nil {
@@ -178,114 +232,172 @@ func saveIndex(folder string, index *musicIndexData) error {
 	return gob.NewEncoder(f).Encode(index)
 }
 
-func lookupAlbumArt(album *Album, songs []Song, folder string) error {
-	if album.ProcessedAlbumArt || len(album.AlbumArtPath) > 0 {
-		return nil
+// Generation returns a number that changes every time the songs, albums and artists are replaced by a
+// scan, after which ids from before then no longer refer to the same things. Callers must hold SongsMu.
+func (mi *MusicIndex) Generation() int {
+	return mi.generation
+}
+
+// setIndex swaps in a new snapshot of the library and updates the search index to match.
+func (mi *MusicIndex) setIndex(songs []Song, albums []Album, artists []Artist, albumIdByName map[string]int) {
+	mi.SongsMu.Lock()
+	defer mi.SongsMu.Unlock()
+	mi.Songs, mi.Albums, mi.Artists, mi.AlbumIdByName = songs, albums, artists, albumIdByName
+	mi.generation++
+	mi.songIdByPath = make(map[string]int, len(songs))
+	for idx := range songs {
+		mi.songIdByPath[songs[idx].Path] = idx
+	}
+	if mi.search == nil {
+		mi.search = newSearchIndex()
 	}
-	albumArtPath := path.Join(folder, path.Dir(songs[album.StartSongIdx].Path), "Folder.jpg")
+	start := time.Now()
+	mi.search.update(artists, albums, songs)
+	log.Printf("updated search index in %s", time.Since(start))
+}
+
+// save writes the live index to disk.
+func (mi *MusicIndex) save() error {
+	mi.saveMu.Lock()
+	defer mi.saveMu.Unlock()
+	mi.SongsMu.Lock()
+	index := musicIndexData{Artists: mi.Artists, Songs: mi.Songs, Albums: mi.Albums}
+	mi.SongsMu.Unlock()
+	return saveIndex(mi.folder, &index)
+}
+
+// RecentlyAdded returns the ids of the albums most recently added to the library.
+func (mi *MusicIndex) RecentlyAdded(limit int) []int {
+	mi.SongsMu.Lock()
+	defer mi.SongsMu.Unlock()
+	albumIds := make([]int, len(mi.Albums))
+	for idx := range albumIds {
+		albumIds[idx] = idx
+	}
+	sort.SliceStable(albumIds, func(i, j int) bool {
+		return mi.Albums[albumIds[i]].AddedAt.After(mi.Albums[albumIds[j]].AddedAt)
+	})
+	if limit > 0 && len(albumIds) > limit {
+		albumIds = albumIds[:limit]
+	}
+	return albumIds
+}
 
-	songFile, err := os.Open(path.Join(folder, songs[album.StartSongIdx].Path))
+// AlbumSongIds returns the ids of the songs in an album in track order.
+func (mi *MusicIndex) AlbumSongIds(albumName string) ([]int, error) {
+	album, _, err := mi.lookupAlbum(albumName)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer songFile.Close()
-	m, err := tag.ReadFrom(songFile)
-	if err != nil {
-		return err
+	songIds := make([]int, 0, album.EndSongIdx-album.StartSongIdx)
+	for songId := album.StartSongIdx; songId < album.EndSongIdx; songId++ {
+		songIds = append(songIds, songId)
 	}
-	pic := m.Picture()
-	if pic != nil {
-		if pic.MIMEType == "image/jpeg" {
-			if err := os.WriteFile(albumArtPath, pic.Data, 0644); err != nil {
-				return err
+	return songIds, nil
+}
+
+// ArtistSongIds returns the ids of the songs by an artist, album by album in track order.
+func (mi *MusicIndex) ArtistSongIds(artistName string) ([]int, error) {
+	mi.SongsMu.Lock()
+	defer mi.SongsMu.Unlock()
+	for _, artist := range mi.Artists {
+		if artist.Name != artistName || artist.StartAlbumIdx == artist.EndAlbumIdx {
+			continue
+		}
+		songIds := make([]int, 0)
+		for _, album := range mi.Albums[artist.StartAlbumIdx:artist.EndAlbumIdx] {
+			for songId := album.StartSongIdx; songId < album.EndSongIdx; songId++ {
+				songIds = append(songIds, songId)
 			}
-			album.AlbumArtPath = albumArtPath
-			return err
 		}
+		return songIds, nil
 	}
+	return nil, ErrNotFound
+}
 
-	log.Printf("fetching %s %s", album.Artist, album.Name)
-	url := strings.ReplaceAll(fmt.Sprintf("https://musicbrainz.org/ws/2/release?query=artist=%s AND Album=%s&fmt=json&limit=1", album.Artist, album.Name), " ", "%20")
-	req, err := http.NewRequest("GET", url, bytes.NewReader([]byte{}))
-	req.Header.Add("User-Agent", "MusicBox/0.0.1 ( 3zanders@gmail.com )")
-	if err != nil {
-		return err
-	}
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+// ffprobeCommand returns where ffprobe is, which reads the tags and length of songs.
+func ffprobeCommand() string {
+	if runtime.GOOS == "windows" {
+		return "bin\\ffprobe.exe"
 	}
-	resBytes, err := io.ReadAll(res.Body)
+	return "ffprobe"
+}
+
+// ProbeDuration returns how long an audio file is.
+func ProbeDuration(fullPath string) (time.Duration, error) {
+	ffmpegJson, err := exec.Command(ffprobeCommand(), "-v", "quiet", "-show_format", "-print_format", "json", fullPath).Output()
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("failed to ffprobe %s: %w", fullPath, err)
 	}
-	resStr := string(resBytes)
-	startIdx := strings.Index(resStr, "\"releases\":[{\"id\":\"")
-	var mbid string
-	if startIdx != -1 {
-		endIdx := strings.Index(resStr[startIdx+19:], "\"")
-		mbid = resStr[startIdx+19 : startIdx+19+endIdx]
-		log.Printf("%s %s has mbid %s", album.Artist, album.Name, mbid)
-	} else {
-		log.Printf("%s %s has no results", album.Artist, album.Name)
-		return nil
+	var result ffprobeResult
+	if err := json.Unmarshal(ffmpegJson, &result); err != nil {
+		return 0, fmt.Errorf("failed to parse ffprobe %s: %w", fullPath, err)
 	}
-	imageUrl := fmt.Sprintf("http://coverartarchive.org/release/%s/front", mbid)
-	log.Printf("downloading %s %s: %s to %s", album.Artist, album.Name, imageUrl, albumArtPath)
-	imageRes, err := http.Get(imageUrl)
+	secs, err := strconv.ParseFloat(result.Format.Duration, 64)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("no duration for %s: %w", fullPath, err)
 	}
-	if imageRes.StatusCode == 404 {
-		return fmt.Errorf("404 not found")
-	}
-	if imageRes.StatusCode != 200 {
-		imageResBytes, _ := io.ReadAll(imageRes.Body)
-		return fmt.Errorf("%d: %s", res.StatusCode, string(imageResBytes))
-	}
-	contentType := imageRes.Header.Get("content-type")
-	if contentType == "image/jpeg" {
-		albumArtFile, err := os.Create(albumArtPath)
-		if err != nil {
-			return err
-		}
-		defer albumArtFile.Close()
-		if _, err := io.Copy(albumArtFile, imageRes.Body); err != nil {
-			return err
-		}
-	} else if contentType == "image/png" {
-		img, err := png.Decode(imageRes.Body)
-		if err != nil {
-			return err
-		}
-		newImg := image.NewRGBA(img.Bounds())
-		draw.Draw(newImg, newImg.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
-		draw.Draw(newImg, newImg.Bounds(), img, image.Point{}, draw.Src)
-		albumArtFile, err := os.Create(albumArtPath)
-		if err != nil {
-			return err
-		}
-		defer albumArtFile.Close()
-		if err := jpeg.Encode(albumArtFile, newImg, &jpeg.Options{Quality: 80}); err != nil {
-			return err
-		}
-	} else {
-		return fmt.Errorf("bad image: %s", contentType)
-	}
-	log.Printf("downloaded ok!")
-	time.Sleep(time.Second)
-	album.AlbumArtPath = albumArtPath
-	return nil
+	return time.Duration(secs * float64(time.Second)), nil
 }
 
-func (mi *MusicIndex) Scan(folder string) {
-	ffprobePath := "ffprobe"
-	if runtime.GOOS == "windows" {
-		ffprobePath = "bin\\ffprobe.exe"
-	}
+// Open sets the folder of the library and loads its album art ledger. It must be called before the
+// index is used or scanned, as neither changes afterwards and both are read without a lock.
+func (mi *MusicIndex) Open(folder string) {
+	mi.folder = folder
+	artLedger, err := loadArtLedger(folder)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("failed to load album art ledger: %v", err)
+	}
+	mi.artLedger = artLedger
+}
+
+// Scan loads the index of the folder given to Open and then looks for songs that have been added,
+// changed or removed since.
+func (mi *MusicIndex) Scan() {
+	ffprobePath := ffprobeCommand()
 	if _, err := exec.LookPath(ffprobePath); err != nil {
 		log.Fatal("failed to find ffprobe")
 	}
+	folder := mi.folder
+	playlists, err := loadPlaylists(folder)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to load playlists: %v", err)
+		}
+		playlists = &playlistData{}
+	}
+	mi.playlistsMu.Lock()
+	mi.playlists = playlists
+	mi.playlistsMu.Unlock()
+	ratings, err := loadRatings(folder)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to load ratings: %v", err)
+		}
+		ratings = &ratingsData{}
+	}
+	if ratings.Songs == nil {
+		ratings.Songs = make(map[string]Rating)
+	}
+	if ratings.Albums == nil {
+		ratings.Albums = make(map[string]Rating)
+	}
+	mi.ratingsMu.Lock()
+	mi.ratings = ratings
+	mi.ratingsMu.Unlock()
+	playStats, err := loadPlayHistory(folder)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("failed to load play history: %v", err)
+	}
+	mi.playStatsMu.Lock()
+	mi.playStats = playStats
+	mi.history = &playHistory{folder: folder}
+	mi.playStatsMu.Unlock()
+	if artistInfo, err := loadArtistInfo(folder); err == nil {
+		mi.artistInfoMu.Lock()
+		mi.artistInfo = artistInfo
+		mi.artistInfoMu.Unlock()
+	}
 	// load an existing index file
 	log.Println("loading index")
 	var index *musicIndexData
@@ -301,9 +413,7 @@ func (mi *MusicIndex) Scan(folder string) {
 					index.Albums[idx].AlbumArtPath = strings.TrimPrefix(album.AlbumArtPath, folder)
 				}
 			}
-			mi.SongsMu.Lock()
-			mi.Songs, mi.Albums, mi.Artists, mi.AlbumIdByName = index.Songs, index.Albums, index.Artists, albumIdByName
-			mi.SongsMu.Unlock()
+			mi.setIndex(index.Songs, index.Albums, index.Artists, albumIdByName)
 			log.Printf("loaded %d songs from index", len(mi.Songs))
 		} else {
 			log.Printf("no existing index file found: %v", err)
@@ -311,7 +421,8 @@ func (mi *MusicIndex) Scan(folder string) {
 	}
 	// scan the music directory for music
 	log.Println("starting file scan")
-	songs, err := scanFolder([]Song{}, folder, folder, ffprobePath)
+	var playlistFiles []string
+	songs, err := scanFolder([]Song{}, &playlistFiles, folder, folder, ffprobePath)
 	if err != nil {
 		log.Printf("failed to scan: %v", err)
 		return
@@ -327,8 +438,16 @@ func (mi *MusicIndex) Scan(folder string) {
 			}
 			for idx := range songs {
 				if songIdx, exists := songPaths[songs[idx].Path]; exists {
+					lyricsPath := songs[idx].LyricsPath
 					songs[idx] = index.Songs[songIdx]
+					if songs[idx].LyricsPath != lyricsPath {
+						// probe again to pick up the embedded lyrics if the .lrc file was removed
+						songs[idx].LyricsPath = lyricsPath
+						songs[idx].ProcessedFFProbe = false
+					}
 					numMatchedSongs++
+				} else {
+					songs[idx].AddedAt = time.Now()
 				}
 			}
 		}
@@ -341,7 +460,7 @@ func (mi *MusicIndex) Scan(folder string) {
 		var wg sync.WaitGroup
 		wg.Add(numCpu)
 		workChan := make(chan int)
-		var progress int64
+		var progress, numSeededRatings int64
 		for i := 0; i < numCpu; i++ {
 			go func() {
 				defer wg.Done()
@@ -351,10 +470,23 @@ func (mi *MusicIndex) Scan(folder string) {
 						log.Printf("%d/%d (%d%%)", prog, len(songs), (int)(prog*100)/len(songs))
 					}
 					song := &songs[idx]
-					if song.ProcessedFFProbe {
-						continue
+					if len(song.LyricsPath) > 0 {
+						lyrics, err := os.ReadFile(path.Join(folder, song.LyricsPath))
+						if err != nil {
+							log.Printf("failed to read lyrics %s: %v", song.LyricsPath, err)
+						} else {
+							song.Lyrics = string(lyrics)
+						}
 					}
 					fullPath := path.Join(folder, song.Path)
+					if song.AddedAt.IsZero() {
+						if info, err := os.Stat(fullPath); err == nil {
+							song.AddedAt = info.ModTime()
+						}
+					}
+					if song.ProcessedFFProbe && song.FFProbeVersion >= ffprobeVersion {
+						continue
+					}
 					ffmpegJson, err := exec.Command(ffprobePath, "-v", "quiet", "-show_format", "-print_format", "json", fullPath).Output()
 					if err != nil {
 						log.Printf("failed to ffprobe %s: '%s' %v", fullPath, string(ffmpegJson), err)
@@ -368,13 +500,28 @@ func (mi *MusicIndex) Scan(folder string) {
 					result.Format.Duration, _, _ = strings.Cut(result.Format.Duration, ".")
 					duration, _ := strconv.ParseInt(result.Format.Duration, 10, 32)
 					song.DurationSecs = int(duration)
-					year, _ := strconv.ParseInt(result.Format.Tags.Date, 10, 32)
+					yearStr := result.Format.Tags.Date
+					if len(yearStr) > 4 {
+						yearStr = yearStr[:4]
+					}
+					year, _ := strconv.ParseInt(yearStr, 10, 32)
 					song.Year = int(year)
+					song.Genre = result.Format.Tags.Genre
+					// read the USLT or ©lyr lyrics and POPM or rate ratings, which ffprobe doesn't show us
+					if m, err := readTags(fullPath); err == nil {
+						if len(song.LyricsPath) == 0 {
+							song.Lyrics = strings.TrimSpace(m.Lyrics())
+						}
+						if mi.seedSongRating(song.Path, tagStars(m)) {
+							atomic.AddInt64(&numSeededRatings, 1)
+						}
+					}
 					trackStr, numTrackStr, _ := strings.Cut(result.Format.Tags.Track, "/")
 					track, _ := strconv.ParseInt(trackStr, 10, 32)
 					numTracks, _ := strconv.ParseInt(numTrackStr, 10, 32)
 					song.TrackNum, song.TrackTotal = int(track), int(numTracks)
 					song.ProcessedFFProbe = true
+					song.FFProbeVersion = ffprobeVersion
 				}
 			}()
 		}
@@ -384,6 +531,14 @@ func (mi *MusicIndex) Scan(folder string) {
 		close(workChan)
 		wg.Wait()
 		log.Println("completed metadata lookup")
+		if numSeededRatings > 0 {
+			log.Printf("read %d ratings from tags", numSeededRatings)
+			mi.ratingsMu.Lock()
+			if err := saveRatings(folder, mi.ratings); err != nil {
+				log.Printf("failed to save ratings: %v", err)
+			}
+			mi.ratingsMu.Unlock()
+		}
 	}
 	// sort the songs and form the album and artist list from the scanned directory
 	var artists []Artist
@@ -441,7 +596,42 @@ func (mi *MusicIndex) Scan(folder string) {
 				albumStartIdx = albumIdx
 			}
 		}
-		log.Printf("found %d artists %d albums %d album art", len(artists), len(albums), numAlbumArt)
+		if len(currentAlbum) > 0 {
+			albums = append(albums, Album{
+				StartSongIdx: songStartIdx, EndSongIdx: len(songs),
+				Name: currentAlbum, Artist: currentArtist,
+				AlbumArtPath: albumArtPath,
+			})
+			albumIdx++
+		}
+		if len(currentArtist) > 0 {
+			artists = append(artists, Artist{
+				Name: currentArtist, StartAlbumIdx: albumStartIdx, EndAlbumIdx: albumIdx,
+			})
+		}
+		numArtistImages := 0
+		for idx := range artists {
+			artist := &artists[idx]
+			if artist.StartAlbumIdx == artist.EndAlbumIdx {
+				continue
+			}
+			artist.FolderPath = artistFolder(songs[albums[artist.StartAlbumIdx].StartSongIdx].Path)
+			if imagePath := path.Join(artist.FolderPath, artistImageName); len(artist.FolderPath) > 0 {
+				if _, err := os.Stat(path.Join(folder, imagePath)); err == nil {
+					artist.ImagePath = imagePath
+					numArtistImages++
+				}
+			}
+		}
+		log.Printf("found %d artists %d albums %d album art %d artist images", len(artists), len(albums), numAlbumArt, numArtistImages)
+		for idx := range albums {
+			album := &albums[idx]
+			for _, song := range songs[album.StartSongIdx:album.EndSongIdx] {
+				if album.AddedAt.IsZero() || (!song.AddedAt.IsZero() && song.AddedAt.Before(album.AddedAt)) {
+					album.AddedAt = song.AddedAt
+				}
+			}
+		}
 
 		albumIdByName = make(map[string]int, len(albums))
 		for idx, album := range albums {
@@ -458,64 +648,29 @@ func (mi *MusicIndex) Scan(folder string) {
 		for idx, album := range albums {
 			if albumIdx, exists := albumPairs[album.Artist+":"+album.Name]; exists {
 				albums[idx] = index.Albums[albumIdx]
+				albums[idx].StartSongIdx, albums[idx].EndSongIdx = album.StartSongIdx, album.EndSongIdx
+				if albums[idx].AddedAt.IsZero() {
+					albums[idx].AddedAt = album.AddedAt
+				}
 				numMatchedAlbums++
 			}
 		}
 		log.Printf("matched %d albums", numMatchedAlbums)
 	}
 	// share the results so far with the server
-	mi.SongsMu.Lock()
-	mi.Songs, mi.Albums, mi.Artists, mi.AlbumIdByName = songs, albums, artists, albumIdByName
-	mi.SongsMu.Unlock()
+	mi.setIndex(songs, albums, artists, albumIdByName)
+	// import playlists found in the library
+	mi.importPlaylists(playlistFiles)
 	// lookup any missing album art
-	for idx := range albums {
-		album := &albums[idx]
-		if err := lookupAlbumArt(album, songs, folder); err != nil {
-			log.Printf("failed to lookup %s %s: %v", album.Artist, album.Name, err)
-		}
-		album.ProcessedAlbumArt = true
+	mi.lookupMissingAlbumArt()
+	// lookup artist images and biographies
+	if mi.ArtistInfoProvider != nil {
+		mi.lookupArtistInfo(artists)
 	}
 	// write index to disk
-	if err := saveIndex(folder, &musicIndexData{Artists: artists, Songs: songs, Albums: albums}); err != nil {
+	if err := mi.save(); err != nil {
 		log.Printf("failed to save index to disk: %v", err)
 	} else {
 		log.Println("saved index to disk")
 	}
 }
-
-type SearchResult struct {
-	SongId, AlbumId, ArtistId int
-}
-
-const MaxSearchResults = 300
-
-func (i *MusicIndex) Search(s string) []SearchResult {
-	pattern := search.New(language.English, search.IgnoreCase).CompileString(s)
-
-	results := make([]SearchResult, 0)
-	for idx, artist := range i.Artists {
-		if i, _ := pattern.IndexString(artist.Name); i != -1 {
-			results = append(results, SearchResult{ArtistId: idx, SongId: -1, AlbumId: -1})
-			if len(results) > MaxSearchResults {
-				break
-			}
-		}
-	}
-	for idx, album := range i.Albums {
-		if i, _ := pattern.IndexString(album.Name); i != -1 {
-			results = append(results, SearchResult{AlbumId: idx, SongId: -1, ArtistId: -1})
-			if len(results) > MaxSearchResults {
-				break
-			}
-		}
-	}
-	for idx, song := range i.Songs {
-		if i, _ := pattern.IndexString(song.Title); i != -1 {
-			results = append(results, SearchResult{SongId: idx, AlbumId: -1, ArtistId: -1})
-			if len(results) > MaxSearchResults {
-				break
-			}
-		}
-	}
-	return results
-}
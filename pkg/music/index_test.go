@@ -0,0 +1,35 @@
+package music
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecentlyAdded(t *testing.T) {
+	var mi MusicIndex
+	mi.Open(t.TempDir())
+	day := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+	mi.setIndex(nil, []Album{
+		{Name: "Old", AddedAt: day.AddDate(-1, 0, 0)},
+		{Name: "Newest", AddedAt: day},
+		// albums from before songs had an added time sort last
+		{Name: "Unknown"},
+		{Name: "Middle", AddedAt: day.AddDate(0, -1, 0)},
+		{Name: "Also middle", AddedAt: day.AddDate(0, -1, 0)},
+	}, nil, map[string]int{})
+	tests := []struct {
+		limit        int
+		wantAlbumIds []int
+	}{
+		{0, []int{1, 3, 4, 0, 2}},
+		{2, []int{1, 3}},
+		{3, []int{1, 3, 4}},
+		{10, []int{1, 3, 4, 0, 2}},
+	}
+	for _, test := range tests {
+		if albumIds := mi.RecentlyAdded(test.limit); !reflect.DeepEqual(albumIds, test.wantAlbumIds) {
+			t.Errorf("limit %d: got albums %v, want %v", test.limit, albumIds, test.wantAlbumIds)
+		}
+	}
+}
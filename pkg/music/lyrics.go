@@ -0,0 +1,127 @@
+package music
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LyricLine is a line of lyrics. Time is the offset into the song in seconds for synced lyrics.
+type LyricLine struct {
+	Time float64
+	Text string
+}
+
+// Lyrics are the lyrics of a song, which are synced if they came from an LRC file or embedded LRC text.
+type Lyrics struct {
+	SongId int
+	Source string
+	Synced bool
+	Lines  []LyricLine
+}
+
+var (
+	lrcTimestamp     = regexp.MustCompile(`^\[(\d+):(\d+(?:[.:]\d+)?)\]`)
+	lrcTag           = regexp.MustCompile(`^\[([a-zA-Z]+):([^\]]*)\]\s*$`)
+	lrcWordTimestamp = regexp.MustCompile(`<\d+:\d+(?:[.:]\d+)?>`)
+)
+
+// lyricsSidecar returns the path of the .lrc file with the same name as a song if there is one.
+func lyricsSidecar(songPath string, lrcFiles map[string]string) string {
+	return lrcFiles[strings.TrimSuffix(songPath, path.Ext(songPath))]
+}
+
+func parseLrcTime(mins, secs string) float64 {
+	m, _ := strconv.Atoi(mins)
+	// some files use [mm:ss:xx] rather than [mm:ss.xx]
+	s, _ := strconv.ParseFloat(strings.Replace(secs, ":", ".", 1), 64)
+	return float64(m)*60 + s
+}
+
+// ParseLyrics parses plain text or LRC lyrics, returning true if they are synced. LRC lines may have
+// several timestamps, such as a repeated chorus, and enhanced LRC word timestamps are dropped.
+func ParseLyrics(text string) ([]LyricLine, bool) {
+	var plainLines, syncedLines []LyricLine
+	var offset float64
+	text = strings.TrimPrefix(text, "\ufeff")
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if m := lrcTag.FindStringSubmatch(line); m != nil {
+			if strings.ToLower(m[1]) == "offset" {
+				// a positive offset in milliseconds shows the lyrics sooner
+				ms, _ := strconv.Atoi(strings.TrimSpace(m[2]))
+				offset = float64(ms) / 1000
+			}
+			continue
+		}
+		var times []float64
+		for {
+			m := lrcTimestamp.FindStringSubmatch(line)
+			if m == nil {
+				break
+			}
+			times = append(times, parseLrcTime(m[1], m[2]))
+			line = line[len(m[0]):]
+		}
+		line = strings.TrimSpace(lrcWordTimestamp.ReplaceAllString(line, ""))
+		if len(times) == 0 {
+			if len(line) > 0 || len(plainLines) > 0 {
+				plainLines = append(plainLines, LyricLine{Text: line})
+			}
+			continue
+		}
+		for _, t := range times {
+			if t -= offset; t < 0 {
+				t = 0
+			}
+			syncedLines = append(syncedLines, LyricLine{Time: t, Text: line})
+		}
+	}
+	if len(syncedLines) > 0 {
+		sort.SliceStable(syncedLines, func(i, j int) bool { return syncedLines[i].Time < syncedLines[j].Time })
+		return syncedLines, true
+	}
+	for len(plainLines) > 0 && len(plainLines[len(plainLines)-1].Text) == 0 {
+		plainLines = plainLines[:len(plainLines)-1]
+	}
+	return plainLines, false
+}
+
+// lyricsText returns the words of the lyrics without any LRC timestamps or tags, for the search index.
+func lyricsText(text string) string {
+	if len(text) == 0 {
+		return ""
+	}
+	lines, _ := ParseLyrics(text)
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line.Text)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Lyrics returns the lyrics of a song.
+func (mi *MusicIndex) Lyrics(songId int) (*Lyrics, error) {
+	mi.SongsMu.Lock()
+	if songId < 0 || songId >= len(mi.Songs) {
+		mi.SongsMu.Unlock()
+		return nil, ErrNotFound
+	}
+	song := mi.Songs[songId]
+	mi.SongsMu.Unlock()
+	if len(song.Lyrics) == 0 {
+		return nil, ErrNotFound
+	}
+	lines, synced := ParseLyrics(song.Lyrics)
+	if lines == nil {
+		lines = []LyricLine{}
+	}
+	source := "embedded"
+	if len(song.LyricsPath) > 0 {
+		source = "sidecar"
+	}
+	return &Lyrics{SongId: songId, Source: source, Synced: synced, Lines: lines}, nil
+}
@@ -0,0 +1,54 @@
+package music
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLyrics(t *testing.T) {
+	tests := []struct {
+		name       string
+		text       string
+		wantLines  []LyricLine
+		wantSynced bool
+	}{
+		{"synced", "[ti:Airbag]\n[00:01.50]In the next world war\n[00:04.25]In a jackknifed juggernaut", []LyricLine{
+			{1.5, "In the next world war"},
+			{4.25, "In a jackknifed juggernaut"},
+		}, true},
+		{"colon hundredths", "[00:01:50]One", []LyricLine{{1.5, "One"}}, true},
+		{"minutes", "[02:03.25]Later", []LyricLine{{123.25, "Later"}}, true},
+		// a positive offset shows the lyrics sooner, but never before the start
+		{"offset", "[offset:+500]\n[00:00.25]First\n[00:02.75]Second", []LyricLine{{0, "First"}, {2.25, "Second"}}, true},
+		{"negative offset", "[offset:-1000]\n[00:02.50]Late", []LyricLine{{3.5, "Late"}}, true},
+		{"several timestamps", "[00:10.00][00:30.50]Chorus\n[00:20.00]Verse", []LyricLine{
+			{10, "Chorus"},
+			{20, "Verse"},
+			{30.5, "Chorus"},
+		}, true},
+		{"word timestamps", "[00:01.00]<00:01.00>Word <00:01.50>by <00:02.00>word", []LyricLine{{1, "Word by word"}}, true},
+		{"unsorted", "[00:05.00]Second\n[00:01.00]First\n[00:05.00]Also second", []LyricLine{
+			{1, "First"},
+			{5, "Second"},
+			{5, "Also second"},
+		}, true},
+		{"windows line endings", "\ufeff[00:01.00]One\r\n[00:02.00]Two\r\n", []LyricLine{{1, "One"}, {2, "Two"}}, true},
+		// plain lyrics keep their blank lines between verses, but not around them
+		{"plain", "\nFirst verse\n\nSecond verse\n\n", []LyricLine{
+			{0, "First verse"},
+			{0, ""},
+			{0, "Second verse"},
+		}, false},
+		{"plain with tags", "[ar:Radiohead]\nJust words", []LyricLine{{0, "Just words"}}, false},
+		{"empty", "", nil, false},
+	}
+	for _, test := range tests {
+		lines, synced := ParseLyrics(test.text)
+		if synced != test.wantSynced {
+			t.Errorf("%s: got synced %v, want %v", test.name, synced, test.wantSynced)
+		}
+		if !reflect.DeepEqual(lines, test.wantLines) {
+			t.Errorf("%s: got lines %+v, want %+v", test.name, lines, test.wantLines)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package music
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrBadPlaylist is returned when creating or updating a playlist with bad details.
+var ErrBadPlaylist = errors.New("bad playlist")
+
+func IsPlaylistFile(ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".m3u", ".m3u8", ".pls":
+		return true
+	default:
+		return false
+	}
+}
+
+// Playlist is a list of songs, stored by path so it survives rescans of the library.
+type Playlist struct {
+	ID        int
+	Name      string
+	SongPaths []string
+	// Smart playlists have rules picking their songs rather than a list of songs
+	Smart *SmartRules `json:",omitempty"`
+	// Source is the playlist file in the library this was imported from, if any
+	Source   string    `json:",omitempty"`
+	Imported time.Time `json:"-"`
+	Updated  time.Time
+}
+
+// PlaylistInfo summarises a playlist for listing.
+type PlaylistInfo struct {
+	ID       int
+	Name     string
+	Source   string `json:",omitempty"`
+	Smart    bool
+	NumSongs int
+	Updated  time.Time
+}
+
+type playlistData struct {
+	NextID    int
+	Playlists []Playlist
+	// DeletedSources are imported playlists that were deleted, so we don't import them again
+	DeletedSources map[string]bool
+}
+
+func loadPlaylists(folder string) (*playlistData, error) {
+	f, err := os.Open(path.Join(folder, "playlists.dat"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var data playlistData
+	if err := gob.NewDecoder(f).Decode(&data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+func savePlaylists(folder string, data *playlistData) error {
+	f, err := os.Create(path.Join(folder, "playlists.dat"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return gob.NewEncoder(f).Encode(data)
+}
+
+// readPlaylistFile reads the entries of an m3u, m3u8 or pls file.
+func readPlaylistFile(fullPath string) ([]string, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	isPls := strings.ToLower(path.Ext(fullPath)) == ".pls"
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !utf8.ValidString(line) {
+			// plain .m3u files are usually latin-1
+			runes := make([]rune, len(line))
+			for i := 0; i < len(line); i++ {
+				runes[i] = rune(line[i])
+			}
+			line = string(runes)
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "\ufeff"))
+		if isPls {
+			key, value, ok := strings.Cut(line, "=")
+			if ok && strings.HasPrefix(strings.ToLower(key), "file") {
+				entries = append(entries, strings.TrimSpace(value))
+			}
+		} else if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// pathSuffix returns the lowercased <Artist>/<Album>/<Track> end of a path.
+func pathSuffix(p string) string {
+	bits := strings.Split(strings.ToLower(p), "/")
+	if len(bits) > 3 {
+		bits = bits[len(bits)-3:]
+	}
+	return strings.Join(bits, "/")
+}
+
+// resolvePlaylistEntry finds the song a playlist entry refers to. Entries can be relative to the
+// playlist, absolute paths inside the library or absolute paths from another machine, in which case
+// we match the <Artist>/<Album>/<Track> end of the path. Callers must hold SongsMu.
+func (mi *MusicIndex) resolvePlaylistEntry(playlistDir, entry string, songIdBySuffix map[string]int) (int, bool) {
+	if strings.Contains(entry, "://") && !strings.HasPrefix(entry, "file://") {
+		return 0, false
+	}
+	entry = strings.ReplaceAll(strings.TrimPrefix(entry, "file://"), "\\", "/")
+	isAbs := strings.HasPrefix(entry, "/") || (len(entry) > 2 && entry[1] == ':')
+	if !isAbs {
+		if songId, ok := mi.songIdByPath[path.Join(playlistDir, entry)]; ok {
+			return songId, true
+		}
+	}
+	folder := strings.ReplaceAll(mi.folder, "\\", "/")
+	if songId, ok := mi.songIdByPath[path.Clean("/"+strings.TrimPrefix(entry, folder))]; ok {
+		return songId, true
+	}
+	songId, ok := songIdBySuffix[pathSuffix(entry)]
+	return songId, ok
+}
+
+// importPlaylists imports the playlist files found in the library, updating those that changed since they were imported.
+func (mi *MusicIndex) importPlaylists(playlistFiles []string) {
+	mi.playlistsMu.Lock()
+	defer mi.playlistsMu.Unlock()
+	numImported := 0
+	var songIdBySuffix map[string]int
+	for _, playlistFile := range playlistFiles {
+		if mi.playlists.DeletedSources[playlistFile] {
+			continue
+		}
+		info, err := os.Stat(path.Join(mi.folder, playlistFile))
+		if err != nil {
+			log.Printf("failed to import playlist %s: %v", playlistFile, err)
+			continue
+		}
+		var playlist *Playlist
+		for idx := range mi.playlists.Playlists {
+			if mi.playlists.Playlists[idx].Source == playlistFile {
+				playlist = &mi.playlists.Playlists[idx]
+				break
+			}
+		}
+		if playlist != nil && playlist.Imported.Equal(info.ModTime()) {
+			continue
+		}
+		entries, err := readPlaylistFile(path.Join(mi.folder, playlistFile))
+		if err != nil {
+			log.Printf("failed to import playlist %s: %v", playlistFile, err)
+			continue
+		}
+		songPaths := make([]string, 0, len(entries))
+		mi.SongsMu.Lock()
+		if songIdBySuffix == nil {
+			songIdBySuffix = make(map[string]int, len(mi.Songs))
+			for idx := range mi.Songs {
+				songIdBySuffix[pathSuffix(mi.Songs[idx].Path)] = idx
+			}
+		}
+		for _, entry := range entries {
+			if songId, ok := mi.resolvePlaylistEntry(path.Dir(playlistFile), entry, songIdBySuffix); ok {
+				songPaths = append(songPaths, mi.Songs[songId].Path)
+			}
+		}
+		mi.SongsMu.Unlock()
+		if len(songPaths) < len(entries) {
+			log.Printf("playlist %s: could not find %d of %d songs", playlistFile, len(entries)-len(songPaths), len(entries))
+		}
+		if playlist == nil {
+			name := path.Base(playlistFile)
+			mi.playlists.Playlists = append(mi.playlists.Playlists, Playlist{
+				ID: mi.playlists.NextID, Name: strings.TrimSuffix(name, path.Ext(name)), Source: playlistFile,
+			})
+			mi.playlists.NextID++
+			playlist = &mi.playlists.Playlists[len(mi.playlists.Playlists)-1]
+		}
+		playlist.SongPaths = songPaths
+		playlist.Imported = info.ModTime()
+		playlist.Updated = time.Now()
+		numImported++
+	}
+	log.Printf("imported %d playlists", numImported)
+	if numImported > 0 {
+		if err := savePlaylists(mi.folder, mi.playlists); err != nil {
+			log.Printf("failed to save playlists: %v", err)
+		}
+	}
+}
+
+func (mi *MusicIndex) findPlaylist(id int) (*Playlist, error) {
+	if mi.playlists == nil {
+		return nil, ErrNotFound
+	}
+	for idx := range mi.playlists.Playlists {
+		if mi.playlists.Playlists[idx].ID == id {
+			return &mi.playlists.Playlists[idx], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// songPaths converts song ids to paths.
+func (mi *MusicIndex) songPaths(songIds []int) ([]string, error) {
+	mi.SongsMu.Lock()
+	defer mi.SongsMu.Unlock()
+	songPaths := make([]string, len(songIds))
+	for idx, songId := range songIds {
+		if songId < 0 || songId >= len(mi.Songs) {
+			return nil, fmt.Errorf("%w: no song %d", ErrBadPlaylist, songId)
+		}
+		songPaths[idx] = mi.Songs[songId].Path
+	}
+	return songPaths, nil
+}
+
+// Playlists lists every playlist sorted by name.
+func (mi *MusicIndex) Playlists() []PlaylistInfo {
+	mi.playlistsMu.Lock()
+	defer mi.playlistsMu.Unlock()
+	infos := make([]PlaylistInfo, 0)
+	if mi.playlists == nil {
+		return infos
+	}
+	mi.SongsMu.Lock()
+	for idx := range mi.playlists.Playlists {
+		playlist := &mi.playlists.Playlists[idx]
+		numSongs := len(playlist.SongPaths)
+		if playlist.Smart != nil {
+			numSongs = len(mi.smartPlaylistSongIds(playlist))
+		}
+		infos = append(infos, PlaylistInfo{
+			ID: playlist.ID, Name: playlist.Name, Source: playlist.Source,
+			Smart: playlist.Smart != nil, NumSongs: numSongs, Updated: playlist.Updated,
+		})
+	}
+	mi.SongsMu.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return strings.ToLower(infos[i].Name) < strings.ToLower(infos[j].Name)
+	})
+	return infos
+}
+
+// playlistCopy returns a copy of a playlist that is safe to use without holding playlistsMu.
+func (mi *MusicIndex) playlistCopy(id int) (*Playlist, error) {
+	mi.playlistsMu.Lock()
+	defer mi.playlistsMu.Unlock()
+	playlist, err := mi.findPlaylist(id)
+	if err != nil {
+		return nil, err
+	}
+	p := *playlist
+	p.SongPaths = append([]string{}, playlist.SongPaths...)
+	if playlist.Smart != nil {
+		rules := *playlist.Smart
+		p.Smart = &rules
+	}
+	return &p, nil
+}
+
+// playlistSongIds returns the ids of the songs in a playlist that are still in the library.
+// Callers must hold SongsMu.
+func (mi *MusicIndex) playlistSongIds(playlist *Playlist) []int {
+	if playlist.Smart != nil {
+		return mi.smartPlaylistSongIds(playlist)
+	}
+	songIds := make([]int, 0, len(playlist.SongPaths))
+	for _, songPath := range playlist.SongPaths {
+		if songId, ok := mi.songIdByPath[songPath]; ok {
+			songIds = append(songIds, songId)
+		}
+	}
+	return songIds
+}
+
+// Playlist returns a playlist along with the ids of its songs that are still in the library.
+func (mi *MusicIndex) Playlist(id int) (*Playlist, []int, error) {
+	playlist, err := mi.playlistCopy(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	mi.SongsMu.Lock()
+	defer mi.SongsMu.Unlock()
+	return playlist, mi.playlistSongIds(playlist), nil
+}
+
+// CreatePlaylist creates a new playlist of songs, or a smart playlist if smart isn't nil.
+func (mi *MusicIndex) CreatePlaylist(name string, songIds []int, smart *SmartRules) (*Playlist, error) {
+	if len(strings.TrimSpace(name)) == 0 {
+		return nil, fmt.Errorf("%w: missing name", ErrBadPlaylist)
+	}
+	if smart != nil {
+		if len(songIds) > 0 {
+			return nil, fmt.Errorf("%w: smart playlists can't have songs", ErrBadPlaylist)
+		}
+		if err := validateSmartRules(smart); err != nil {
+			return nil, err
+		}
+	}
+	songPaths, err := mi.songPaths(songIds)
+	if err != nil {
+		return nil, err
+	}
+	mi.playlistsMu.Lock()
+	defer mi.playlistsMu.Unlock()
+	if mi.playlists == nil {
+		return nil, errors.New("index not loaded yet")
+	}
+	playlist := Playlist{ID: mi.playlists.NextID, Name: name, SongPaths: songPaths, Smart: smart, Updated: time.Now()}
+	mi.playlists.NextID++
+	mi.playlists.Playlists = append(mi.playlists.Playlists, playlist)
+	return &playlist, savePlaylists(mi.folder, mi.playlists)
+}
+
+// UpdatePlaylist renames a playlist if name isn't empty, replaces its songs if songIds isn't nil and
+// replaces the rules of a smart playlist if smart isn't nil.
+func (mi *MusicIndex) UpdatePlaylist(id int, name string, songIds []int, smart *SmartRules) (*Playlist, error) {
+	if smart != nil {
+		if err := validateSmartRules(smart); err != nil {
+			return nil, err
+		}
+	}
+	var songPaths []string
+	if songIds != nil {
+		var err error
+		if songPaths, err = mi.songPaths(songIds); err != nil {
+			return nil, err
+		}
+	}
+	mi.playlistsMu.Lock()
+	defer mi.playlistsMu.Unlock()
+	playlist, err := mi.findPlaylist(id)
+	if err != nil {
+		return nil, err
+	}
+	if (songPaths != nil && playlist.Smart != nil) || (smart != nil && playlist.Smart == nil) {
+		return nil, fmt.Errorf("%w: can't change between smart and regular playlists", ErrBadPlaylist)
+	}
+	if len(strings.TrimSpace(name)) > 0 {
+		playlist.Name = name
+	}
+	if songPaths != nil {
+		playlist.SongPaths = songPaths
+	}
+	if smart != nil {
+		playlist.Smart = smart
+	}
+	playlist.Updated = time.Now()
+	p := *playlist
+	return &p, savePlaylists(mi.folder, mi.playlists)
+}
+
+// DeletePlaylist deletes a playlist. Deleted playlists imported from the library aren't imported again.
+func (mi *MusicIndex) DeletePlaylist(id int) error {
+	mi.playlistsMu.Lock()
+	defer mi.playlistsMu.Unlock()
+	playlist, err := mi.findPlaylist(id)
+	if err != nil {
+		return err
+	}
+	if len(playlist.Source) > 0 {
+		if mi.playlists.DeletedSources == nil {
+			mi.playlists.DeletedSources = make(map[string]bool)
+		}
+		mi.playlists.DeletedSources[playlist.Source] = true
+	}
+	for idx := range mi.playlists.Playlists {
+		if mi.playlists.Playlists[idx].ID == id {
+			mi.playlists.Playlists = append(mi.playlists.Playlists[:idx], mi.playlists.Playlists[idx+1:]...)
+			break
+		}
+	}
+	return savePlaylists(mi.folder, mi.playlists)
+}
+
+// ExportPlaylist writes a playlist as an M3U8 file with paths relative to the music folder.
+func (mi *MusicIndex) ExportPlaylist(id int, w io.Writer) error {
+	playlist, err := mi.playlistCopy(id)
+	if err != nil {
+		return err
+	}
+	mi.SongsMu.Lock()
+	defer mi.SongsMu.Unlock()
+	b := bufio.NewWriter(w)
+	b.WriteString("#EXTM3U\n")
+	for _, songId := range mi.playlistSongIds(playlist) {
+		song := &mi.Songs[songId]
+		b.WriteString("#EXTINF:" + strconv.Itoa(song.DurationSecs) + "," + song.Artist + " - " + song.Title + "\n")
+		b.WriteString(strings.TrimPrefix(song.Path, "/") + "\n")
+	}
+	return b.Flush()
+}
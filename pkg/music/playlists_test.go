@@ -0,0 +1,122 @@
+package music
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestReadPlaylistFile(t *testing.T) {
+	tests := []struct {
+		name, contents string
+		wantEntries    []string
+	}{
+		{"Mix.m3u", "#EXTM3U\n#EXTINF:183,Artist - One\nArtist/Album/01 One.mp3\n\n#EXTINF:-1,Radio\nhttp://radio.example.com/stream\n",
+			[]string{"Artist/Album/01 One.mp3", "http://radio.example.com/stream"}},
+		{"Mix.m3u8", "\ufeff#EXTM3U\r\n#EXTINF:183,Björk - Army of Me\r\n../Björk/Post/01 Army of Me.mp3\r\n",
+			[]string{"../Björk/Post/01 Army of Me.mp3"}},
+		// plain m3u files from older players are often latin-1
+		{"Old.m3u", "Bj\xf6rk/Post/01 Army of Me.mp3\nSigur R\xf3s/()/01 Untitled.mp3\n",
+			[]string{"Björk/Post/01 Army of Me.mp3", "Sigur Rós/()/01 Untitled.mp3"}},
+		{"Mix.PLS", "[playlist]\nFile1=/music/Artist/Album/01 One.mp3\nTitle1=One\nLength1=183\nfile2= Artist/Album/02 Two.mp3\nNumberOfEntries=2\nVersion=2\n",
+			[]string{"/music/Artist/Album/01 One.mp3", "Artist/Album/02 Two.mp3"}},
+	}
+	folder := t.TempDir()
+	for _, test := range tests {
+		playlistPath := path.Join(folder, test.name)
+		if err := os.WriteFile(playlistPath, []byte(test.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := readPlaylistFile(playlistPath)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(entries, test.wantEntries) {
+			t.Errorf("%s: got entries %q, want %q", test.name, entries, test.wantEntries)
+		}
+	}
+}
+
+// testPlaylistLibrary makes an index of a few songs, without any files, that playlists can be made of.
+func testPlaylistLibrary(t *testing.T) *MusicIndex {
+	var mi MusicIndex
+	mi.Open(t.TempDir())
+	mi.playlists = &playlistData{}
+	mi.setIndex([]Song{
+		{Path: "/Artist/Album/01 One.mp3", Title: "One", Artist: "Artist", Album: "Album", DurationSecs: 183},
+		{Path: "/Artist/Album/02 Two.mp3", Title: "Two", Artist: "Artist", Album: "Album", DurationSecs: 200},
+		{Path: "/Björk/Post/01 Army of Me.mp3", Title: "Army of Me", Artist: "Björk", Album: "Post", DurationSecs: 234},
+	}, nil, nil, map[string]int{})
+	return &mi
+}
+
+func TestResolvePlaylistEntry(t *testing.T) {
+	mi := testPlaylistLibrary(t)
+	tests := []struct {
+		name, playlistDir, entry string
+		wantSongId               int
+		wantOk                   bool
+	}{
+		{"relative", "/", "Artist/Album/02 Two.mp3", 1, true},
+		{"relative to a folder", "/Playlists", "../Björk/Post/01 Army of Me.mp3", 2, true},
+		{"absolute in the library", "/Playlists", mi.folder + "/Artist/Album/01 One.mp3", 0, true},
+		{"absolute from the library folder", "/Playlists", "/Artist/Album/02 Two.mp3", 1, true},
+		{"file url", "/Playlists", "file://" + mi.folder + "/Artist/Album/01 One.mp3", 0, true},
+		// paths from another machine are matched by their <Artist>/<Album>/<Track> end
+		{"another machine", "/Playlists", "/mnt/nas/music/artist/album/02 two.mp3", 1, true},
+		{"windows", "/Playlists", `C:\Users\me\Music\Björk\Post\01 Army of Me.mp3`, 2, true},
+		{"missing", "/Playlists", "/mnt/nas/music/Artist/Album/03 Three.mp3", 0, false},
+		{"stream", "/Playlists", "http://radio.example.com/Artist/Album/01 One.mp3", 0, false},
+	}
+	mi.SongsMu.Lock()
+	defer mi.SongsMu.Unlock()
+	songIdBySuffix := make(map[string]int, len(mi.Songs))
+	for idx := range mi.Songs {
+		songIdBySuffix[pathSuffix(mi.Songs[idx].Path)] = idx
+	}
+	for _, test := range tests {
+		songId, ok := mi.resolvePlaylistEntry(test.playlistDir, test.entry, songIdBySuffix)
+		if ok != test.wantOk || (ok && songId != test.wantSongId) {
+			t.Errorf("%s: %q got song %d %v, want %d %v", test.name, test.entry, songId, ok, test.wantSongId, test.wantOk)
+		}
+	}
+}
+
+func TestExportPlaylistRoundTrip(t *testing.T) {
+	mi := testPlaylistLibrary(t)
+	playlist, err := mi.CreatePlaylist("Mix", []int{2, 0, 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported bytes.Buffer
+	if err := mi.ExportPlaylist(playlist.ID, &exported); err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n" +
+		"#EXTINF:234,Björk - Army of Me\nBjörk/Post/01 Army of Me.mp3\n" +
+		"#EXTINF:183,Artist - One\nArtist/Album/01 One.mp3\n" +
+		"#EXTINF:200,Artist - Two\nArtist/Album/02 Two.mp3\n"
+	if exported.String() != want {
+		t.Errorf("got export\n%s\nwant\n%s", exported.String(), want)
+	}
+
+	if err := os.WriteFile(path.Join(mi.folder, "Exported.m3u8"), exported.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mi.importPlaylists([]string{"/Exported.m3u8"})
+	var imported *Playlist
+	for _, info := range mi.Playlists() {
+		if info.Source == "/Exported.m3u8" {
+			if imported, _, err = mi.Playlist(info.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if imported == nil {
+		t.Fatalf("export wasn't imported, got playlists %+v", mi.Playlists())
+	}
+	if imported.Name != "Exported" || !reflect.DeepEqual(imported.SongPaths, playlist.SongPaths) {
+		t.Errorf("got imported playlist %q of %q, want Exported of %q", imported.Name, imported.SongPaths, playlist.SongPaths)
+	}
+}
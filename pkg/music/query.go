@@ -0,0 +1,346 @@
+package music
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// QueryError is returned by ParseQuery when a search query has bad syntax.
+type QueryError struct {
+	Pos     int
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Pos)
+}
+
+const (
+	queryFieldAny    = ""
+	queryFieldArtist = "artist"
+	queryFieldAlbum  = "album"
+	queryFieldTitle  = "title"
+	queryFieldGenre  = "genre"
+	queryFieldYear   = "year"
+	queryFieldLyrics = "lyrics"
+	// number fields, which match a number or range of numbers
+	queryFieldDuration = "duration"
+	queryFieldAdded    = "added"
+	queryFieldPlays    = "plays"
+	queryFieldPlayed   = "played"
+	// star ratings of songs and albums, and 1 for favourites or 0 otherwise
+	queryFieldRating    = "rating"
+	queryFieldFavourite = "favourite"
+)
+
+var queryFields = map[string]string{
+	"artist": queryFieldArtist,
+	"album":  queryFieldAlbum,
+	"title":  queryFieldTitle,
+	"song":   queryFieldTitle,
+	"genre":  queryFieldGenre,
+	"year":   queryFieldYear,
+	"lyrics": queryFieldLyrics,
+	// duration in seconds
+	"duration": queryFieldDuration,
+	// days since the song was added to the library
+	"added": queryFieldAdded,
+	"plays": queryFieldPlays,
+	// days since the song was last played
+	"played":    queryFieldPlayed,
+	"rating":    queryFieldRating,
+	"favourite": queryFieldFavourite,
+	"favorite":  queryFieldFavourite,
+}
+
+// indexedFields are the fields in the search index, so their words can be looked up in it.
+var indexedFields = map[string]bool{
+	queryFieldAny: true, queryFieldArtist: true, queryFieldAlbum: true, queryFieldTitle: true, queryFieldLyrics: true,
+}
+
+// songFields are the fields only songs have.
+var songFields = map[string]bool{
+	queryFieldTitle: true, queryFieldGenre: true, queryFieldYear: true, queryFieldLyrics: true,
+	queryFieldDuration: true, queryFieldAdded: true, queryFieldPlays: true, queryFieldPlayed: true,
+}
+
+func isNumberField(field string) bool {
+	switch field {
+	case queryFieldYear, queryFieldDuration, queryFieldAdded, queryFieldPlays, queryFieldPlayed, queryFieldRating, queryFieldFavourite:
+		return true
+	default:
+		return false
+	}
+}
+
+// queryTerm is a single word, quoted phrase or field filter in a query.
+type queryTerm struct {
+	field          string
+	negate, phrase bool
+	tokens         []string
+	text           string
+	min, max       int
+}
+
+// Query is a parsed search query such as `artist:radiohead year:1997..2001 -live "karma police"`.
+type Query struct {
+	terms []queryTerm
+	// words are the positive free text words and field filter words, which are looked up in the search
+	// index to find the candidates the terms are checked against
+	words []string
+}
+
+// ParseQuery parses free text words, "quoted phrases", field:value filters, number ranges such as
+// year:from..to and -negated terms. Words that look like filters on fields that don't exist are free text.
+func ParseQuery(s string) (*Query, error) {
+	q := &Query{}
+	runes := []rune(s)
+	pos := 0
+	for {
+		for pos < len(runes) && unicode.IsSpace(runes[pos]) {
+			pos++
+		}
+		if pos >= len(runes) {
+			break
+		}
+		start := pos
+		var term queryTerm
+		if runes[pos] == '-' {
+			term.negate = true
+			pos++
+		}
+		// read a field name if there is one, leaving words like "Live:" in "Live: Tokyo" as free text
+		fieldEnd := pos
+		for fieldEnd < len(runes) && unicode.IsLetter(runes[fieldEnd]) {
+			fieldEnd++
+		}
+		if fieldEnd > pos && fieldEnd < len(runes) && runes[fieldEnd] == ':' {
+			if field, ok := queryFields[strings.ToLower(string(runes[pos:fieldEnd]))]; ok {
+				term.field = field
+				pos = fieldEnd + 1
+			}
+		}
+		// read the value
+		var value string
+		valueStart := pos
+		if pos < len(runes) && runes[pos] == '"' {
+			end := pos + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, &QueryError{Pos: pos, Message: "unterminated quote"}
+			}
+			value = string(runes[pos+1 : end])
+			term.phrase = true
+			pos = end + 1
+		} else {
+			end := pos
+			for end < len(runes) && !unicode.IsSpace(runes[end]) {
+				end++
+			}
+			value = string(runes[pos:end])
+			pos = end
+		}
+		if len(strings.TrimSpace(value)) == 0 {
+			return nil, &QueryError{Pos: start, Message: "missing search term"}
+		}
+		if isNumberField(term.field) {
+			min, max, err := parseRange(value)
+			if err != nil {
+				return nil, &QueryError{Pos: valueStart, Message: err.Error()}
+			}
+			term.min, term.max = min, max
+		} else {
+			term.tokens = tokenize(value)
+			term.text = strings.Join(term.tokens, " ")
+			if len(term.tokens) == 0 {
+				// punctuation on its own can't match anything in the index
+				continue
+			}
+			if !term.phrase && len(term.tokens) > 1 {
+				// a word like "AC/DC" is a phrase of its tokens
+				term.phrase = true
+			}
+		}
+		if !term.negate && !term.phrase && indexedFields[term.field] {
+			q.words = append(q.words, term.tokens...)
+			if term.field == queryFieldAny {
+				continue
+			}
+		}
+		q.terms = append(q.terms, term)
+	}
+	return q, nil
+}
+
+// parseRange parses 1997, 1997..2001, 1997.. and ..2001.
+func parseRange(s string) (int, int, error) {
+	parseNumber := func(s string, defaultNumber int) (int, error) {
+		if len(s) == 0 {
+			return defaultNumber, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad number %q", s)
+		}
+		return n, nil
+	}
+	from, to, isRange := strings.Cut(s, "..")
+	if !isRange {
+		n, err := parseNumber(s, 0)
+		return n, n, err
+	}
+	if len(from) == 0 && len(to) == 0 {
+		return 0, 0, fmt.Errorf("bad range %q", s)
+	}
+	min, err := parseNumber(from, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := parseNumber(to, math.MaxInt32)
+	if err != nil {
+		return 0, 0, err
+	}
+	if min > max {
+		return 0, 0, fmt.Errorf("bad range %q", s)
+	}
+	return min, max, nil
+}
+
+// songOnly returns true if the query filters on fields only songs have.
+func (q *Query) songOnly() bool {
+	for _, term := range q.terms {
+		if !term.negate && songFields[term.field] {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldValue returns the value of a field of an artist, album or song, or false if it doesn't have that field.
+func (i *MusicIndex) fieldValue(doc *searchDoc, field string) (string, bool) {
+	switch doc.kind {
+	case searchDocArtist:
+		if field == queryFieldArtist {
+			return i.Artists[doc.idx].Name, true
+		}
+	case searchDocAlbum:
+		album := &i.Albums[doc.idx]
+		switch field {
+		case queryFieldAlbum:
+			return album.Name, true
+		case queryFieldArtist:
+			return album.Artist, true
+		case queryFieldRating, queryFieldFavourite:
+			return ratingValue(i.AlbumRating(album.Artist, album.Name), field), true
+		}
+	case searchDocSong:
+		song := &i.Songs[doc.idx]
+		switch field {
+		case queryFieldTitle:
+			return song.Title, true
+		case queryFieldArtist:
+			return song.Artist, true
+		case queryFieldAlbum:
+			return song.Album, true
+		case queryFieldGenre:
+			return song.Genre, true
+		case queryFieldYear:
+			return strconv.Itoa(song.Year), true
+		case queryFieldRating, queryFieldFavourite:
+			return ratingValue(i.SongRating(song.Path), field), true
+		case queryFieldDuration:
+			return strconv.Itoa(song.DurationSecs), true
+		case queryFieldAdded:
+			if song.AddedAt.IsZero() {
+				return "", false
+			}
+			return strconv.Itoa(int(time.Since(song.AddedAt) / (24 * time.Hour))), true
+		case queryFieldPlays:
+			return strconv.Itoa(i.songPlayStats(song.Path).Plays), true
+		case queryFieldPlayed:
+			// songs that have never been played have no last played time
+			stats := i.songPlayStats(song.Path)
+			if stats.LastPlayed.IsZero() {
+				return "", false
+			}
+			return strconv.Itoa(int(time.Since(stats.LastPlayed) / (24 * time.Hour))), true
+		}
+	}
+	return "", false
+}
+
+func ratingValue(rating Rating, field string) string {
+	if field == queryFieldFavourite {
+		if rating.Favourite {
+			return "1"
+		}
+		return "0"
+	}
+	return strconv.Itoa(rating.Stars)
+}
+
+// termMatches returns true if the term matches a field, or any field for free text terms. Negated
+// terms are matched exactly or by prefix so "-live" doesn't remove "love".
+func termMatches(term *queryTerm, fields []searchField) bool {
+	if term.phrase {
+		for _, field := range fields {
+			if strings.Contains(strings.Join(field.tokens, " "), term.text) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, queryToken := range term.tokens {
+		found := false
+		for _, field := range fields {
+			for _, token := range field.tokens {
+				if score := matchToken(queryToken, token); score >= matchPrefix || (!term.negate && score > 0) {
+					found = true
+					break
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matches returns true if an artist, album or song passes every filter in the query.
+func (i *MusicIndex) matches(q *Query, doc *searchDoc) bool {
+	if q.songOnly() && doc.kind != searchDocSong {
+		return false
+	}
+	for idx := range q.terms {
+		term := &q.terms[idx]
+		var matched bool
+		if term.field == queryFieldAny {
+			matched = termMatches(term, doc.fields)
+		} else if term.field == queryFieldLyrics && doc.kind == searchDocSong {
+			// lyrics are long, so use the tokens already in the index
+			matched = termMatches(term, doc.fields[songLyricsField:songLyricsField+1])
+		} else if value, ok := i.fieldValue(doc, term.field); !ok {
+			// albums have no genre, so -genre:rock keeps them and genre:rock drops them
+			matched = false
+		} else if isNumberField(term.field) {
+			n, _ := strconv.Atoi(value)
+			matched = n >= term.min && n <= term.max
+		} else {
+			matched = termMatches(term, []searchField{newSearchField(value, 1)})
+		}
+		if matched == term.negate {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+package music
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query     string
+		wantWords []string
+		wantTerms []queryTerm
+	}{
+		{"karma police", []string{"karma", "police"}, nil},
+		// words that look like fields but aren't are free text
+		{"Live: Tokyo", []string{"live", "tokyo"}, nil},
+		{"Re: Stacks", []string{"re", "stacks"}, nil},
+		{"mixtape:vol", nil, []queryTerm{{tokens: []string{"mixtape", "vol"}, text: "mixtape vol", phrase: true}}},
+		{"Artist:Radiohead", []string{"radiohead"}, []queryTerm{{field: queryFieldArtist, tokens: []string{"radiohead"}, text: "radiohead"}}},
+		{"year:1997..2001 -live", nil, []queryTerm{
+			{field: queryFieldYear, min: 1997, max: 2001},
+			{negate: true, tokens: []string{"live"}, text: "live"},
+		}},
+	}
+	for _, test := range tests {
+		q, err := ParseQuery(test.query)
+		if err != nil {
+			t.Errorf("ParseQuery(%q) failed: %v", test.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(q.words, test.wantWords) {
+			t.Errorf("ParseQuery(%q) got words %q, want %q", test.query, q.words, test.wantWords)
+		}
+		if !reflect.DeepEqual(q.terms, test.wantTerms) {
+			t.Errorf("ParseQuery(%q) got terms %+v, want %+v", test.query, q.terms, test.wantTerms)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantPos int
+	}{
+		{"year:nineties", 5},
+		{"plays:5..1", 6},
+		{"rating:..", 7},
+		{"artist:", 0},
+		{`"karma police`, 0},
+	}
+	for _, test := range tests {
+		_, err := ParseQuery(test.query)
+		var queryError *QueryError
+		if !errors.As(err, &queryError) {
+			t.Errorf("ParseQuery(%q) got error %v, want a QueryError", test.query, err)
+		} else if queryError.Pos != test.wantPos {
+			t.Errorf("ParseQuery(%q) got error at %d, want %d", test.query, queryError.Pos, test.wantPos)
+		}
+	}
+}
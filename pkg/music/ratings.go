@@ -0,0 +1,174 @@
+package music
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/dhowden/tag"
+)
+
+const MaxStars = 5
+
+// ErrBadRating is returned when rating something more than MaxStars.
+var ErrBadRating = errors.New("bad rating")
+
+// Rating is the star rating of a song or album out of MaxStars, with zero meaning unrated.
+type Rating struct {
+	Stars     int
+	Favourite bool
+}
+
+type ratingsData struct {
+	// Songs are keyed by path and albums by artist:album so they survive rescans
+	Songs  map[string]Rating
+	Albums map[string]Rating
+}
+
+func loadRatings(folder string) (*ratingsData, error) {
+	f, err := os.Open(path.Join(folder, "ratings.dat"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var data ratingsData
+	if err := gob.NewDecoder(f).Decode(&data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+func saveRatings(folder string, data *ratingsData) error {
+	f, err := os.Create(path.Join(folder, "ratings.dat"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return gob.NewEncoder(f).Encode(data)
+}
+
+// tagStars reads the rating from a POPM frame, as written by Windows Media Player and others, or
+// from an iTunes style rate tag from 0 to 100.
+func tagStars(m tag.Metadata) int {
+	for name, value := range m.Raw() {
+		switch {
+		case strings.HasPrefix(name, "POP"):
+			// email, a zero byte, the rating from 1 to 255 then the play count
+			b, ok := value.([]byte)
+			if !ok {
+				continue
+			}
+			if idx := strings.IndexByte(string(b), 0); idx >= 0 && idx+1 < len(b) {
+				switch rating := b[idx+1]; {
+				case rating == 0:
+					return 0
+				case rating < 32:
+					return 1
+				case rating < 96:
+					return 2
+				case rating < 160:
+					return 3
+				case rating < 224:
+					return 4
+				default:
+					return 5
+				}
+			}
+		case strings.EqualFold(name, "rate") || strings.EqualFold(name, "rating"):
+			s, ok := value.(string)
+			if !ok {
+				continue
+			}
+			rate, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || rate <= 0 {
+				continue
+			}
+			if rate <= MaxStars {
+				return rate
+			}
+			if rate > 100 {
+				rate = 100
+			}
+			return (rate + 10) / 20
+		}
+	}
+	return 0
+}
+
+func albumRatingKey(artist, album string) string {
+	return artist + ":" + album
+}
+
+// seedSongRating sets the rating of a song from its tags if it hasn't been rated.
+func (mi *MusicIndex) seedSongRating(songPath string, stars int) bool {
+	mi.ratingsMu.Lock()
+	defer mi.ratingsMu.Unlock()
+	if _, ok := mi.ratings.Songs[songPath]; ok || stars == 0 {
+		return false
+	}
+	mi.ratings.Songs[songPath] = Rating{Stars: stars}
+	return true
+}
+
+// SongRating returns the rating of a song.
+func (mi *MusicIndex) SongRating(songPath string) Rating {
+	mi.ratingsMu.Lock()
+	defer mi.ratingsMu.Unlock()
+	if mi.ratings == nil {
+		return Rating{}
+	}
+	return mi.ratings.Songs[songPath]
+}
+
+// AlbumRating returns the rating of an album.
+func (mi *MusicIndex) AlbumRating(artist, album string) Rating {
+	mi.ratingsMu.Lock()
+	defer mi.ratingsMu.Unlock()
+	if mi.ratings == nil {
+		return Rating{}
+	}
+	return mi.ratings.Albums[albumRatingKey(artist, album)]
+}
+
+func (mi *MusicIndex) setRating(songPath, albumKey string, rating Rating) error {
+	if rating.Stars < 0 || rating.Stars > MaxStars {
+		return fmt.Errorf("%w: %d stars", ErrBadRating, rating.Stars)
+	}
+	mi.ratingsMu.Lock()
+	defer mi.ratingsMu.Unlock()
+	if mi.ratings == nil {
+		return errors.New("index not loaded yet")
+	}
+	if len(songPath) > 0 {
+		mi.ratings.Songs[songPath] = rating
+	} else {
+		mi.ratings.Albums[albumKey] = rating
+	}
+	mi.ratingsVersion++
+	return saveRatings(mi.folder, mi.ratings)
+}
+
+// RateSong sets the rating of a song.
+func (mi *MusicIndex) RateSong(songId int, rating Rating) error {
+	mi.SongsMu.Lock()
+	if songId < 0 || songId >= len(mi.Songs) {
+		mi.SongsMu.Unlock()
+		return ErrNotFound
+	}
+	songPath := mi.Songs[songId].Path
+	mi.SongsMu.Unlock()
+	return mi.setRating(songPath, "", rating)
+}
+
+// RateAlbum sets the rating of an album.
+func (mi *MusicIndex) RateAlbum(albumName string, rating Rating) error {
+	album, _, err := mi.lookupAlbum(albumName)
+	if err != nil {
+		return err
+	}
+	return mi.setRating("", albumRatingKey(album.Artist, album.Name), rating)
+}
@@ -0,0 +1,84 @@
+package music
+
+import (
+	"testing"
+
+	"github.com/dhowden/tag"
+)
+
+// rawTags is tag.Metadata with only the raw frames set, which is all tagStars looks at.
+type rawTags struct {
+	tag.Metadata
+	raw map[string]interface{}
+}
+
+func (m rawTags) Raw() map[string]interface{} { return m.raw }
+
+func popm(rating byte) []byte {
+	return append([]byte("Windows Media Player 9 Series\x00"), rating, 0, 0, 0, 3)
+}
+
+func TestTagStars(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       map[string]interface{}
+		wantStars int
+	}{
+		{"POPM 0", map[string]interface{}{"POPM": popm(0)}, 0},
+		{"POPM 1", map[string]interface{}{"POPM": popm(1)}, 1},
+		{"POPM 64", map[string]interface{}{"POPM": popm(64)}, 2},
+		{"POPM 128", map[string]interface{}{"POPM": popm(128)}, 3},
+		{"POPM 196", map[string]interface{}{"POPM": popm(196)}, 4},
+		{"POPM 255", map[string]interface{}{"POPM": popm(255)}, 5},
+		// ID3v2.2 calls the frame POP
+		{"POP", map[string]interface{}{"POP": popm(196)}, 4},
+		{"POPM without a rating", map[string]interface{}{"POPM": []byte("no-one@example.com\x00")}, 0},
+		{"POPM not bytes", map[string]interface{}{"POPM": "255"}, 0},
+		// rates up to MaxStars are already stars, anything above is out of 100
+		{"rate 3", map[string]interface{}{"rate": "3"}, 3},
+		{"rate 5", map[string]interface{}{"rate": "5"}, 5},
+		{"rate 20", map[string]interface{}{"rate": "20"}, 1},
+		{"rate 50", map[string]interface{}{"rate": "50"}, 3},
+		{"rate 80", map[string]interface{}{"RATE": " 80 "}, 4},
+		{"rate 100", map[string]interface{}{"rate": "100"}, 5},
+		{"rate over 100", map[string]interface{}{"rate": "150"}, 5},
+		{"rate 0", map[string]interface{}{"rate": "0"}, 0},
+		{"rate negative", map[string]interface{}{"rate": "-20"}, 0},
+		{"rate not a number", map[string]interface{}{"rate": "good"}, 0},
+		{"rating", map[string]interface{}{"Rating": "60"}, 3},
+		{"no rating", map[string]interface{}{"TIT2": "One"}, 0},
+	}
+	for _, test := range tests {
+		if stars := tagStars(rawTags{raw: test.raw}); stars != test.wantStars {
+			t.Errorf("%s: got %d stars, want %d", test.name, stars, test.wantStars)
+		}
+	}
+}
+
+func TestSeedSongRating(t *testing.T) {
+	var mi MusicIndex
+	mi.Open(t.TempDir())
+	mi.ratings = &ratingsData{Songs: make(map[string]Rating), Albums: make(map[string]Rating)}
+	if err := mi.setRating("/Artist/Album/01 One.mp3", "", Rating{Stars: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// tags never replace a rating made here, and unrated tags don't count as a rating
+	if mi.seedSongRating("/Artist/Album/01 One.mp3", 5) {
+		t.Error("seeding a rated song replaced its rating")
+	}
+	if mi.seedSongRating("/Artist/Album/02 Two.mp3", 0) {
+		t.Error("seeding zero stars rated the song")
+	}
+	if !mi.seedSongRating("/Artist/Album/03 Three.mp3", 4) {
+		t.Error("seeding an unrated song didn't rate it")
+	}
+	for songPath, want := range map[string]int{
+		"/Artist/Album/01 One.mp3":   2,
+		"/Artist/Album/02 Two.mp3":   0,
+		"/Artist/Album/03 Three.mp3": 4,
+	} {
+		if rating := mi.SongRating(songPath); rating.Stars != want {
+			t.Errorf("%s: got %d stars, want %d", songPath, rating.Stars, want)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package music
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+type SearchResult struct {
+	SongId, AlbumId, ArtistId int
+	Score                     float64
+}
+
+const MaxSearchResults = 300
+
+const (
+	SearchArtists = "artists"
+	SearchAlbums  = "albums"
+	SearchSongs   = "songs"
+)
+
+type SearchCounts struct {
+	Artists, Albums, Songs int
+}
+
+// SearchPage is a page of search results along with the total number of matches of each type.
+type SearchPage struct {
+	Results []SearchResult
+	Counts  SearchCounts
+	// Next is the offset of the next page of results, or -1 if this is the last page
+	Next int
+	// Generation is the generation of the index the ids in the results are for, see MusicIndex.Generation
+	Generation int
+}
+
+const (
+	matchExact     = 1.0
+	matchPrefix    = 0.8
+	matchTypo      = 0.6
+	matchSubstring = 0.5
+
+	// secondary fields, such as the artist of an album, count for less than the primary field
+	secondaryFieldWeight = 0.6
+	// lyrics matches rank below matches on everything else
+	lyricsFieldWeight = 0.3
+)
+
+// normalize lowercases s and strips diacritics and apostrophes so "Beyoncé" matches "beyonce"
+// and "Don't" matches "dont".
+func normalize(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) || r == '\'' || r == '’' {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+func tokenize(s string) []string {
+	return strings.FieldsFunc(normalize(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// maxTypos is the edit distance we tolerate for a query token, none for short words.
+func maxTypos(token string) int {
+	switch n := len([]rune(token)); {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// editDistance returns the optimal string alignment distance between a and b, or max+1 if it's more than max.
+// rows is scratch space that is grown as needed and returned for reuse.
+func editDistance(a, b []rune, max int, rows []int) (int, []int) {
+	if d := len(a) - len(b); d > max || -d > max {
+		return max + 1, rows
+	}
+	if len(rows) < 3*(len(b)+1) {
+		rows = make([]int, 3*(len(b)+1))
+	}
+	prev2, prev, curr := rows[0:len(b)+1], rows[len(b)+1:2*(len(b)+1)], rows[2*(len(b)+1):3*(len(b)+1)]
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		rowMin := curr[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if v := prev[j] + 1; v < curr[j] {
+				curr[j] = v
+			}
+			if v := curr[j-1] + 1; v < curr[j] {
+				curr[j] = v
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				if v := prev2[j-2] + 1; v < curr[j] {
+					curr[j] = v
+				}
+			}
+			if curr[j] < rowMin {
+				rowMin = curr[j]
+			}
+		}
+		if rowMin > max {
+			return max + 1, rows
+		}
+		prev2, prev, curr = prev, curr, prev2
+	}
+	return prev[len(b)], rows
+}
+
+// tokenMatcher scores how well a query token matches tokens from the index.
+type tokenMatcher struct {
+	query []rune
+	typos int
+	rows  []int
+}
+
+func newTokenMatcher(query string) *tokenMatcher {
+	return &tokenMatcher{query: []rune(query), typos: maxTypos(query)}
+}
+
+func (m *tokenMatcher) match(query, token string, tokenRunes []rune) float64 {
+	if query == token {
+		return matchExact
+	}
+	if strings.HasPrefix(token, query) {
+		return matchPrefix
+	}
+	if m.typos > 0 {
+		var d int
+		if d, m.rows = editDistance(m.query, tokenRunes, m.typos, m.rows); d <= m.typos {
+			return matchTypo
+		}
+		// allow typos in a word that is still being typed
+		if len(tokenRunes) > len(m.query) {
+			if d, m.rows = editDistance(m.query, tokenRunes[:len(m.query)], m.typos, m.rows); d <= m.typos {
+				return matchTypo * matchPrefix
+			}
+		}
+	}
+	if len(query) >= 3 && strings.Contains(token, query) {
+		return matchSubstring
+	}
+	return 0
+}
+
+// matchToken scores how well a query token matches a token from the index.
+func matchToken(query, token string) float64 {
+	return newTokenMatcher(query).match(query, token, []rune(token))
+}
+
+// searchField is a tokenized field of an artist, album or song.
+type searchField struct {
+	normalized string
+	tokens     []string
+	weight     float64
+}
+
+func newSearchField(s string, weight float64) searchField {
+	return searchField{normalized: normalize(s), tokens: tokenize(s), weight: weight}
+}
+
+// matchingDocs returns the artists, albums and songs matching a query. Callers must hold SongsMu.
+func (i *MusicIndex) matchingDocs(q *Query) []scoredDoc {
+	var candidates []scoredDoc
+	if len(q.words) > 0 {
+		candidates = i.search.search(strings.Join(q.words, " "), q.words)
+	} else {
+		candidates = make([]scoredDoc, 0, len(i.search.docs))
+		for _, doc := range i.search.docs {
+			if doc != nil {
+				candidates = append(candidates, scoredDoc{doc: doc})
+			}
+		}
+	}
+	matches := candidates[:0]
+	for _, candidate := range candidates {
+		if i.matches(q, candidate.doc) {
+			matches = append(matches, candidate)
+		}
+	}
+	return matches
+}
+
+func betterResult(a, b *SearchResult) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return a.ArtistId+a.AlbumId+a.SongId < b.ArtistId+b.AlbumId+b.SongId
+}
+
+// sortTop moves the best n results to the front in order, leaving the rest in any order after them. It is
+// much quicker than sorting them all when a common word matches most of the library.
+func sortTop(results []SearchResult, n int) {
+	if n <= 0 {
+		return
+	}
+	if n >= len(results)/8 {
+		sort.Slice(results, func(i, j int) bool { return betterResult(&results[i], &results[j]) })
+		return
+	}
+	// keep the best n so far in a heap with the worst of them at the top
+	top := results[:n]
+	down := func(i int) {
+		for {
+			worst, left, right := i, 2*i+1, 2*i+2
+			if left < n && betterResult(&top[worst], &top[left]) {
+				worst = left
+			}
+			if right < n && betterResult(&top[worst], &top[right]) {
+				worst = right
+			}
+			if worst == i {
+				return
+			}
+			top[i], top[worst] = top[worst], top[i]
+			i = worst
+		}
+	}
+	for i := n/2 - 1; i >= 0; i-- {
+		down(i)
+	}
+	for i := n; i < len(results); i++ {
+		if betterResult(&results[i], &top[0]) {
+			top[0], results[i] = results[i], top[0]
+			down(0)
+		}
+	}
+	sort.Slice(top, func(i, j int) bool { return betterResult(&top[i], &top[j]) })
+}
+
+// Search returns a page of the artists, albums and songs matching the query, grouped by type and ranked by
+// how well they match. Free text words must each match a word in any field, see ParseQuery for the rest of
+// the syntax. Results can be restricted to SearchArtists, SearchAlbums or SearchSongs with resultType.
+func (i *MusicIndex) Search(s string, resultType string, offset, limit int) (*SearchPage, error) {
+	q, err := ParseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > MaxSearchResults {
+		limit = MaxSearchResults
+	}
+	i.SongsMu.Lock()
+	defer i.SongsMu.Unlock()
+	page := &SearchPage{Results: []SearchResult{}, Next: -1, Generation: i.generation}
+	if (len(q.words) == 0 && len(q.terms) == 0) || i.search == nil {
+		return page, nil
+	}
+
+	var artists, albums, songs []SearchResult
+	matches := i.matchingDocs(q)
+	songs = make([]SearchResult, 0, len(matches))
+	for _, result := range matches {
+		switch result.doc.kind {
+		case searchDocArtist:
+			artists = append(artists, SearchResult{ArtistId: result.doc.idx, SongId: -1, AlbumId: -1, Score: result.score})
+		case searchDocAlbum:
+			albums = append(albums, SearchResult{AlbumId: result.doc.idx, SongId: -1, ArtistId: -1, Score: result.score})
+		case searchDocSong:
+			songs = append(songs, SearchResult{SongId: result.doc.idx, AlbumId: -1, ArtistId: -1, Score: result.score})
+		}
+	}
+	page.Counts = SearchCounts{Artists: len(artists), Albums: len(albums), Songs: len(songs)}
+	switch resultType {
+	case SearchArtists:
+		albums, songs = nil, nil
+	case SearchAlbums:
+		artists, songs = nil, nil
+	case SearchSongs:
+		artists, albums = nil, nil
+	}
+
+	total := len(artists) + len(albums) + len(songs)
+	if offset < 0 || offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end < total {
+		page.Next = end
+	} else {
+		end = total
+	}
+	// the page is a window onto the artists, then the albums, then the songs, and only the results up to
+	// the end of it need to be in order
+	page.Results = make([]SearchResult, 0, end-offset)
+	groupStart := 0
+	for _, group := range [][]SearchResult{artists, albums, songs} {
+		from, to := offset-groupStart, end-groupStart
+		groupStart += len(group)
+		if to <= 0 || from >= len(group) {
+			continue
+		}
+		if from < 0 {
+			from = 0
+		}
+		if to > len(group) {
+			to = len(group)
+		}
+		sortTop(group, to)
+		page.Results = append(page.Results, group[from:to]...)
+	}
+	return page, nil
+}
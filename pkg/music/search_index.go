@@ -0,0 +1,349 @@
+package music
+
+import (
+	"sort"
+	"strings"
+)
+
+type searchDocKind uint8
+
+const (
+	searchDocArtist searchDocKind = iota
+	searchDocAlbum
+	searchDocSong
+)
+
+// songLyricsField is the index of the lyrics in the fields of a song.
+const songLyricsField = 3
+
+// searchDoc is an artist, album or song in the search index. idx is its index into
+// MusicIndex.Artists, Albums or Songs, which changes every time the library is rescanned.
+type searchDoc struct {
+	key    string
+	kind   searchDocKind
+	idx    int
+	fields []searchField
+	text   string
+}
+
+// searchPosting is a document containing a token, along with the weight of the field it's in and whether
+// the token starts the title, which saves looking the document up for every token it contains while searching.
+type searchPosting struct {
+	doc         int32
+	startsTitle bool
+	weight      float64
+}
+
+// searchIndex is an inverted index from normalized tokens to the artists, albums and songs
+// containing them. It is kept up to date with the MusicIndex by update, which only re-indexes
+// the documents that have changed since the last update.
+type searchIndex struct {
+	docs     []*searchDoc
+	freeDocs []int32
+	docByKey map[string]int32
+	postings map[string][]searchPosting
+	// sorted list of every token in postings, rebuilt when tokens are added or removed,
+	// along with indexes into it by letter, bigram and trigram
+	dictionary      []string
+	dictionaryRunes [][]rune
+	firstRunes      []rune
+	dictionaryDirty bool
+	tokensByLetter  map[string][]int32
+	tokensByBigram  map[string][]int32
+	tokensByTrigram map[string][]int32
+	// scores of the documents during a search, and whether the first query token matched the start of
+	// their titles, kept between searches as they're as long as docs
+	scores      []float64
+	startsTitle []bool
+	// how many grams of a query token each token in the dictionary has, kept between searches
+	shared []uint8
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{docByKey: make(map[string]int32), postings: make(map[string][]searchPosting)}
+}
+
+func (si *searchIndex) add(doc *searchDoc) {
+	var id int32
+	if len(si.freeDocs) > 0 {
+		id = si.freeDocs[len(si.freeDocs)-1]
+		si.freeDocs = si.freeDocs[:len(si.freeDocs)-1]
+		si.docs[id] = doc
+	} else {
+		id = int32(len(si.docs))
+		si.docs = append(si.docs, doc)
+	}
+	si.docByKey[doc.key] = id
+	for fieldIdx, field := range doc.fields {
+		for tokenIdx, token := range field.tokens {
+			postings, ok := si.postings[token]
+			if !ok {
+				si.dictionaryDirty = true
+			}
+			si.postings[token] = append(postings, searchPosting{doc: id, startsTitle: fieldIdx == 0 && tokenIdx == 0, weight: field.weight})
+		}
+	}
+}
+
+func (si *searchIndex) remove(id int32) {
+	doc := si.docs[id]
+	for _, field := range doc.fields {
+		for _, token := range field.tokens {
+			postings, ok := si.postings[token]
+			if !ok {
+				continue
+			}
+			kept := postings[:0]
+			for _, posting := range postings {
+				if posting.doc != id {
+					kept = append(kept, posting)
+				}
+			}
+			if len(kept) == 0 {
+				delete(si.postings, token)
+				si.dictionaryDirty = true
+			} else {
+				si.postings[token] = kept
+			}
+		}
+	}
+	delete(si.docByKey, doc.key)
+	si.docs[id] = nil
+	si.freeDocs = append(si.freeDocs, id)
+}
+
+// update brings the index in line with the artists, albums and songs, adding and removing
+// only the documents that changed.
+func (si *searchIndex) update(artists []Artist, albums []Album, songs []Song) {
+	newDocs := make(map[string]*searchDoc, len(artists)+len(albums)+len(songs))
+	for idx, artist := range artists {
+		newDocs["artist:"+artist.Name] = &searchDoc{
+			kind: searchDocArtist, idx: idx, text: artist.Name,
+		}
+	}
+	for idx, album := range albums {
+		newDocs["album:"+album.Artist+":"+album.Name] = &searchDoc{
+			kind: searchDocAlbum, idx: idx, text: album.Name + "\x00" + album.Artist,
+		}
+	}
+	for idx, song := range songs {
+		newDocs["song:"+song.Path] = &searchDoc{
+			kind: searchDocSong, idx: idx, text: song.Title + "\x00" + song.Artist + "\x00" + song.Album + "\x00" + song.Lyrics,
+		}
+	}
+	for key, id := range si.docByKey {
+		if newDoc, ok := newDocs[key]; !ok || newDoc.text != si.docs[id].text {
+			si.remove(id)
+		}
+	}
+	for key, newDoc := range newDocs {
+		if id, ok := si.docByKey[key]; ok {
+			si.docs[id].idx = newDoc.idx
+			continue
+		}
+		newDoc.key = key
+		switch newDoc.kind {
+		case searchDocArtist:
+			artist := &artists[newDoc.idx]
+			newDoc.fields = []searchField{newSearchField(artist.Name, 1)}
+		case searchDocAlbum:
+			album := &albums[newDoc.idx]
+			newDoc.fields = []searchField{newSearchField(album.Name, 1), newSearchField(album.Artist, secondaryFieldWeight)}
+		case searchDocSong:
+			song := &songs[newDoc.idx]
+			newDoc.fields = []searchField{
+				newSearchField(song.Title, 1),
+				newSearchField(song.Artist, secondaryFieldWeight), newSearchField(song.Album, secondaryFieldWeight),
+				newSearchField(lyricsText(song.Lyrics), lyricsFieldWeight),
+			}
+		}
+		si.add(newDoc)
+	}
+	if si.dictionaryDirty {
+		si.rebuildDictionary()
+	}
+}
+
+func (si *searchIndex) rebuildDictionary() {
+	si.dictionary = make([]string, 0, len(si.postings))
+	for token := range si.postings {
+		si.dictionary = append(si.dictionary, token)
+	}
+	sort.Strings(si.dictionary)
+	si.dictionaryRunes = make([][]rune, len(si.dictionary))
+	si.firstRunes = make([]rune, len(si.dictionary))
+	si.tokensByLetter = make(map[string][]int32)
+	si.tokensByBigram = make(map[string][]int32)
+	si.tokensByTrigram = make(map[string][]int32)
+	for idx, token := range si.dictionary {
+		runes := []rune(token)
+		si.dictionaryRunes[idx] = runes
+		si.firstRunes[idx] = runes[0]
+		seen := make(map[string]bool, 3*len(runes))
+		for n, byN := range map[int]map[string][]int32{1: si.tokensByLetter, 2: si.tokensByBigram, 3: si.tokensByTrigram} {
+			for i := 0; i+n <= len(runes); i++ {
+				gram := string(runes[i : i+n])
+				if !seen[gram] {
+					seen[gram] = true
+					byN[gram] = append(byN[gram], int32(idx))
+				}
+			}
+		}
+	}
+	si.dictionaryDirty = false
+}
+
+// matchingTokens returns every token in the dictionary matching the query token along with how well it matches.
+func (si *searchIndex) matchingTokens(query string) map[string]float64 {
+	matches := make(map[string]float64)
+	// exact and prefix matches are a contiguous range of the sorted dictionary
+	for idx := sort.SearchStrings(si.dictionary, query); idx < len(si.dictionary) && strings.HasPrefix(si.dictionary[idx], query); idx++ {
+		if si.dictionary[idx] == query {
+			matches[query] = matchExact
+		} else {
+			matches[si.dictionary[idx]] = matchPrefix
+		}
+	}
+	m := newTokenMatcher(query)
+	check := func(idx int32) {
+		// exact and prefix matches are already in matches
+		token := si.dictionary[idx]
+		if strings.HasPrefix(token, query) {
+			return
+		}
+		if score := m.match(query, token, si.dictionaryRunes[idx]); score > 0 {
+			matches[token] = score
+		}
+	}
+	if m.typos > 0 {
+		// a token with a few typos, or starting with them, still has most of the bigrams of the query, as a
+		// typo changes at most three of them, a swap of two letters being the worst. Short words can lose
+		// every bigram, but only one letter for each typo.
+		n, byGram := 2, si.tokensByBigram
+		minShared := len(m.query) - 1 - 3*m.typos
+		if minShared <= 0 {
+			n, byGram = 1, si.tokensByLetter
+			minShared = len(m.query) - m.typos
+		}
+		si.shared = sharedGrams(m.query, n, byGram, len(si.dictionary), si.shared)
+		for idx, shared := range si.shared {
+			if int(shared) < minShared {
+				continue
+			}
+			// whole word typos are in tokens of a similar length, and typos in a word that is still being
+			// typed are only looked for in tokens with the right first letter
+			if d := len(si.dictionaryRunes[idx]) - len(m.query); (d > m.typos || d < -m.typos) && si.firstRunes[idx] != m.query[0] {
+				continue
+			}
+			check(int32(idx))
+		}
+	}
+	// substrings contain the first trigram of the query
+	if len(m.query) >= 3 {
+		for _, idx := range si.tokensByTrigram[string(m.query[:3])] {
+			check(idx)
+		}
+	}
+	return matches
+}
+
+// sharedGrams counts how many of the n letter grams of the query each of the tokens has, counting a gram
+// as often as it is in the query. shared is scratch space that is grown as needed and returned for reuse.
+func sharedGrams(query []rune, n int, byGram map[string][]int32, numTokens int, shared []uint8) []uint8 {
+	if cap(shared) < numTokens {
+		shared = make([]uint8, numTokens)
+	}
+	shared = shared[:numTokens]
+	for idx := range shared {
+		shared[idx] = 0
+	}
+	for i := 0; i+n <= len(query); i++ {
+		for _, idx := range byGram[string(query[i:i+n])] {
+			if shared[idx] < 255 {
+				shared[idx]++
+			}
+		}
+	}
+	return shared
+}
+
+type scoredDoc struct {
+	doc   *searchDoc
+	score float64
+}
+
+// search returns the documents matching every query token along with their scores.
+func (si *searchIndex) search(query string, queryTokens []string) []scoredDoc {
+	tokenMatches := make([]map[string]float64, len(queryTokens))
+	rarest, rarestCount := 0, -1
+	for idx, queryToken := range queryTokens {
+		tokenMatches[idx] = si.matchingTokens(queryToken)
+		count := 0
+		for token := range tokenMatches[idx] {
+			count += len(si.postings[token])
+		}
+		if rarestCount == -1 || count < rarestCount {
+			rarest, rarestCount = idx, count
+		}
+	}
+	// start with the documents matching the most selective query token
+	if len(si.scores) < len(si.docs) {
+		si.scores = make([]float64, len(si.docs))
+		si.startsTitle = make([]bool, len(si.docs))
+	}
+	scores, startsTitle := si.scores, si.startsTitle
+	candidates := make([]int32, 0, rarestCount)
+	for token, score := range tokenMatches[rarest] {
+		for _, posting := range si.postings[token] {
+			s := score * posting.weight
+			if scores[posting.doc] == 0 {
+				candidates = append(candidates, posting.doc)
+			}
+			if s > scores[posting.doc] {
+				scores[posting.doc] = s
+			}
+			if posting.startsTitle && score >= matchPrefix {
+				startsTitle[posting.doc] = true
+			}
+		}
+	}
+	// then check the candidates contain the other query tokens
+	results := make([]scoredDoc, 0, len(candidates))
+	for _, id := range candidates {
+		score := scores[id]
+		// only a title starting with a word matching the first query token can start with the whole query
+		checkTitle := rarest != 0 || startsTitle[id]
+		scores[id], startsTitle[id] = 0, false
+		doc := si.docs[id]
+		for idx := range queryTokens {
+			if idx == rarest {
+				continue
+			}
+			best := 0.0
+			for _, field := range doc.fields {
+				for _, token := range field.tokens {
+					if s := tokenMatches[idx][token] * field.weight; s > best {
+						best = s
+					}
+				}
+			}
+			if best == 0 {
+				score = 0
+				break
+			}
+			score += best
+		}
+		if score == 0 {
+			continue
+		}
+		if checkTitle {
+			if doc.fields[0].normalized == query {
+				score += matchExact
+			} else if strings.HasPrefix(doc.fields[0].normalized, query) {
+				score += matchPrefix
+			}
+		}
+		results = append(results, scoredDoc{doc: doc, score: score})
+	}
+	return results
+}
@@ -0,0 +1,200 @@
+package music
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var (
+	onsets = []string{"", "b", "c", "d", "f", "g", "h", "j", "k", "l", "m", "n", "p", "r", "s", "t", "v", "w", "y", "z", "bl", "br", "ch", "cr", "dr", "fl", "gr", "pl", "qu", "sh", "sl", "st", "th", "tr"}
+	vowels = []string{"a", "e", "i", "o", "u", "y", "ai", "ea", "ee", "oo", "ou", "ie"}
+	codas  = []string{"", "", "", "b", "ck", "d", "ft", "g", "l", "ll", "m", "n", "nd", "ng", "nt", "p", "r", "rd", "s", "ss", "st", "t", "x"}
+)
+
+// syntheticIndex builds an index of numSongs songs with made up names, ten songs to an album and ten
+// albums to an artist, and returns it with the 20,000 words the names are made from.
+func syntheticIndex(numSongs int) (*MusicIndex, []string) {
+	r := rand.New(rand.NewSource(1))
+	words := make([]string, 20000)
+	for idx := range words {
+		var word strings.Builder
+		for n := 1 + r.Intn(3); n > 0; n-- {
+			word.WriteString(onsets[r.Intn(len(onsets))] + vowels[r.Intn(len(vowels))] + codas[r.Intn(len(codas))])
+		}
+		words[idx] = word.String()
+	}
+	name := func(numWords int) string {
+		parts := make([]string, numWords)
+		for idx := range parts {
+			parts[idx] = words[r.Intn(len(words))]
+		}
+		return strings.Title(strings.Join(parts, " "))
+	}
+	songs := make([]Song, 0, numSongs)
+	albums := make([]Album, 0, numSongs/10)
+	artists := make([]Artist, 0, numSongs/100)
+	albumIdByName := make(map[string]int, numSongs/10)
+	for len(songs) < numSongs {
+		artist := Artist{Name: name(1 + r.Intn(2)), StartAlbumIdx: len(albums)}
+		for a := 0; a < 10 && len(songs) < numSongs; a++ {
+			album := Album{Name: name(1 + r.Intn(3)), Artist: artist.Name, StartSongIdx: len(songs)}
+			for s := 0; s < 10 && len(songs) < numSongs; s++ {
+				title := name(1 + r.Intn(4))
+				songs = append(songs, Song{
+					Path:  fmt.Sprintf("/%s/%s/%02d %s.mp3", artist.Name, album.Name, s+1, title),
+					Title: title, Artist: artist.Name, Album: album.Name, TrackNum: s + 1,
+				})
+			}
+			album.EndSongIdx = len(songs)
+			albumIdByName[album.Name] = len(albums)
+			albums = append(albums, album)
+		}
+		artist.EndAlbumIdx = len(albums)
+		artists = append(artists, artist)
+	}
+	var mi MusicIndex
+	mi.setIndex(songs, albums, artists, albumIdByName)
+	return &mi, words
+}
+
+func BenchmarkSearch(b *testing.B) {
+	mi, words := syntheticIndex(100000)
+	// a word long enough to allow a typo, with two letters swapped
+	var long string
+	for _, word := range words {
+		if len(word) >= 8 {
+			long = word
+			break
+		}
+	}
+	typo := long[:2] + string(long[3]) + string(long[2]) + long[4:]
+	queries := []struct{ name, query string }{
+		{"exact", words[0]},
+		{"prefix", words[1][:4]},
+		{"short prefix", words[1][:2]},
+		{"typo", typo},
+		{"multi-term", strings.ToLower(mi.Songs[500].Artist + " " + mi.Songs[500].Title)},
+		{"filtered", "artist:" + words[2] + " " + words[3][:4]},
+	}
+	for _, q := range queries {
+		b.Run(q.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				if _, err := mi.Search(q.query, "", 0, 50); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		max  int
+		want int
+	}{
+		{"radiohead", "radiohead", 2, 0},
+		{"radiohead", "radiohed", 2, 1},
+		{"radiohead", "raidohead", 2, 1}, // a swap is one edit
+		{"radiohead", "radioheads", 2, 1},
+		{"radiohead", "rdiohed", 2, 2},
+		{"radiohead", "rdioed", 2, 3},   // more than max is max+1
+		{"radiohead", "coldplay", 2, 3}, // however far apart they are
+		{"abc", "abcdef", 1, 2},         // lengths too far apart to check
+		{"", "ab", 2, 2},
+		{"beyonce", "beyoncé", 1, 1},
+	}
+	var rows []int
+	for _, test := range tests {
+		var got int
+		got, rows = editDistance([]rune(test.a), []rune(test.b), test.max, rows)
+		if got != test.want {
+			t.Errorf("editDistance(%q, %q, %d) = %d, want %d", test.a, test.b, test.max, got, test.want)
+		}
+	}
+}
+
+func TestMatchToken(t *testing.T) {
+	tests := []struct {
+		query, token string
+		want         float64
+	}{
+		{"karma", "karma", matchExact},
+		{"kar", "karma", matchPrefix},
+		{"karam", "karma", matchTypo},
+		{"kramap", "karmapolice", matchTypo * matchPrefix},
+		{"arm", "karma", matchSubstring},
+		{"kra", "karma", 0}, // no typos in short words
+		{"kxrxa", "karma", 0},
+		{"radiohaed", "radiohead", matchTypo},
+		{"raidohaed", "radiohead", matchTypo}, // two typos in a long word
+		{"rxdxohxad", "radiohead", 0},
+	}
+	for _, test := range tests {
+		if got := matchToken(test.query, test.token); got != test.want {
+			t.Errorf("matchToken(%q, %q) = %v, want %v", test.query, test.token, got, test.want)
+		}
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	songs := []Song{
+		{Path: "/a/1.mp3", Title: "Karma Police", Artist: "Radiohead", Album: "OK Computer"},
+		{Path: "/a/2.mp3", Title: "Karmageddon", Artist: "Radiohead", Album: "OK Computer"},
+		{Path: "/a/3.mp3", Title: "Instant Karam", Artist: "John Lennon", Album: "Singles"},
+		{Path: "/a/4.mp3", Title: "Chameleon", Artist: "Karma", Album: "Singles"},
+		{Path: "/a/5.mp3", Title: "Sunday", Artist: "Nobody", Album: "Singles", Lyrics: "good karma all round"},
+		{Path: "/a/6.mp3", Title: "Unrelated", Artist: "Nobody", Album: "Singles"},
+		{Path: "/a/7.mp3", Title: "Karma", Artist: "Nobody", Album: "Singles"},
+	}
+	var mi MusicIndex
+	mi.setIndex(songs, nil, nil, map[string]int{})
+
+	page, err := mi.Search("karma", SearchSongs, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, result := range page.Results {
+		got = append(got, songs[result.SongId].Title)
+	}
+	// an exact title first, then titles starting with the word, then a prefix of a word, a typo, the
+	// artist and lastly the lyrics
+	want := []string{"Karma", "Karma Police", "Karmageddon", "Instant Karam", "Chameleon", "Sunday"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if page.Counts.Songs != len(want) {
+		t.Errorf("got %d songs counted, want %d", page.Counts.Songs, len(want))
+	}
+
+	// every word has to match
+	page, err = mi.Search("karma lennon", SearchSongs, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Results) != 1 || songs[page.Results[0].SongId].Title != "Instant Karam" {
+		t.Errorf("got %+v for karma lennon", page.Results)
+	}
+}
+
+func TestSearchGeneration(t *testing.T) {
+	songs := []Song{{Path: "/a/1.mp3", Title: "Karma Police", Artist: "Radiohead", Album: "OK Computer"}}
+	var mi MusicIndex
+	mi.setIndex(songs, nil, nil, map[string]int{})
+	page, err := mi.Search("karma", "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Generation != mi.Generation() {
+		t.Errorf("got generation %d, want %d", page.Generation, mi.Generation())
+	}
+	// a rescan means the ids in the page may refer to other songs
+	mi.setIndex(append([]Song{{Path: "/a/0.mp3", Title: "Airbag"}}, songs...), nil, nil, map[string]int{})
+	if page.Generation == mi.Generation() {
+		t.Errorf("generation %d didn't change after a rescan", page.Generation)
+	}
+}
@@ -0,0 +1,168 @@
+package music
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	SmartOrderLibrary = ""
+	SmartOrderRandom  = "random"
+	// newest, most played and most recently played first
+	SmartOrderAdded  = "added"
+	SmartOrderPlays  = "plays"
+	SmartOrderPlayed = "played"
+	SmartOrderYear   = "year"
+)
+
+// SmartRules pick the songs in a smart playlist. Query is a search query such as
+// `year:1980..1989 genre:rock` or `added:..30`, see ParseQuery. Limit is ignored if zero.
+type SmartRules struct {
+	Query string
+	Order string
+	Limit int
+}
+
+// PlayStats are how many times a song was played to the end and when it was last played.
+type PlayStats struct {
+	Plays      int
+	LastPlayed time.Time
+}
+
+// how long smart playlists with rules relative to today, such as added:..30, are cached for
+const smartDatedExpiry = time.Hour
+
+// smartResult is the songs in a smart playlist, which are valid for an index generation and version of
+// the playlist, and the versions of the ratings and play stats if its rules use them.
+type smartResult struct {
+	generation                   int
+	updated                      time.Time
+	ratingsVersion, playsVersion int
+	// expires is when rules relative to today need evaluating again, or zero if they don't
+	expires time.Time
+	songIds []int
+}
+
+// smartDependencies returns whether the songs picked by smart playlist rules depend on the ratings, the
+// play stats and today's date, besides the library.
+func smartDependencies(rules *SmartRules) (ratings, plays, dated bool) {
+	plays = rules.Order == SmartOrderPlays || rules.Order == SmartOrderPlayed
+	q, err := ParseQuery(rules.Query)
+	if err != nil {
+		return ratings, plays, dated
+	}
+	for _, term := range q.terms {
+		switch term.field {
+		case queryFieldRating, queryFieldFavourite:
+			ratings = true
+		case queryFieldPlays:
+			plays = true
+		case queryFieldPlayed:
+			plays, dated = true, true
+		case queryFieldAdded:
+			dated = true
+		}
+	}
+	return ratings, plays, dated
+}
+
+func validateSmartRules(rules *SmartRules) error {
+	if _, err := ParseQuery(rules.Query); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadPlaylist, err)
+	}
+	switch rules.Order {
+	case SmartOrderLibrary, SmartOrderRandom, SmartOrderAdded, SmartOrderPlays, SmartOrderPlayed, SmartOrderYear:
+	default:
+		return fmt.Errorf("%w: unknown order %q", ErrBadPlaylist, rules.Order)
+	}
+	if rules.Limit < 0 {
+		return fmt.Errorf("%w: negative limit", ErrBadPlaylist)
+	}
+	return nil
+}
+
+// evaluateSmartRules returns the ids of the songs matching the rules. Callers must hold SongsMu.
+func (mi *MusicIndex) evaluateSmartRules(rules *SmartRules) ([]int, error) {
+	if mi.search == nil {
+		return nil, errors.New("index not loaded yet")
+	}
+	q, err := ParseQuery(rules.Query)
+	if err != nil {
+		return nil, err
+	}
+	songIds := make([]int, 0)
+	for _, match := range mi.matchingDocs(q) {
+		if match.doc.kind == searchDocSong {
+			songIds = append(songIds, match.doc.idx)
+		}
+	}
+	sort.Ints(songIds)
+	switch rules.Order {
+	case SmartOrderRandom:
+		rand.New(rand.NewSource(time.Now().UnixNano())).Shuffle(len(songIds), func(i, j int) {
+			songIds[i], songIds[j] = songIds[j], songIds[i]
+		})
+	case SmartOrderAdded:
+		sort.SliceStable(songIds, func(i, j int) bool {
+			return mi.Songs[songIds[i]].AddedAt.After(mi.Songs[songIds[j]].AddedAt)
+		})
+	case SmartOrderPlays:
+		sort.SliceStable(songIds, func(i, j int) bool {
+			return mi.songPlayStats(mi.Songs[songIds[i]].Path).Plays > mi.songPlayStats(mi.Songs[songIds[j]].Path).Plays
+		})
+	case SmartOrderPlayed:
+		sort.SliceStable(songIds, func(i, j int) bool {
+			return mi.songPlayStats(mi.Songs[songIds[i]].Path).LastPlayed.After(mi.songPlayStats(mi.Songs[songIds[j]].Path).LastPlayed)
+		})
+	case SmartOrderYear:
+		sort.SliceStable(songIds, func(i, j int) bool {
+			return mi.Songs[songIds[i]].Year < mi.Songs[songIds[j]].Year
+		})
+	}
+	if rules.Limit > 0 && len(songIds) > rules.Limit {
+		songIds = songIds[:rules.Limit]
+	}
+	return songIds, nil
+}
+
+// smartPlaylistSongIds returns the songs in a smart playlist, which are only re-evaluated when the
+// index, the playlist or the ratings and play stats its rules use change, or its rules relative to today
+// expire, so random playlists don't shuffle every time they are listed. Callers must hold SongsMu.
+func (mi *MusicIndex) smartPlaylistSongIds(playlist *Playlist) []int {
+	now := time.Now()
+	ratings, plays, dated := smartDependencies(playlist.Smart)
+	result := smartResult{generation: mi.generation, updated: playlist.Updated}
+	if ratings {
+		mi.ratingsMu.Lock()
+		result.ratingsVersion = mi.ratingsVersion
+		mi.ratingsMu.Unlock()
+	}
+	if plays {
+		mi.playStatsMu.Lock()
+		result.playsVersion = mi.playsVersion
+		mi.playStatsMu.Unlock()
+	}
+	if cached, ok := mi.smartCache[playlist.ID]; ok && cached.generation == result.generation && cached.updated.Equal(result.updated) &&
+		cached.ratingsVersion == result.ratingsVersion && cached.playsVersion == result.playsVersion &&
+		(cached.expires.IsZero() || now.Before(cached.expires)) {
+		return cached.songIds
+	}
+	songIds, err := mi.evaluateSmartRules(playlist.Smart)
+	if err != nil {
+		log.Printf("failed to evaluate smart playlist %s: %v", playlist.Name, err)
+		return []int{}
+	}
+	if mi.smartCache == nil {
+		mi.smartCache = make(map[int]smartResult)
+	}
+	if dated {
+		result.expires = now.Add(smartDatedExpiry)
+	}
+	result.songIds = songIds
+	mi.smartCache[playlist.ID] = result
+	return songIds
+}
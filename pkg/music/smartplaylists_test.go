@@ -0,0 +1,74 @@
+package music
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSmartPlaylistCache(t *testing.T) {
+	now := time.Now()
+	var mi MusicIndex
+	mi.Open(t.TempDir())
+	mi.ratings = &ratingsData{Songs: make(map[string]Rating), Albums: make(map[string]Rating)}
+	mi.playStats = make(map[string]PlayStats)
+	mi.history = &playHistory{folder: mi.folder}
+	mi.setIndex([]Song{
+		{Path: "/a/1.mp3", Title: "One", AddedAt: now.Add(-10 * 24 * time.Hour)},
+		{Path: "/a/2.mp3", Title: "Two", AddedAt: now.Add(-20 * 24 * time.Hour)},
+		{Path: "/a/3.mp3", Title: "Three", AddedAt: now.Add(-40 * 24 * time.Hour)},
+	}, nil, nil, map[string]int{})
+	songIds := func(playlist *Playlist) []int {
+		mi.SongsMu.Lock()
+		defer mi.SongsMu.Unlock()
+		return mi.smartPlaylistSongIds(playlist)
+	}
+
+	rated := &Playlist{ID: 1, Smart: &SmartRules{Query: "rating:4.."}}
+	played := &Playlist{ID: 2, Smart: &SmartRules{Query: "plays:1.."}}
+	random := &Playlist{ID: 3, Smart: &SmartRules{Order: SmartOrderRandom}}
+	added := &Playlist{ID: 4, Smart: &SmartRules{Query: "added:..30"}}
+	if got := songIds(rated); len(got) != 0 {
+		t.Errorf("got rated songs %v before rating any", got)
+	}
+	if got := songIds(played); len(got) != 0 {
+		t.Errorf("got played songs %v before playing any", got)
+	}
+	shuffled := songIds(random)
+	if got := songIds(added); !reflect.DeepEqual(got, []int{0, 1}) {
+		t.Errorf("got added songs %v, want [0 1]", got)
+	}
+
+	if err := mi.RateSong(1, Rating{Stars: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if got := songIds(rated); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("got rated songs %v after rating, want [1]", got)
+	}
+	if err := mi.RecordPlay(2, PlayComplete); err != nil {
+		t.Fatal(err)
+	}
+	if got := songIds(played); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("got played songs %v after playing, want [2]", got)
+	}
+	// playlists that don't depend on plays keep their order
+	if got := songIds(random); &got[0] != &shuffled[0] {
+		t.Errorf("random playlist was shuffled again after a play")
+	}
+
+	// rules relative to today are evaluated again once they expire
+	mi.SongsMu.Lock()
+	mi.Songs[1].AddedAt = now.Add(-35 * 24 * time.Hour)
+	mi.SongsMu.Unlock()
+	if got := songIds(added); !reflect.DeepEqual(got, []int{0, 1}) {
+		t.Errorf("got added songs %v before expiring, want [0 1]", got)
+	}
+	mi.SongsMu.Lock()
+	cached := mi.smartCache[added.ID]
+	cached.expires = now.Add(-time.Second)
+	mi.smartCache[added.ID] = cached
+	mi.SongsMu.Unlock()
+	if got := songIds(added); !reflect.DeepEqual(got, []int{0}) {
+		t.Errorf("got added songs %v after expiring, want [0]", got)
+	}
+}
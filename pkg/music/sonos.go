@@ -1,43 +1,269 @@
 package music
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/szatmary/sonos"
 )
 
+const (
+	SonosRoomAdded   = "added"
+	SonosRoomRemoved = "removed"
+
+	// how often to search for new players and check the ones we know about are still there
+	sonosSearchInterval = 30 * time.Second
+	// a player is dropped once it has failed this many checks in a row
+	sonosMaxFailures = 2
+
+	ssdpAddr         = "239.255.255.250:1900"
+	ssdpZonePlayerST = "urn:schemas-upnp-org:device:ZonePlayer:1"
+)
+
+// SonosRoomEvent is sent to watchers when a room appears or disappears, with the rooms there are now.
+type SonosRoomEvent struct {
+	Event string `json:",omitempty"`
+	Room  string `json:",omitempty"`
+	Rooms []string
+}
+
 type Sonos struct {
 	ZonePlayers   []*sonos.ZonePlayer
 	ZonePlayersMu sync.RWMutex
+	// failed checks in a row and hidden players such as bonded surrounds, keyed by RINCON_ id
+	failures map[string]int
+	hidden   map[string]bool
+
+	watchers   map[chan SonosRoomEvent]struct{}
+	watchersMu sync.Mutex
+
+	// queues still being filled and sleep timers waiting to fade out keyed by room
+	queueJobs   map[string]*queueJob
+	queueJobsMu sync.Mutex
+	sleepJobs   map[string]*sleepJob
+	sleepJobsMu sync.Mutex
+	// coordinators playing an announcement keyed by room
+	announcing   map[string]bool
+	announcingMu sync.Mutex
 }
 
 func NewSonos() *Sonos {
-	s := &Sonos{}
+	s := &Sonos{failures: make(map[string]int), hidden: make(map[string]bool)}
 	go s.search()
 	return s
 }
 
+// search keeps looking for players with SSDP, as they may be switched on or change address at any time.
 func (s *Sonos) search() {
-	sn, err := sonos.NewSonos()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
 	if err != nil {
-		log.Println(err)
+		log.Printf("failed to search for sonos: %v", err)
 		return
 	}
+	go s.readSearchResponses(conn)
+	bcast, err := net.ResolveUDPAddr("udp", ssdpAddr)
+	if err != nil {
+		log.Printf("failed to search for sonos: %v", err)
+		return
+	}
+	pkt := []byte(fmt.Sprintf("M-SEARCH * HTTP/1.1\r\nHOST: %s\r\nMAN: \"ssdp:discover\"\r\nMX: 5\r\nST: %s\r\n\r\n", ssdpAddr, ssdpZonePlayerST))
+	for {
+		if _, err := conn.WriteTo(pkt, bcast); err != nil {
+			log.Printf("failed to search for sonos trying again in %s: %v", sonosSearchInterval, err)
+		}
+		time.Sleep(sonosSearchInterval)
+		s.checkPlayers()
+	}
+}
+
+func (s *Sonos) readSearchResponses(conn *net.UDPConn) {
+	buf := make([]byte, 8192)
 	for {
-		zns, err := sn.Search()
+		n, _, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			log.Printf("failed to search for sonos trying again in 10 seconds: %v", err)
-			time.Sleep(10 * time.Second)
+			log.Printf("failed to read sonos search response: %v", err)
+			return
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location, err := url.Parse(res.Header.Get("Location"))
+		if err != nil || len(location.Host) == 0 {
 			continue
 		}
-		for zp := range zns {
-			log.Println("found sonos: " + zp.RoomName())
-			s.ZonePlayersMu.Lock()
-			s.ZonePlayers = append(s.ZonePlayers, zp)
+		s.AddPlayer(location)
+	}
+}
+
+// AddPlayer adds the player with a device description URL, replacing the player with the same UDN
+// if it has moved to a new address.
+func (s *Sonos) AddPlayer(location *url.URL) error {
+	s.ZonePlayersMu.RLock()
+	for _, zp := range s.ZonePlayers {
+		if zp.DeviceDescriptionURL.String() == location.String() {
+			s.ZonePlayersMu.RUnlock()
+			return nil
+		}
+	}
+	s.ZonePlayersMu.RUnlock()
+
+	zp, err := sonos.NewZonePlayer(location)
+	if err != nil {
+		log.Printf("failed to add sonos at %s: %v", location, err)
+		return err
+	}
+	s.ZonePlayersMu.Lock()
+	for idx, existing := range s.ZonePlayers {
+		if existing.Root.Device.UDN == zp.Root.Device.UDN {
+			// another search may have found it while we were reading its description
+			if existing.DeviceDescriptionURL.String() == location.String() {
+				s.ZonePlayersMu.Unlock()
+				return nil
+			}
+			log.Printf("sonos %s moved to %s", zp.RoomName(), location.Host)
+			s.ZonePlayers[idx] = zp
+			s.failures[playerUUID(zp)] = 0
 			s.ZonePlayersMu.Unlock()
+			return nil
 		}
+	}
+	log.Println("found sonos: " + zp.RoomName())
+	s.ZonePlayers = append(s.ZonePlayers, zp)
+	s.failures[playerUUID(zp)] = 0
+	s.ZonePlayersMu.Unlock()
+	s.notify(SonosRoomAdded, zp.RoomName())
+	return nil
+}
+
+// checkPlayers drops players that have stopped answering and finds out which are hidden.
+func (s *Sonos) checkPlayers() {
+	s.ZonePlayersMu.RLock()
+	players := append([]*sonos.ZonePlayer{}, s.ZonePlayers...)
+	s.ZonePlayersMu.RUnlock()
+	client := http.Client{Timeout: 5 * time.Second}
+	var alive *sonos.ZonePlayer
+	for _, zp := range players {
+		res, err := client.Get(zp.DeviceDescriptionURL.String())
+		if err == nil {
+			res.Body.Close()
+			if alive == nil {
+				alive = zp
+			}
+		}
+		s.ZonePlayersMu.Lock()
+		if err == nil {
+			s.failures[playerUUID(zp)] = 0
+			s.ZonePlayersMu.Unlock()
+			continue
+		}
+		s.failures[playerUUID(zp)]++
+		removed := false
+		if s.failures[playerUUID(zp)] >= sonosMaxFailures {
+			for idx, existing := range s.ZonePlayers {
+				if existing == zp {
+					s.ZonePlayers = append(s.ZonePlayers[:idx], s.ZonePlayers[idx+1:]...)
+					delete(s.failures, playerUUID(zp))
+					removed = true
+					break
+				}
+			}
+		}
+		s.ZonePlayersMu.Unlock()
+		if removed {
+			log.Printf("lost sonos: %s: %v", zp.RoomName(), err)
+			s.stopQueueing(zp.RoomName())
+			s.stopSleepFade(zp.RoomName())
+			s.notify(SonosRoomRemoved, zp.RoomName())
+		}
+	}
+	if alive == nil {
 		return
 	}
+	state, err := zoneGroupState(alive)
+	if err != nil {
+		log.Printf("failed to get sonos groups: %v", err)
+		return
+	}
+	hidden := make(map[string]bool)
+	for _, zoneGroup := range state.ZoneGroups {
+		for _, member := range zoneGroup.ZoneGroupMember {
+			if member.Invisible == "1" {
+				hidden[member.UUID] = true
+			}
+		}
+	}
+	s.ZonePlayersMu.Lock()
+	s.hidden = hidden
+	s.ZonePlayersMu.Unlock()
+}
+
+// Player returns the player for a room, skipping hidden players bonded to it.
+func (s *Sonos) Player(room string) *sonos.ZonePlayer {
+	s.ZonePlayersMu.RLock()
+	defer s.ZonePlayersMu.RUnlock()
+	for _, zp := range s.ZonePlayers {
+		if zp.RoomName() == room && !s.hidden[playerUUID(zp)] {
+			return zp
+		}
+	}
+	return nil
+}
+
+// Rooms returns the names of the rooms with players in them.
+func (s *Sonos) Rooms() []string {
+	s.ZonePlayersMu.RLock()
+	defer s.ZonePlayersMu.RUnlock()
+	return s.rooms()
+}
+
+// rooms returns the names of the rooms. Callers must hold ZonePlayersMu.
+func (s *Sonos) rooms() []string {
+	rooms := make([]string, 0, len(s.ZonePlayers))
+	seen := make(map[string]bool)
+	for _, zp := range s.ZonePlayers {
+		if !seen[zp.RoomName()] && !s.hidden[playerUUID(zp)] {
+			seen[zp.RoomName()] = true
+			rooms = append(rooms, zp.RoomName())
+		}
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Watch returns a channel of rooms appearing and disappearing, and a function to stop watching.
+func (s *Sonos) Watch() (<-chan SonosRoomEvent, func()) {
+	events := make(chan SonosRoomEvent, 16)
+	s.watchersMu.Lock()
+	if s.watchers == nil {
+		s.watchers = make(map[chan SonosRoomEvent]struct{})
+	}
+	s.watchers[events] = struct{}{}
+	s.watchersMu.Unlock()
+	return events, func() {
+		s.watchersMu.Lock()
+		delete(s.watchers, events)
+		s.watchersMu.Unlock()
+	}
+}
+
+func (s *Sonos) notify(event, room string) {
+	ev := SonosRoomEvent{Event: event, Room: room, Rooms: s.Rooms()}
+	s.watchersMu.Lock()
+	defer s.watchersMu.Unlock()
+	for watcher := range s.watchers {
+		select {
+		case watcher <- ev:
+		default:
+			// drop events for watchers that aren't keeping up rather than holding up discovery
+		}
+	}
 }
@@ -0,0 +1,372 @@
+package music
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/szatmary/sonos"
+	avtransport "github.com/szatmary/sonos/AVTransport"
+	clk "github.com/szatmary/sonos/AlarmClock"
+	dir "github.com/szatmary/sonos/ContentDirectory"
+	"github.com/zanders3/music/pkg/sonosevs"
+)
+
+// ErrBadAlarm is returned for alarms with a time, recurrence, volume, play mode or room a sonos can't use.
+var ErrBadAlarm = errors.New("bad alarm")
+
+const (
+	// the chime a sonos plays for an alarm without any music
+	sonosChimeURI = "x-rincon-buzzer:0"
+	// saved queues are where sonos keeps playlists, and alarms play them from this file
+	savedQueueURI = "file:///jffs/settings/savedqueues.rsq#"
+	// the saved queues made for alarms are named with this so they can be tidied up afterwards
+	alarmQueuePrefix = "Music Box alarm: "
+)
+
+// AlarmPlayModes are the play modes an alarm can start with.
+var AlarmPlayModes = []string{"NORMAL", "REPEAT_ALL", "SHUFFLE_NOREPEAT", "SHUFFLE"}
+
+// recurrences are ONCE, WEEKDAYS, WEEKENDS, DAILY or ON_ followed by days of the week from 0 for Sunday.
+var recurrences = regexp.MustCompile(`^(ONCE|WEEKDAYS|WEEKENDS|DAILY|ON_[0-6]{1,7})$`)
+
+// SonosAlarm is an alarm kept by the sonos players, which go off by themselves whether or not the server
+// is running. StartTime and Duration are HH:MM:SS in the local time of the sonos. Title is the album or
+// playlist it plays, or empty for the sonos chime.
+type SonosAlarm struct {
+	ID                 int
+	Room               string
+	StartTime          string
+	Duration           string
+	Recurrence         string
+	Enabled            bool
+	Volume             int
+	PlayMode           string
+	IncludeLinkedZones bool
+	Title              string `json:",omitempty"`
+}
+
+// AlarmSource is music for an alarm to play, such as the tracks of an album.
+type AlarmSource struct {
+	Title  string
+	Tracks []QueueTrack
+}
+
+type alarmList struct {
+	Alarms []alarmXML `xml:"Alarm"`
+}
+
+type alarmXML struct {
+	ID                 int    `xml:"ID,attr"`
+	StartTime          string `xml:"StartTime,attr"`
+	Duration           string `xml:"Duration,attr"`
+	Recurrence         string `xml:"Recurrence,attr"`
+	Enabled            string `xml:"Enabled,attr"`
+	RoomUUID           string `xml:"RoomUUID,attr"`
+	ProgramURI         string `xml:"ProgramURI,attr"`
+	ProgramMetaData    string `xml:"ProgramMetaData,attr"`
+	PlayMode           string `xml:"PlayMode,attr"`
+	Volume             int    `xml:"Volume,attr"`
+	IncludeLinkedZones string `xml:"IncludeLinkedZones,attr"`
+}
+
+// anyPlayer returns a player to ask about things every player knows, such as the alarms.
+func (s *Sonos) anyPlayer() (*sonos.ZonePlayer, error) {
+	s.ZonePlayersMu.RLock()
+	defer s.ZonePlayersMu.RUnlock()
+	for _, zp := range s.ZonePlayers {
+		if !s.hidden[playerUUID(zp)] {
+			return zp, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no sonos players", ErrNotFound)
+}
+
+// alarmTitle returns the title of what an alarm plays from its metadata.
+func alarmTitle(metaData string) string {
+	var didl sonosevs.DIDLLite
+	if err := xml.Unmarshal([]byte(metaData), &didl); err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(didl.Item.Title, alarmQueuePrefix)
+}
+
+func (s *Sonos) listAlarms() ([]alarmXML, error) {
+	zp, err := s.anyPlayer()
+	if err != nil {
+		return nil, err
+	}
+	res, err := zp.AlarmClock.ListAlarms(zp.HttpClient, &clk.ListAlarmsArgs{})
+	if err != nil {
+		return nil, err
+	}
+	var alarms alarmList
+	if err := xml.Unmarshal([]byte(res.CurrentAlarmList), &alarms); err != nil {
+		return nil, fmt.Errorf("bad alarm list from %s: %w", zp.RoomName(), err)
+	}
+	return alarms.Alarms, nil
+}
+
+func (s *Sonos) findAlarm(id int) (*alarmXML, error) {
+	alarms, err := s.listAlarms()
+	if err != nil {
+		return nil, err
+	}
+	for idx := range alarms {
+		if alarms[idx].ID == id {
+			return &alarms[idx], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: alarm %d", ErrNotFound, id)
+}
+
+func (s *Sonos) toAlarm(alarm alarmXML) SonosAlarm {
+	room := alarm.RoomUUID
+	if zp := s.playerByUUID(alarm.RoomUUID); zp != nil {
+		room = zp.RoomName()
+	}
+	return SonosAlarm{
+		ID:                 alarm.ID,
+		Room:               room,
+		StartTime:          alarm.StartTime,
+		Duration:           alarm.Duration,
+		Recurrence:         alarm.Recurrence,
+		Enabled:            alarm.Enabled == "1",
+		Volume:             alarm.Volume,
+		PlayMode:           alarm.PlayMode,
+		IncludeLinkedZones: alarm.IncludeLinkedZones == "1",
+		Title:              alarmTitle(alarm.ProgramMetaData),
+	}
+}
+
+// Alarms returns the alarms of every room, sorted by when they go off.
+func (s *Sonos) Alarms() ([]SonosAlarm, error) {
+	list, err := s.listAlarms()
+	if err != nil {
+		return nil, err
+	}
+	alarms := make([]SonosAlarm, len(list))
+	for idx, alarm := range list {
+		alarms[idx] = s.toAlarm(alarm)
+	}
+	sort.Slice(alarms, func(i, j int) bool {
+		if alarms[i].StartTime != alarms[j].StartTime {
+			return alarms[i].StartTime < alarms[j].StartTime
+		}
+		return alarms[i].ID < alarms[j].ID
+	})
+	return alarms, nil
+}
+
+// Alarm returns the alarm with an id.
+func (s *Sonos) Alarm(id int) (*SonosAlarm, error) {
+	alarm, err := s.findAlarm(id)
+	if err != nil {
+		return nil, err
+	}
+	a := s.toAlarm(*alarm)
+	return &a, nil
+}
+
+// parseClock parses a time of day as HH:MM:SS or HH:MM.
+func parseClock(s string) (string, error) {
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Format("15:04:05"), nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q is not HH:MM:SS", ErrBadAlarm, s)
+}
+
+// checkAlarm checks an alarm can be set on a sonos, tidying up its times, and returns the player to set it
+// with and the RINCON_ id of its room. roomUUID is the room the alarm is already set for, if it is.
+func (s *Sonos) checkAlarm(alarm *SonosAlarm, roomUUID string) (*sonos.ZonePlayer, string, error) {
+	var err error
+	if alarm.StartTime, err = parseClock(alarm.StartTime); err != nil {
+		return nil, "", err
+	}
+	if alarm.Duration, err = parseClock(alarm.Duration); err != nil {
+		return nil, "", err
+	}
+	if alarm.Duration == "00:00:00" {
+		return nil, "", fmt.Errorf("%w: the duration can't be zero", ErrBadAlarm)
+	}
+	if !recurrences.MatchString(alarm.Recurrence) {
+		return nil, "", fmt.Errorf("%w: bad recurrence %s", ErrBadAlarm, alarm.Recurrence)
+	}
+	if alarm.Volume < 0 || alarm.Volume > 100 {
+		return nil, "", fmt.Errorf("%w: volume %d must be between 0 and 100", ErrBadAlarm, alarm.Volume)
+	}
+	found := false
+	for _, playMode := range AlarmPlayModes {
+		found = found || playMode == alarm.PlayMode
+	}
+	if !found {
+		return nil, "", fmt.Errorf("%w: bad play mode %s", ErrBadAlarm, alarm.PlayMode)
+	}
+	if zp := s.Player(alarm.Room); zp != nil {
+		return zp, playerUUID(zp), nil
+	}
+	// an alarm can stay in a room that is hidden or that the server doesn't know, which it shows by the
+	// RINCON_ id of the room
+	if zp := s.playerByUUID(roomUUID); len(roomUUID) > 0 && (alarm.Room == roomUUID || (zp != nil && alarm.Room == zp.RoomName())) {
+		if zp == nil {
+			// every sonos has the alarms and saved queues, so any of them can change it
+			if zp, err = s.anyPlayer(); err != nil {
+				return nil, "", err
+			}
+		}
+		return zp, roomUUID, nil
+	}
+	return nil, "", fmt.Errorf("%w: no sonos in %s", ErrBadAlarm, alarm.Room)
+}
+
+// createAlarmQueue saves the tracks of a source as a sonos playlist, and returns the program URI and
+// metadata an alarm plays it with.
+func createAlarmQueue(zp *sonos.ZonePlayer, source *AlarmSource) (string, string, error) {
+	if len(source.Tracks) == 0 {
+		return "", "", fmt.Errorf("%w: no songs to play", ErrBadAlarm)
+	}
+	title := alarmQueuePrefix + source.Title
+	res, err := zp.AVTransport.CreateSavedQueue(zp.HttpClient, &avtransport.CreateSavedQueueArgs{
+		InstanceID:          0,
+		Title:               title,
+		EnqueuedURI:         source.Tracks[0].URI,
+		EnqueuedURIMetaData: source.Tracks[0].MetaData,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	updateID := res.NewUpdateID
+	for _, track := range source.Tracks[1:] {
+		added, err := zp.AVTransport.AddURIToSavedQueue(zp.HttpClient, &avtransport.AddURIToSavedQueueArgs{
+			InstanceID:          0,
+			ObjectID:            res.AssignedObjectID,
+			UpdateID:            updateID,
+			EnqueuedURI:         track.URI,
+			EnqueuedURIMetaData: track.MetaData,
+			// past the end adds it at the end
+			AddAtIndex: 4294967295,
+		})
+		if err != nil {
+			destroyAlarmQueue(zp, res.AssignedObjectID)
+			return "", "", err
+		}
+		updateID = added.NewUpdateID
+	}
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(title))
+	metaData := fmt.Sprintf("<DIDL-Lite xmlns:dc=\"http://purl.org/dc/elements/1.1/\" xmlns:upnp=\"urn:schemas-upnp-org:metadata-1-0/upnp/\" xmlns:r=\"urn:schemas-rinconnetworks-com:metadata-1-0/\" xmlns=\"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/\"><item id=\"%s\" parentID=\"SQ:\" restricted=\"true\"><dc:title>%s</dc:title><upnp:class>object.container.playlistContainer</upnp:class><desc id=\"cdudn\" nameSpace=\"urn:schemas-rinconnetworks-com:metadata-1-0/\">RINCON_AssociatedZPUDN</desc></item></DIDL-Lite>",
+		res.AssignedObjectID, b.String())
+	return savedQueueURI + strings.TrimPrefix(res.AssignedObjectID, "SQ:"), metaData, nil
+}
+
+func destroyAlarmQueue(zp *sonos.ZonePlayer, objectID string) {
+	if _, err := zp.ContentDirectory.DestroyObject(zp.HttpClient, &dir.DestroyObjectArgs{ObjectID: objectID}); err != nil {
+		log.Printf("failed to remove the sonos playlist %s: %v", objectID, err)
+	}
+}
+
+// tidyAlarmQueue removes the playlist an alarm played if it was made for the alarm.
+func tidyAlarmQueue(zp *sonos.ZonePlayer, alarm *alarmXML) {
+	var didl sonosevs.DIDLLite
+	if !strings.HasPrefix(alarm.ProgramURI, savedQueueURI) || xml.Unmarshal([]byte(alarm.ProgramMetaData), &didl) != nil || !strings.HasPrefix(didl.Item.Title, alarmQueuePrefix) {
+		return
+	}
+	destroyAlarmQueue(zp, "SQ:"+strings.TrimPrefix(alarm.ProgramURI, savedQueueURI))
+}
+
+// CreateAlarm adds an alarm which plays a source, or the sonos chime if source is nil, and returns it.
+func (s *Sonos) CreateAlarm(alarm SonosAlarm, source *AlarmSource) (*SonosAlarm, error) {
+	zp, roomUUID, err := s.checkAlarm(&alarm, "")
+	if err != nil {
+		return nil, err
+	}
+	programURI, metaData := sonosChimeURI, ""
+	if source != nil {
+		if programURI, metaData, err = createAlarmQueue(zp, source); err != nil {
+			return nil, err
+		}
+	}
+	res, err := zp.AlarmClock.CreateAlarm(zp.HttpClient, &clk.CreateAlarmArgs{
+		StartLocalTime:     alarm.StartTime,
+		Duration:           alarm.Duration,
+		Recurrence:         alarm.Recurrence,
+		Enabled:            alarm.Enabled,
+		RoomUUID:           roomUUID,
+		ProgramURI:         programURI,
+		ProgramMetaData:    metaData,
+		PlayMode:           alarm.PlayMode,
+		Volume:             uint16(alarm.Volume),
+		IncludeLinkedZones: alarm.IncludeLinkedZones,
+	})
+	if err != nil {
+		if source != nil {
+			tidyAlarmQueue(zp, &alarmXML{ProgramURI: programURI, ProgramMetaData: metaData})
+		}
+		return nil, err
+	}
+	return s.Alarm(int(res.AssignedID))
+}
+
+// UpdateAlarm changes an alarm to play a source, or keeps playing what it did if source is nil, and returns it.
+func (s *Sonos) UpdateAlarm(alarm SonosAlarm, source *AlarmSource) (*SonosAlarm, error) {
+	existing, err := s.findAlarm(alarm.ID)
+	if err != nil {
+		return nil, err
+	}
+	zp, roomUUID, err := s.checkAlarm(&alarm, existing.RoomUUID)
+	if err != nil {
+		return nil, err
+	}
+	programURI, metaData := existing.ProgramURI, existing.ProgramMetaData
+	if source != nil {
+		if programURI, metaData, err = createAlarmQueue(zp, source); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := zp.AlarmClock.UpdateAlarm(zp.HttpClient, &clk.UpdateAlarmArgs{
+		ID:                 uint32(alarm.ID),
+		StartLocalTime:     alarm.StartTime,
+		Duration:           alarm.Duration,
+		Recurrence:         alarm.Recurrence,
+		Enabled:            alarm.Enabled,
+		RoomUUID:           roomUUID,
+		ProgramURI:         programURI,
+		ProgramMetaData:    metaData,
+		PlayMode:           alarm.PlayMode,
+		Volume:             uint16(alarm.Volume),
+		IncludeLinkedZones: alarm.IncludeLinkedZones,
+	}); err != nil {
+		if source != nil {
+			tidyAlarmQueue(zp, &alarmXML{ProgramURI: programURI, ProgramMetaData: metaData})
+		}
+		return nil, err
+	}
+	if source != nil {
+		tidyAlarmQueue(zp, existing)
+	}
+	return s.Alarm(alarm.ID)
+}
+
+// DeleteAlarm removes an alarm and the playlist made for it.
+func (s *Sonos) DeleteAlarm(id int) error {
+	existing, err := s.findAlarm(id)
+	if err != nil {
+		return err
+	}
+	zp, err := s.anyPlayer()
+	if err != nil {
+		return err
+	}
+	if _, err := zp.AlarmClock.DestroyAlarm(zp.HttpClient, &clk.DestroyAlarmArgs{ID: uint32(id)}); err != nil {
+		return err
+	}
+	tidyAlarmQueue(zp, existing)
+	return nil
+}
@@ -0,0 +1,240 @@
+package music
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/szatmary/sonos"
+	avtransport "github.com/szatmary/sonos/AVTransport"
+	ren "github.com/szatmary/sonos/RenderingControl"
+)
+
+var (
+	// ErrBadAnnouncement is returned for announcements with a volume a sonos can't be set to.
+	ErrBadAnnouncement = errors.New("bad announcement")
+	// ErrAnnouncing is returned when a group is already playing an announcement.
+	ErrAnnouncing = errors.New("already announcing")
+)
+
+const (
+	// the longest an announcement plays for before the group goes back to what it was playing, for
+	// clips whose length we don't know or that don't stop by themselves
+	sonosMaxAnnouncement = 5 * time.Minute
+	// how long a sonos has to start playing an announcement
+	sonosAnnounceStart = 10 * time.Second
+	// how often to check whether an announcement has finished
+	sonosAnnouncePoll = 500 * time.Millisecond
+)
+
+// Announcement is a short clip to interrupt a group with. Volume is the volume of every room in the
+// group while it plays, or nil to leave it alone, and Duration is how long the clip is if it is known.
+type Announcement struct {
+	URI      string
+	Title    string
+	Duration time.Duration
+	Volume   *int
+}
+
+// SonosSnapshot is what a group was playing and how loud each of its rooms was, so it can be put back.
+type SonosSnapshot struct {
+	coordinator   *sonos.ZonePlayer
+	uri, metaData string
+	track         int
+	relTime       string
+	playing       bool
+	rooms         []roomSnapshot
+}
+
+type roomSnapshot struct {
+	zp     *sonos.ZonePlayer
+	volume int
+	muted  bool
+}
+
+// Snapshot records what the group of a player is playing, where it is up to and the volume of each room.
+func (s *Sonos) Snapshot(zp *sonos.ZonePlayer) (*SonosSnapshot, error) {
+	coordinator := s.Coordinator(zp)
+	media, err := coordinator.AVTransport.GetMediaInfo(coordinator.HttpClient, &avtransport.GetMediaInfoArgs{InstanceID: 0})
+	if err != nil {
+		return nil, err
+	}
+	pos, err := coordinator.AVTransport.GetPositionInfo(coordinator.HttpClient, &avtransport.GetPositionInfoArgs{InstanceID: 0})
+	if err != nil {
+		return nil, err
+	}
+	transport, err := coordinator.AVTransport.GetTransportInfo(coordinator.HttpClient, &avtransport.GetTransportInfoArgs{InstanceID: 0})
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &SonosSnapshot{
+		coordinator: coordinator,
+		uri:         media.CurrentURI,
+		metaData:    media.CurrentURIMetaData,
+		track:       int(pos.Track),
+		relTime:     pos.RelTime,
+		playing:     transport.CurrentTransportState == "PLAYING" || transport.CurrentTransportState == "TRANSITIONING",
+	}
+	for _, member := range s.GroupMembers(coordinator) {
+		volume, err := member.GetVolume()
+		if err != nil {
+			return nil, err
+		}
+		mute, err := member.RenderingControl.GetMute(member.HttpClient, &ren.GetMuteArgs{InstanceID: 0, Channel: "Master"})
+		if err != nil {
+			return nil, err
+		}
+		snapshot.rooms = append(snapshot.rooms, roomSnapshot{zp: member, volume: volume, muted: mute.CurrentMute})
+	}
+	return snapshot, nil
+}
+
+// Restore puts a group back to what it was playing when the snapshot was taken, at the same place and
+// volume, and starts it playing again if it was.
+func (s *Sonos) Restore(snapshot *SonosSnapshot) error {
+	coordinator := snapshot.coordinator
+	if len(snapshot.uri) > 0 {
+		if _, err := coordinator.AVTransport.SetAVTransportURI(coordinator.HttpClient, &avtransport.SetAVTransportURIArgs{InstanceID: 0, CurrentURI: snapshot.uri, CurrentURIMetaData: snapshot.metaData}); err != nil {
+			return err
+		}
+		if strings.HasPrefix(snapshot.uri, "x-rincon-queue:") && snapshot.track > 0 {
+			if _, err := coordinator.AVTransport.Seek(coordinator.HttpClient, &avtransport.SeekArgs{InstanceID: 0, Unit: "TRACK_NR", Target: fmt.Sprint(snapshot.track)}); err != nil {
+				return err
+			}
+		}
+		if len(snapshot.relTime) > 0 && snapshot.relTime != "0:00:00" && snapshot.relTime != "NOT_IMPLEMENTED" {
+			// radio can't seek, which is fine as it carries on from now anyway
+			if _, err := coordinator.AVTransport.Seek(coordinator.HttpClient, &avtransport.SeekArgs{InstanceID: 0, Unit: "REL_TIME", Target: snapshot.relTime}); err != nil {
+				log.Printf("failed to seek %s back to %s: %v", coordinator.RoomName(), snapshot.relTime, err)
+			}
+		}
+	} else if _, err := coordinator.AVTransport.Stop(coordinator.HttpClient, &avtransport.StopArgs{InstanceID: 0}); err != nil {
+		return err
+	}
+	for _, room := range snapshot.rooms {
+		if err := room.zp.SetVolume(room.volume); err != nil {
+			return err
+		}
+		if err := s.SetMute(room.zp, room.muted); err != nil {
+			return err
+		}
+	}
+	if snapshot.playing && len(snapshot.uri) > 0 {
+		if _, err := coordinator.AVTransport.Play(coordinator.HttpClient, &avtransport.PlayArgs{InstanceID: 0, Speed: "1"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// announcementMetadata describes a clip to a sonos as a track.
+func announcementMetadata(announcement *Announcement) string {
+	escape := func(s string) string {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	mimeType := mime.TypeByExtension(path.Ext(announcement.URI))
+	if len(mimeType) == 0 {
+		mimeType = "audio/mpeg"
+	}
+	var duration string
+	if announcement.Duration > 0 {
+		secs := int(announcement.Duration.Round(time.Second).Seconds())
+		duration = fmt.Sprintf(` duration="%d:%02d:%02d"`, secs/(60*60), secs/60%60, secs%60)
+	}
+	return fmt.Sprintf("<DIDL-Lite xmlns:dc=\"http://purl.org/dc/elements/1.1/\" xmlns:upnp=\"urn:schemas-upnp-org:metadata-1-0/upnp/\" xmlns:r=\"urn:schemas-rinconnetworks-com:metadata-1-0/\" xmlns=\"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/\"><item id=\"-1\" parentID=\"-1\" restricted=\"true\"><res protocolInfo=\"http-get:*:%s:*\"%s>%s</res><dc:title>%s</dc:title><upnp:class>object.item.audioItem.musicTrack</upnp:class></item></DIDL-Lite>",
+		mimeType, duration, escape(announcement.URI), escape(announcement.Title))
+}
+
+// Announce interrupts the group of a player to play a clip, waits for it to finish and then puts back
+// what the group was playing.
+func (s *Sonos) Announce(zp *sonos.ZonePlayer, announcement Announcement) error {
+	if announcement.Volume != nil && (*announcement.Volume < 0 || *announcement.Volume > 100) {
+		return fmt.Errorf("%w: volume %d must be between 0 and 100", ErrBadAnnouncement, *announcement.Volume)
+	}
+	coordinator := s.Coordinator(zp)
+	room := coordinator.RoomName()
+	s.announcingMu.Lock()
+	if s.announcing[room] {
+		s.announcingMu.Unlock()
+		return fmt.Errorf("%w: %s", ErrAnnouncing, room)
+	}
+	if s.announcing == nil {
+		s.announcing = make(map[string]bool)
+	}
+	s.announcing[room] = true
+	s.announcingMu.Unlock()
+	defer func() {
+		s.announcingMu.Lock()
+		delete(s.announcing, room)
+		s.announcingMu.Unlock()
+	}()
+
+	snapshot, err := s.Snapshot(coordinator)
+	if err != nil {
+		return err
+	}
+	err = s.playAnnouncement(snapshot, &announcement)
+	if restoreErr := s.Restore(snapshot); restoreErr != nil {
+		log.Printf("failed to put back what %s was playing after an announcement: %v", room, restoreErr)
+		if err == nil {
+			err = restoreErr
+		}
+	}
+	return err
+}
+
+// playAnnouncement plays a clip on the group in a snapshot and waits for it to finish.
+func (s *Sonos) playAnnouncement(snapshot *SonosSnapshot, announcement *Announcement) error {
+	coordinator := snapshot.coordinator
+	if snapshot.playing {
+		// pausing first stops the group jumping to the clip half way through a word
+		coordinator.AVTransport.Pause(coordinator.HttpClient, &avtransport.PauseArgs{InstanceID: 0})
+	}
+	if announcement.Volume != nil {
+		for _, room := range snapshot.rooms {
+			if err := room.zp.SetVolume(*announcement.Volume); err != nil {
+				return err
+			}
+		}
+	}
+	for _, room := range snapshot.rooms {
+		if room.muted {
+			if err := s.SetMute(room.zp, false); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := coordinator.AVTransport.SetAVTransportURI(coordinator.HttpClient, &avtransport.SetAVTransportURIArgs{InstanceID: 0, CurrentURI: announcement.URI, CurrentURIMetaData: announcementMetadata(announcement)}); err != nil {
+		return err
+	}
+	if _, err := coordinator.AVTransport.Play(coordinator.HttpClient, &avtransport.PlayArgs{InstanceID: 0, Speed: "1"}); err != nil {
+		return err
+	}
+	start := time.Now()
+	end := start.Add(sonosMaxAnnouncement)
+	if announcement.Duration > 0 && announcement.Duration+sonosAnnounceStart < sonosMaxAnnouncement {
+		end = start.Add(announcement.Duration + sonosAnnounceStart)
+	}
+	started := false
+	for time.Now().Before(end) {
+		time.Sleep(sonosAnnouncePoll)
+		transport, err := coordinator.AVTransport.GetTransportInfo(coordinator.HttpClient, &avtransport.GetTransportInfoArgs{InstanceID: 0})
+		if err != nil {
+			return err
+		}
+		playing := transport.CurrentTransportState == "PLAYING" || transport.CurrentTransportState == "TRANSITIONING"
+		if playing {
+			started = true
+		} else if started || time.Since(start) > sonosAnnounceStart {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package music
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/szatmary/sonos"
+	ren "github.com/szatmary/sonos/RenderingControl"
+)
+
+// ErrBadEQ is returned when setting the bass or treble of a room beyond what a sonos allows.
+var ErrBadEQ = errors.New("bad eq")
+
+// bass and treble go from -10 to 10, with 0 flat
+const sonosMaxEQ = 10
+
+func checkEQ(name string, level int) error {
+	if level < -sonosMaxEQ || level > sonosMaxEQ {
+		return fmt.Errorf("%w: %s %d must be between %d and %d", ErrBadEQ, name, level, -sonosMaxEQ, sonosMaxEQ)
+	}
+	return nil
+}
+
+// SetMute mutes or unmutes one room, leaving the rest of its group playing.
+func (s *Sonos) SetMute(zp *sonos.ZonePlayer, muted bool) error {
+	_, err := zp.RenderingControl.SetMute(zp.HttpClient, &ren.SetMuteArgs{InstanceID: 0, Channel: "Master", DesiredMute: muted})
+	return err
+}
+
+// SetBass sets the bass of a room from -10 to 10.
+func (s *Sonos) SetBass(zp *sonos.ZonePlayer, bass int) error {
+	if err := checkEQ("bass", bass); err != nil {
+		return err
+	}
+	_, err := zp.RenderingControl.SetBass(zp.HttpClient, &ren.SetBassArgs{InstanceID: 0, DesiredBass: int16(bass)})
+	return err
+}
+
+// SetTreble sets the treble of a room from -10 to 10.
+func (s *Sonos) SetTreble(zp *sonos.ZonePlayer, treble int) error {
+	if err := checkEQ("treble", treble); err != nil {
+		return err
+	}
+	_, err := zp.RenderingControl.SetTreble(zp.HttpClient, &ren.SetTrebleArgs{InstanceID: 0, DesiredTreble: int16(treble)})
+	return err
+}
+
+// SetLoudness turns on or off the loudness of a room, which boosts the bass and treble at low volumes.
+func (s *Sonos) SetLoudness(zp *sonos.ZonePlayer, loudness bool) error {
+	_, err := zp.RenderingControl.SetLoudness(zp.HttpClient, &ren.SetLoudnessArgs{InstanceID: 0, Channel: "Master", DesiredLoudness: loudness})
+	return err
+}
@@ -0,0 +1,156 @@
+package music
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/szatmary/sonos"
+	avtransport "github.com/szatmary/sonos/AVTransport"
+	zgt "github.com/szatmary/sonos/ZoneGroupTopology"
+	"github.com/zanders3/music/pkg/sonosevs"
+)
+
+// ErrBadGroup is returned when joining a room to its own group.
+var ErrBadGroup = errors.New("bad group")
+
+// SonosGroup is a set of rooms playing the same music, controlled through the coordinator.
+type SonosGroup struct {
+	Coordinator string
+	Rooms       []string
+}
+
+// zoneGroupState reads the group topology from a sonos, which every player knows about.
+func zoneGroupState(zp *sonos.ZonePlayer) (*sonosevs.ZoneGroupState, error) {
+	res, err := zp.ZoneGroupTopology.GetZoneGroupState(zp.HttpClient, &zgt.GetZoneGroupStateArgs{})
+	if err != nil {
+		return nil, err
+	}
+	state := strings.TrimSpace(res.ZoneGroupState)
+	if strings.HasPrefix(state, "<ZoneGroups") {
+		state = "<ZoneGroupState>" + state + "</ZoneGroupState>"
+	}
+	var zoneGroups sonosevs.ZoneGroupState
+	if err := xml.Unmarshal([]byte(state), &zoneGroups); err != nil {
+		return nil, fmt.Errorf("bad zone group state from %s: %w", zp.RoomName(), err)
+	}
+	return &zoneGroups, nil
+}
+
+// playerUUID returns the RINCON_ id of a player used in the group topology.
+func playerUUID(zp *sonos.ZonePlayer) string {
+	return strings.TrimPrefix(zp.Root.Device.UDN, "uuid:")
+}
+
+// playerByUUID returns the zone player with a RINCON_ id.
+func (s *Sonos) playerByUUID(uuid string) *sonos.ZonePlayer {
+	s.ZonePlayersMu.RLock()
+	defer s.ZonePlayersMu.RUnlock()
+	for _, zp := range s.ZonePlayers {
+		if playerUUID(zp) == uuid {
+			return zp
+		}
+	}
+	return nil
+}
+
+// Groups returns the groups of rooms, sorted by coordinator.
+func (s *Sonos) Groups() ([]SonosGroup, error) {
+	s.ZonePlayersMu.RLock()
+	if len(s.ZonePlayers) == 0 {
+		s.ZonePlayersMu.RUnlock()
+		return []SonosGroup{}, nil
+	}
+	zp := s.ZonePlayers[0]
+	s.ZonePlayersMu.RUnlock()
+	state, err := zoneGroupState(zp)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]SonosGroup, 0, len(state.ZoneGroups))
+	for _, zoneGroup := range state.ZoneGroups {
+		var group SonosGroup
+		seen := make(map[string]bool)
+		for _, member := range zoneGroup.ZoneGroupMember {
+			// surrounds and subs bonded to a room are invisible members with the same room name
+			if member.Invisible == "1" || seen[member.ZoneName] {
+				continue
+			}
+			seen[member.ZoneName] = true
+			group.Rooms = append(group.Rooms, member.ZoneName)
+			if member.UUID == zoneGroup.Coordinator {
+				group.Coordinator = member.ZoneName
+			}
+		}
+		if len(group.Rooms) == 0 {
+			continue
+		}
+		sort.Strings(group.Rooms)
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Coordinator < groups[j].Coordinator })
+	return groups, nil
+}
+
+// Coordinator returns the player coordinating the group a player is in, which must be sent transport
+// commands such as play and changes to the queue. Returns the player itself if it can't be found.
+func (s *Sonos) Coordinator(zp *sonos.ZonePlayer) *sonos.ZonePlayer {
+	state, err := zoneGroupState(zp)
+	if err != nil {
+		return zp
+	}
+	for _, zoneGroup := range state.ZoneGroups {
+		for _, member := range zoneGroup.ZoneGroupMember {
+			if member.UUID == playerUUID(zp) {
+				if coordinator := s.playerByUUID(zoneGroup.Coordinator); coordinator != nil {
+					return coordinator
+				}
+				return zp
+			}
+		}
+	}
+	return zp
+}
+
+// JoinGroup adds a player to the group another player is in.
+func (s *Sonos) JoinGroup(zp, other *sonos.ZonePlayer) error {
+	coordinator := s.Coordinator(other)
+	if playerUUID(coordinator) == playerUUID(zp) {
+		return fmt.Errorf("%w: %s is already the coordinator", ErrBadGroup, zp.RoomName())
+	}
+	s.stopQueueing(zp.RoomName())
+	_, err := zp.AVTransport.SetAVTransportURI(zp.HttpClient, &avtransport.SetAVTransportURIArgs{InstanceID: 0, CurrentURI: "x-rincon:" + playerUUID(coordinator)})
+	return err
+}
+
+// LeaveGroup takes a player out of its group so it plays on its own.
+func (s *Sonos) LeaveGroup(zp *sonos.ZonePlayer) error {
+	_, err := zp.AVTransport.BecomeCoordinatorOfStandaloneGroup(zp.HttpClient, &avtransport.BecomeCoordinatorOfStandaloneGroupArgs{InstanceID: 0})
+	return err
+}
+
+// PartyMode adds every other room to the group a player is in.
+func (s *Sonos) PartyMode(zp *sonos.ZonePlayer) error {
+	state, err := zoneGroupState(zp)
+	if err != nil {
+		return err
+	}
+	coordinator := s.Coordinator(zp)
+	for _, zoneGroup := range state.ZoneGroups {
+		if zoneGroup.Coordinator == playerUUID(coordinator) {
+			continue
+		}
+		for _, member := range zoneGroup.ZoneGroupMember {
+			other := s.playerByUUID(member.UUID)
+			if member.Invisible == "1" || other == nil {
+				continue
+			}
+			if _, err := other.AVTransport.SetAVTransportURI(other.HttpClient, &avtransport.SetAVTransportURIArgs{InstanceID: 0, CurrentURI: "x-rincon:" + playerUUID(coordinator)}); err != nil {
+				return fmt.Errorf("failed to add %s to the group: %w", other.RoomName(), err)
+			}
+		}
+	}
+	return nil
+}
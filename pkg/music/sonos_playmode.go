@@ -0,0 +1,35 @@
+package music
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/szatmary/sonos"
+	avtransport "github.com/szatmary/sonos/AVTransport"
+)
+
+// ErrBadPlayMode is returned when setting a play mode a sonos doesn't have.
+var ErrBadPlayMode = errors.New("bad play mode")
+
+// PlayModes are the ways a sonos can play its queue, combining shuffle with repeating the queue or one track.
+var PlayModes = []string{"NORMAL", "REPEAT_ALL", "REPEAT_ONE", "SHUFFLE_NOREPEAT", "SHUFFLE", "SHUFFLE_REPEAT_ONE"}
+
+// SetPlayMode shuffles or repeats the queue of a sonos, which must be the coordinator of its group.
+func (s *Sonos) SetPlayMode(zp *sonos.ZonePlayer, mode string) error {
+	found := false
+	for _, playMode := range PlayModes {
+		found = found || playMode == mode
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", ErrBadPlayMode, mode)
+	}
+	_, err := zp.AVTransport.SetPlayMode(zp.HttpClient, &avtransport.SetPlayModeArgs{InstanceID: 0, NewPlayMode: mode})
+	return err
+}
+
+// SetCrossfade turns crossfading between tracks on or off for a sonos, which must be the coordinator
+// of its group.
+func (s *Sonos) SetCrossfade(zp *sonos.ZonePlayer, crossfade bool) error {
+	_, err := zp.AVTransport.SetCrossfadeMode(zp.HttpClient, &avtransport.SetCrossfadeModeArgs{InstanceID: 0, CrossfadeMode: crossfade})
+	return err
+}
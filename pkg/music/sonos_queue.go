@@ -0,0 +1,320 @@
+package music
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/szatmary/sonos"
+	avtransport "github.com/szatmary/sonos/AVTransport"
+	dir "github.com/szatmary/sonos/ContentDirectory"
+	"github.com/zanders3/music/pkg/sonosevs"
+)
+
+// ErrBadQueue is returned when changing a queue with positions that don't exist.
+var ErrBadQueue = errors.New("bad queue position")
+
+// sonosQueueBatch is the most tracks a sonos accepts in one AddMultipleURIsToQueue call.
+const sonosQueueBatch = 16
+
+// QueueTrack is a song to add to the queue of a sonos with its DIDL-Lite metadata.
+type QueueTrack struct {
+	URI, MetaData string
+}
+
+// QueuedTrack is a track in the queue of a sonos. Position counts from 1.
+type QueuedTrack struct {
+	Position             int
+	URI                  string
+	Title, Artist, Album string
+	Duration             string `json:",omitempty"`
+	AlbumArtURI          string `json:",omitempty"`
+}
+
+// SonosQueue is part of the queue of a sonos. Current is the position of the playing track, or zero
+// if the sonos isn't playing from its queue.
+type SonosQueue struct {
+	Tracks         []QueuedTrack
+	Total, Current int
+}
+
+// QueueProgress is how many tracks have been added to a queue that is still being filled.
+type QueueProgress struct {
+	Queued, Total int
+}
+
+// queueJob fills the rest of a queue in the background until it is done or cancelled.
+type queueJob struct {
+	cancel, done chan struct{}
+	progress     QueueProgress
+}
+
+// addToQueue adds a batch of tracks to the queue of a sonos at a position, or the end if it is zero.
+func addToQueue(zp *sonos.ZonePlayer, tracks []QueueTrack, position int) error {
+	uris := make([]string, len(tracks))
+	metaData := make([]string, len(tracks))
+	for idx, track := range tracks {
+		uris[idx], metaData[idx] = track.URI, track.MetaData
+	}
+	_, err := zp.AVTransport.AddMultipleURIsToQueue(zp.HttpClient, &avtransport.AddMultipleURIsToQueueArgs{
+		InstanceID:                      0,
+		NumberOfURIs:                    uint32(len(tracks)),
+		EnqueuedURIs:                    strings.Join(uris, " "),
+		EnqueuedURIsMetaData:            strings.Join(metaData, " "),
+		DesiredFirstTrackNumberEnqueued: uint32(position),
+	})
+	return err
+}
+
+// stopQueueing cancels any queue still being filled for a room and waits for it to stop.
+func (s *Sonos) stopQueueing(room string) {
+	s.queueJobsMu.Lock()
+	job := s.queueJobs[room]
+	delete(s.queueJobs, room)
+	s.queueJobsMu.Unlock()
+	if job != nil {
+		close(job.cancel)
+		<-job.done
+	}
+}
+
+// SonosAlbumArtURI returns the address of album art from the metadata of a track, which is relative
+// to the sonos when it serves the art itself.
+func SonosAlbumArtURI(zp *sonos.ZonePlayer, uri string) string {
+	if len(uri) == 0 || strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://") {
+		return uri
+	}
+	return "http://" + zp.AVTransport.ControlEndpoint.Host + uri
+}
+
+// queueURI is the transport URI that plays the queue of a sonos.
+func queueURI(zp *sonos.ZonePlayer) string {
+	return "x-rincon-queue:" + strings.TrimPrefix(zp.Root.Device.UDN, "uuid:") + "#0"
+}
+
+// playQueue switches a sonos over to its queue if it was playing something else and plays from a track.
+func playQueue(zp *sonos.ZonePlayer, track int) error {
+	media, err := zp.AVTransport.GetMediaInfo(zp.HttpClient, &avtransport.GetMediaInfoArgs{InstanceID: 0})
+	if err != nil {
+		return err
+	}
+	if media.CurrentURI != queueURI(zp) {
+		if _, err := zp.AVTransport.SetAVTransportURI(zp.HttpClient, &avtransport.SetAVTransportURIArgs{InstanceID: 0, CurrentURI: queueURI(zp)}); err != nil {
+			return err
+		}
+	}
+	if _, err := zp.AVTransport.Seek(zp.HttpClient, &avtransport.SeekArgs{InstanceID: 0, Unit: "TRACK_NR", Target: strconv.Itoa(track)}); err != nil {
+		return err
+	}
+	_, err = zp.AVTransport.Play(zp.HttpClient, &avtransport.PlayArgs{InstanceID: 0, Speed: "1"})
+	return err
+}
+
+// QueueTracks replaces the queue of a sonos with the tracks and starts playing from startIdx. The
+// tracks up to startIdx are added straight away in batches and the rest in the background, so long
+// albums and whole artists start playing quickly.
+func (s *Sonos) QueueTracks(zp *sonos.ZonePlayer, tracks []QueueTrack, startIdx int) error {
+	if startIdx < 0 || startIdx >= len(tracks) {
+		startIdx = 0
+	}
+	room := zp.RoomName()
+	s.stopQueueing(room)
+	if _, err := zp.AVTransport.RemoveAllTracksFromQueue(zp.HttpClient, &avtransport.RemoveAllTracksFromQueueArgs{InstanceID: 0}); err != nil {
+		return err
+	}
+	queued := 0
+	for queued <= startIdx && queued < len(tracks) {
+		end := queued + sonosQueueBatch
+		if end > len(tracks) {
+			end = len(tracks)
+		}
+		if err := addToQueue(zp, tracks[queued:end], 0); err != nil {
+			return err
+		}
+		queued = end
+	}
+	if err := playQueue(zp, startIdx+1); err != nil {
+		return err
+	}
+	if queued == len(tracks) {
+		return nil
+	}
+
+	job := &queueJob{cancel: make(chan struct{}), done: make(chan struct{}), progress: QueueProgress{Queued: queued, Total: len(tracks)}}
+	s.queueJobsMu.Lock()
+	if s.queueJobs == nil {
+		s.queueJobs = make(map[string]*queueJob)
+	}
+	s.queueJobs[room] = job
+	s.queueJobsMu.Unlock()
+	go func() {
+		defer close(job.done)
+		defer func() {
+			s.queueJobsMu.Lock()
+			if s.queueJobs[room] == job {
+				delete(s.queueJobs, room)
+			}
+			s.queueJobsMu.Unlock()
+		}()
+		for queued < len(tracks) {
+			select {
+			case <-job.cancel:
+				return
+			default:
+			}
+			end := queued + sonosQueueBatch
+			if end > len(tracks) {
+				end = len(tracks)
+			}
+			if err := addToQueue(zp, tracks[queued:end], 0); err != nil {
+				log.Printf("failed to queue tracks %d-%d of %d on %s: %v", queued+1, end, len(tracks), room, err)
+				return
+			}
+			queued = end
+			s.queueJobsMu.Lock()
+			job.progress.Queued = queued
+			s.queueJobsMu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// QueueProgress returns how far through filling its queue a room is, or nil if it isn't.
+func (s *Sonos) QueueProgress(room string) *QueueProgress {
+	s.queueJobsMu.Lock()
+	defer s.queueJobsMu.Unlock()
+	job, ok := s.queueJobs[room]
+	if !ok {
+		return nil
+	}
+	progress := job.progress
+	return &progress
+}
+
+// currentTrack returns the position of the playing track in the queue, or zero if the sonos isn't
+// playing its queue.
+func currentTrack(zp *sonos.ZonePlayer) (int, error) {
+	media, err := zp.AVTransport.GetMediaInfo(zp.HttpClient, &avtransport.GetMediaInfoArgs{InstanceID: 0})
+	if err != nil {
+		return 0, err
+	}
+	if media.CurrentURI != queueURI(zp) {
+		return 0, nil
+	}
+	pos, err := zp.AVTransport.GetPositionInfo(zp.HttpClient, &avtransport.GetPositionInfoArgs{InstanceID: 0})
+	if err != nil {
+		return 0, err
+	}
+	return int(pos.Track), nil
+}
+
+// Queue returns up to count tracks from the queue of a sonos starting at a position.
+func (s *Sonos) Queue(zp *sonos.ZonePlayer, start, count int) (*SonosQueue, error) {
+	if start < 1 {
+		start = 1
+	}
+	queue := &SonosQueue{Tracks: []QueuedTrack{}}
+	for count > 0 {
+		// a sonos returns at most 100 tracks at a time
+		requested := count
+		if requested > 100 {
+			requested = 100
+		}
+		res, err := zp.ContentDirectory.Browse(zp.HttpClient, &dir.BrowseArgs{
+			ObjectID:       "Q:0",
+			BrowseFlag:     "BrowseDirectChildren",
+			Filter:         "dc:title,res,dc:creator,upnp:album,upnp:albumArtURI",
+			StartingIndex:  uint32(start - 1),
+			RequestedCount: uint32(requested),
+		})
+		if err != nil {
+			return nil, err
+		}
+		var didl sonosevs.DIDLLiteList
+		if err := xml.Unmarshal([]byte(res.Result), &didl); err != nil {
+			return nil, fmt.Errorf("bad queue from %s: %w", zp.RoomName(), err)
+		}
+		for idx, item := range didl.Items {
+			queue.Tracks = append(queue.Tracks, QueuedTrack{
+				Position: start + idx,
+				URI:      item.Res.Text,
+				Title:    item.Title, Artist: item.Creator, Album: item.Album,
+				Duration:    item.Res.Duration,
+				AlbumArtURI: SonosAlbumArtURI(zp, item.AlbumArtURI),
+			})
+		}
+		queue.Total = int(res.TotalMatches)
+		start += len(didl.Items)
+		count -= len(didl.Items)
+		if len(didl.Items) == 0 || start > queue.Total {
+			break
+		}
+	}
+	current, err := currentTrack(zp)
+	if err != nil {
+		return nil, err
+	}
+	queue.Current = current
+	return queue, nil
+}
+
+// AddTracks adds tracks to the end of the queue of a sonos, or after the playing track if next is set.
+func (s *Sonos) AddTracks(zp *sonos.ZonePlayer, tracks []QueueTrack, next bool) error {
+	position := 0
+	if next {
+		current, err := currentTrack(zp)
+		if err != nil {
+			return err
+		}
+		if current > 0 {
+			position = current + 1
+		}
+	}
+	for start := 0; start < len(tracks); start += sonosQueueBatch {
+		end := start + sonosQueueBatch
+		if end > len(tracks) {
+			end = len(tracks)
+		}
+		batchPosition := 0
+		if position > 0 {
+			batchPosition = position + start
+		}
+		if err := addToQueue(zp, tracks[start:end], batchPosition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MoveTracks moves count tracks starting at a position in the queue of a sonos to before another position.
+func (s *Sonos) MoveTracks(zp *sonos.ZonePlayer, start, count, before int) error {
+	if start < 1 || count < 1 || before < 1 {
+		return fmt.Errorf("%w: positions start at 1", ErrBadQueue)
+	}
+	_, err := zp.AVTransport.ReorderTracksInQueue(zp.HttpClient, &avtransport.ReorderTracksInQueueArgs{
+		InstanceID: 0, StartingIndex: uint32(start), NumberOfTracks: uint32(count), InsertBefore: uint32(before),
+	})
+	return err
+}
+
+// RemoveTracks removes count tracks starting at a position from the queue of a sonos.
+func (s *Sonos) RemoveTracks(zp *sonos.ZonePlayer, start, count int) error {
+	if start < 1 || count < 1 {
+		return fmt.Errorf("%w: positions start at 1", ErrBadQueue)
+	}
+	_, err := zp.AVTransport.RemoveTrackRangeFromQueue(zp.HttpClient, &avtransport.RemoveTrackRangeFromQueueArgs{
+		InstanceID: 0, StartingIndex: uint32(start), NumberOfTracks: uint32(count),
+	})
+	return err
+}
+
+// PlayTrack plays the queue of a sonos from a position.
+func (s *Sonos) PlayTrack(zp *sonos.ZonePlayer, track int) error {
+	if track < 1 {
+		return fmt.Errorf("%w: positions start at 1", ErrBadQueue)
+	}
+	return playQueue(zp, track)
+}
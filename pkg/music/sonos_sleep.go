@@ -0,0 +1,145 @@
+package music
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/szatmary/sonos"
+	avtransport "github.com/szatmary/sonos/AVTransport"
+)
+
+// ErrBadSleepTimer is returned for sleep timers that are negative or longer than a sonos allows.
+var ErrBadSleepTimer = errors.New("bad sleep timer")
+
+const (
+	// a sonos sleep timer has to be less than a day
+	sonosMaxSleep = 24 * time.Hour
+	// a fading sleep timer starts turning the volume down this long before it ends
+	sonosSleepFade = 30 * time.Second
+)
+
+// SleepTimer is how long a sonos has left before it stops playing, as H:MM:SS, and whether it will
+// fade out first. Remaining is empty when there is no sleep timer.
+type SleepTimer struct {
+	Remaining string
+	Fade      bool
+}
+
+// sleepJob fades out the rooms of a group before its sleep timer ends.
+type sleepJob struct {
+	cancel, done chan struct{}
+}
+
+// stopSleepFade cancels any fade out waiting for a room's sleep timer and waits for it to stop.
+func (s *Sonos) stopSleepFade(room string) {
+	s.sleepJobsMu.Lock()
+	job := s.sleepJobs[room]
+	delete(s.sleepJobs, room)
+	s.sleepJobsMu.Unlock()
+	if job != nil {
+		close(job.cancel)
+		<-job.done
+	}
+}
+
+// SetSleepTimer stops a sonos playing after a while, or cancels its sleep timer if the duration is
+// zero. If fade is set the volume of each room in the group is turned down a step at a time over the
+// last 30 seconds, or all of a shorter timer, and put back once it has stopped. zp must be the
+// coordinator of its group.
+func (s *Sonos) SetSleepTimer(zp *sonos.ZonePlayer, duration time.Duration, fade bool) error {
+	if duration < 0 || duration >= sonosMaxSleep {
+		return fmt.Errorf("%w: %s must be between 0 and 24 hours", ErrBadSleepTimer, duration)
+	}
+	room := zp.RoomName()
+	s.stopSleepFade(room)
+	var sleep string
+	if duration > 0 {
+		secs := int(duration.Seconds())
+		sleep = fmt.Sprintf("%02d:%02d:%02d", secs/(60*60), secs/60%60, secs%60)
+	}
+	// the sonos stops by itself, so the timer still works if the server goes away
+	if _, err := zp.AVTransport.ConfigureSleepTimer(zp.HttpClient, &avtransport.ConfigureSleepTimerArgs{InstanceID: 0, NewSleepTimerDuration: sleep}); err != nil {
+		return err
+	}
+	if duration == 0 || !fade {
+		return nil
+	}
+
+	job := &sleepJob{cancel: make(chan struct{}), done: make(chan struct{})}
+	s.sleepJobsMu.Lock()
+	if s.sleepJobs == nil {
+		s.sleepJobs = make(map[string]*sleepJob)
+	}
+	s.sleepJobs[room] = job
+	s.sleepJobsMu.Unlock()
+	go func() {
+		defer close(job.done)
+		defer func() {
+			s.sleepJobsMu.Lock()
+			if s.sleepJobs[room] == job {
+				delete(s.sleepJobs, room)
+			}
+			s.sleepJobsMu.Unlock()
+		}()
+		end := time.Now().Add(duration)
+		fadeOver := sonosSleepFade
+		if duration < fadeOver {
+			fadeOver = duration
+		}
+		select {
+		case <-time.After(time.Until(end.Add(-fadeOver))):
+		case <-job.cancel:
+			return
+		}
+		// turn every room down together so they reach silence as the sonos stops
+		members := s.GroupMembers(zp)
+		volumes := make([]int, len(members))
+		var fades sync.WaitGroup
+		for idx, member := range members {
+			volume, err := member.GetVolume()
+			if err != nil {
+				log.Printf("failed to fade out %s: %v", member.RoomName(), err)
+				volume = -1
+			} else {
+				fades.Add(1)
+				go func(member *sonos.ZonePlayer) {
+					defer fades.Done()
+					if err := s.FadeVolume(member, 0, time.Until(end), job.cancel); err != nil {
+						log.Printf("failed to fade out %s: %v", member.RoomName(), err)
+					}
+				}(member)
+			}
+			volumes[idx] = volume
+		}
+		fades.Wait()
+		// give the sonos a moment to stop before turning the volume back up for next time
+		select {
+		case <-time.After(time.Until(end.Add(2 * time.Second))):
+		case <-job.cancel:
+		}
+		for idx, member := range members {
+			if volumes[idx] < 0 {
+				continue
+			}
+			if err := member.SetVolume(volumes[idx]); err != nil {
+				log.Printf("failed to put the volume of %s back after its sleep timer: %v", member.RoomName(), err)
+			}
+		}
+	}()
+	return nil
+}
+
+// SleepTimer returns how long a sonos has left before it stops playing. zp must be the coordinator of its group.
+func (s *Sonos) SleepTimer(zp *sonos.ZonePlayer) (*SleepTimer, error) {
+	res, err := zp.AVTransport.GetRemainingSleepTimerDuration(zp.HttpClient, &avtransport.GetRemainingSleepTimerDurationArgs{InstanceID: 0})
+	if err != nil {
+		return nil, err
+	}
+	s.sleepJobsMu.Lock()
+	_, fade := s.sleepJobs[zp.RoomName()]
+	s.sleepJobsMu.Unlock()
+	return &SleepTimer{Remaining: res.RemainingSleepTimerDuration, Fade: fade && len(res.RemainingSleepTimerDuration) > 0}, nil
+}
@@ -0,0 +1,66 @@
+package music
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zanders3/music/pkg/sonosfake"
+)
+
+func TestSleepTimerFade(t *testing.T) {
+	network := sonosfake.NewNetwork()
+	defer network.Close()
+	office, err := network.Add("Office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSonos()
+	if err := s.AddPlayer(office.URL()); err != nil {
+		t.Fatal(err)
+	}
+	zp := s.Player("Office")
+	// watchVolume returns each volume the room goes through until stop returns true
+	watchVolume := func(stop func(volumes []int) bool) []int {
+		var volumes []int
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if volume, _ := office.Volume(); len(volumes) == 0 || volumes[len(volumes)-1] != volume {
+				volumes = append(volumes, volume)
+			}
+			if stop(volumes) {
+				return volumes
+			}
+		}
+		t.Fatalf("timed out with volumes %v", volumes)
+		return nil
+	}
+
+	// a timer shorter than the fade fades out over all of it, no faster than a step a second
+	if err := s.SetSleepTimer(zp, 3*time.Second, true); err != nil {
+		t.Fatal(err)
+	}
+	volumes := watchVolume(func(volumes []int) bool {
+		return len(volumes) > 1 && volumes[len(volumes)-1] == 20
+	})
+	if want := []int{20, 10, 0, 20}; !reflect.DeepEqual(volumes, want) {
+		t.Errorf("got volumes %v while sleeping, want %v", volumes, want)
+	}
+
+	// cancelling the timer part way through the fade puts the volume back straight away
+	if err := s.SetSleepTimer(zp, 3*time.Second, true); err != nil {
+		t.Fatal(err)
+	}
+	watchVolume(func(volumes []int) bool {
+		return volumes[len(volumes)-1] == 10
+	})
+	start := time.Now()
+	if err := s.SetSleepTimer(zp, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("cancelling the fade took %s", took)
+	}
+	if volume, _ := office.Volume(); volume != 20 {
+		t.Errorf("got volume %d after cancelling, want 20", volume)
+	}
+}
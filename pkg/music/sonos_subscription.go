@@ -145,12 +145,12 @@ func (s *Subscriptions) Subscribe(eventUrl *url.URL, unsubscribe chan struct{},
 				}
 				log.Printf("%s subscribe succeeded with sid %s and timeout %s", eventUrl.String(), sid, timeout.String())
 				s.subsMu.Lock()
-				s.subs[eventUrl.String()].sid = sid
+				sub.sid = sid
 				s.subsMu.Unlock()
 
 				select {
 				case <-time.After(timeout - 4*time.Second):
-				case <-unsubscribe:
+				case <-sub.shutdown:
 					log.Printf("unsubscribing %s", eventUrl.String())
 					req, err := http.NewRequest("UNSUBSCRIBE", eventUrl.String(), http.NoBody)
 					if err != nil {
@@ -0,0 +1,132 @@
+package music
+
+import (
+	"sort"
+	"time"
+
+	"github.com/szatmary/sonos"
+	rcg "github.com/szatmary/sonos/GroupRenderingControl"
+	ren "github.com/szatmary/sonos/RenderingControl"
+)
+
+// RoomVolume is the volume of one room in a group.
+type RoomVolume struct {
+	Room   string
+	Volume int
+	Muted  bool
+}
+
+// GroupVolume is the volume of a group, which is the average of its rooms, and the volume of each room.
+type GroupVolume struct {
+	Volume int
+	Muted  bool
+	Rooms  []RoomVolume
+}
+
+// GroupMembers returns the players in the same group as a player, including itself and the
+// coordinator.
+func (s *Sonos) GroupMembers(zp *sonos.ZonePlayer) []*sonos.ZonePlayer {
+	state, err := zoneGroupState(zp)
+	if err != nil {
+		return []*sonos.ZonePlayer{zp}
+	}
+	for _, zoneGroup := range state.ZoneGroups {
+		members := make([]*sonos.ZonePlayer, 0, len(zoneGroup.ZoneGroupMember))
+		found := false
+		for _, member := range zoneGroup.ZoneGroupMember {
+			found = found || member.UUID == playerUUID(zp)
+			if other := s.playerByUUID(member.UUID); other != nil && member.Invisible != "1" {
+				members = append(members, other)
+			}
+		}
+		if found {
+			sort.Slice(members, func(i, j int) bool { return members[i].RoomName() < members[j].RoomName() })
+			return members
+		}
+	}
+	return []*sonos.ZonePlayer{zp}
+}
+
+// GroupVolumes reads the volume of a group from its coordinator and the volume of each member.
+func GroupVolumes(coordinator *sonos.ZonePlayer, members []*sonos.ZonePlayer) (*GroupVolume, error) {
+	volume, err := coordinator.GroupRenderingControl.GetGroupVolume(coordinator.HttpClient, &rcg.GetGroupVolumeArgs{InstanceID: 0})
+	if err != nil {
+		return nil, err
+	}
+	mute, err := coordinator.GroupRenderingControl.GetGroupMute(coordinator.HttpClient, &rcg.GetGroupMuteArgs{InstanceID: 0})
+	if err != nil {
+		return nil, err
+	}
+	groupVolume := &GroupVolume{Volume: int(volume.CurrentVolume), Muted: mute.CurrentMute, Rooms: make([]RoomVolume, 0, len(members))}
+	for _, member := range members {
+		volume, err := member.GetVolume()
+		if err != nil {
+			return nil, err
+		}
+		mute, err := member.RenderingControl.GetMute(member.HttpClient, &ren.GetMuteArgs{InstanceID: 0, Channel: "Master"})
+		if err != nil {
+			return nil, err
+		}
+		groupVolume.Rooms = append(groupVolume.Rooms, RoomVolume{Room: member.RoomName(), Volume: volume, Muted: mute.CurrentMute})
+	}
+	return groupVolume, nil
+}
+
+// SetGroupVolume sets the volume of the group a player is in, keeping the rooms at the same volume
+// relative to each other.
+func (s *Sonos) SetGroupVolume(zp *sonos.ZonePlayer, volume int) error {
+	coordinator := s.Coordinator(zp)
+	if _, err := coordinator.GroupRenderingControl.SnapshotGroupVolume(coordinator.HttpClient, &rcg.SnapshotGroupVolumeArgs{InstanceID: 0}); err != nil {
+		return err
+	}
+	_, err := coordinator.GroupRenderingControl.SetGroupVolume(coordinator.HttpClient, &rcg.SetGroupVolumeArgs{InstanceID: 0, DesiredVolume: uint16(volume)})
+	return err
+}
+
+// AdjustGroupVolume turns the volume of the group a player is in up or down.
+func (s *Sonos) AdjustGroupVolume(zp *sonos.ZonePlayer, adjustment int) error {
+	coordinator := s.Coordinator(zp)
+	if _, err := coordinator.GroupRenderingControl.SnapshotGroupVolume(coordinator.HttpClient, &rcg.SnapshotGroupVolumeArgs{InstanceID: 0}); err != nil {
+		return err
+	}
+	_, err := coordinator.GroupRenderingControl.SetRelativeGroupVolume(coordinator.HttpClient, &rcg.SetRelativeGroupVolumeArgs{InstanceID: 0, Adjustment: int32(adjustment)})
+	return err
+}
+
+// SetGroupMute mutes or unmutes every room in the group a player is in.
+func (s *Sonos) SetGroupMute(zp *sonos.ZonePlayer, muted bool) error {
+	coordinator := s.Coordinator(zp)
+	_, err := coordinator.GroupRenderingControl.SetGroupMute(coordinator.HttpClient, &rcg.SetGroupMuteArgs{InstanceID: 0, DesiredMute: muted})
+	return err
+}
+
+// FadeVolume turns the volume of a room up or down to volume a step at a time, taking about as long as over.
+// It stops where it has got to if cancel is closed, which can be nil for fades that always finish.
+func (s *Sonos) FadeVolume(zp *sonos.ZonePlayer, volume int, over time.Duration, cancel <-chan struct{}) error {
+	from, err := zp.GetVolume()
+	if err != nil {
+		return err
+	}
+	steps := volume - from
+	if steps < 0 {
+		steps = -steps
+	}
+	// no faster than a step a second, so the sonos isn't flooded with requests
+	if max := int(over / time.Second); steps > max {
+		steps = max
+	}
+	for step := 1; step <= steps; step++ {
+		select {
+		case <-time.After(over / time.Duration(steps)):
+		case <-cancel:
+			return nil
+		}
+		if err := zp.SetVolume(from + (volume-from)*step/steps); err != nil {
+			return err
+		}
+	}
+	if steps == 0 && volume != from {
+		return zp.SetVolume(volume)
+	}
+	return nil
+}
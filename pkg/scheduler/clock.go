@@ -0,0 +1,21 @@
+package scheduler
+
+import "time"
+
+// Clock tells the scheduler the time, so a test can move it along rather than waiting.
+type Clock interface {
+	Now() time.Time
+	// After sends the time once d has passed, like time.After.
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the real time.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,202 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBadSchedule is returned for cron expressions that can't be parsed.
+var ErrBadSchedule = errors.New("bad schedule")
+
+// macros are shorthands for common schedules.
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// field is one of the five fields of a cron expression, with its range and the names it can use.
+type field struct {
+	name     string
+	min, max int
+	names    []string
+	// the value the first name stands for
+	namesFrom int
+}
+
+var fields = []field{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: monthNames, namesFrom: 1},
+	// 7 is Sunday too
+	{name: "day of week", min: 0, max: 7, names: dayNames},
+}
+
+// Schedule is a parsed cron expression of minute, hour, day of month, month and day of week, in the
+// local time of the server. Each field is *, a number or name, a range such as 1-5 or mon-fri, a step
+// such as */15 or a comma separated list of them. @hourly, @daily, @weekly, @monthly and @yearly are
+// shorthands for the usual schedules.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// when both days are restricted a day matching either runs, like cron
+	domStar, dowStar bool
+}
+
+// ParseSchedule parses a cron expression such as "0 7 * * mon-fri".
+func ParseSchedule(expr string) (*Schedule, error) {
+	expr = strings.ToLower(strings.TrimSpace(expr))
+	if macro, ok := macros[expr]; ok {
+		expr = macro
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("%w: %q needs 5 fields of minute, hour, day of month, month and day of week", ErrBadSchedule, expr)
+	}
+	bits := make([]uint64, len(fields))
+	for idx, part := range parts {
+		var err error
+		if bits[idx], err = fields[idx].parse(part); err != nil {
+			return nil, err
+		}
+	}
+	dow := bits[4]
+	if dow&(1<<7) != 0 {
+		dow |= 1
+	}
+	return &Schedule{
+		minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: dow,
+		domStar: parts[2] == "*", dowStar: parts[4] == "*",
+	}, nil
+}
+
+// parse returns the values a field matches as bits.
+func (f field) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("%w: bad step %q in %s", ErrBadSchedule, stepStr, f.name)
+			}
+		}
+		start, end := f.min, f.max
+		if rng != "*" {
+			startStr, endStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if start, err = f.value(startStr); err != nil {
+				return 0, err
+			}
+			end = start
+			if isRange {
+				if end, err = f.value(endStr); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// 5/15 means from 5 every 15
+				end = f.max
+			}
+			if end < start {
+				return 0, fmt.Errorf("%w: %q goes backwards in %s", ErrBadSchedule, rng, f.name)
+			}
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// value parses a number or name in a field.
+func (f field) value(s string) (int, error) {
+	for idx, name := range f.names {
+		if s == name {
+			return f.namesFrom + idx, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%w: %q is not a %s from %d to %d", ErrBadSchedule, s, f.name, f.min, f.max)
+	}
+	return v, nil
+}
+
+// everyHour is the hour field of a schedule that runs in every hour.
+const everyHour = 1<<24 - 1
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<t.Day()) != 0
+	dowMatch := s.dow&(1<<t.Weekday()) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+func (s *Schedule) matches(t time.Time) bool {
+	return s.month&(1<<t.Month()) != 0 && s.dayMatches(t) && s.hour&(1<<t.Hour()) != 0 && s.minute&(1<<t.Minute()) != 0
+}
+
+// wallClock is the time t shows on the clock, as if there were no daylight saving.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+// skipped reports whether the schedule runs at a time the clocks skipped between from and to, such
+// as 1:30 when they go forward from 1:00 to 2:00.
+func (s *Schedule) skipped(from, to time.Time) bool {
+	for w := wallClock(from).Add(to.Sub(from)); w.Before(wallClock(to)); w = w.Add(time.Minute) {
+		if s.matches(w) {
+			return true
+		}
+	}
+	return false
+}
+
+// repeated reports whether the clocks showed the same time an hour before t, as they do for an hour
+// when they go back.
+func repeated(t time.Time) bool {
+	return wallClock(t.Add(-time.Hour)).Equal(wallClock(t))
+}
+
+// Next returns the first time after t the schedule runs, or the zero time if it never does, such as
+// on the 31st of February. Like cron, a time skipped as the clocks go forward runs once they have, and
+// when they go back a schedule at set hours only runs the first time an hour comes round.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// a schedule that can run at all runs within a few years, as the 29th of February comes round every 4
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		var next time.Time
+		switch {
+		case s.month&(1<<t.Month()) == 0:
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			// count the minutes to the next hour, as the hour by the clock may not exist or come twice
+			next = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case s.minute&(1<<t.Minute()) == 0 || (s.hour != everyHour && repeated(t)):
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+		if s.skipped(t, next) {
+			return next
+		}
+		t = next
+	}
+	return time.Time{}
+}
@@ -0,0 +1,93 @@
+package scheduler
+
+import (
+	"errors"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"0 7 * *",
+		"0 7 * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"0 0 0 * *",
+		"0 0 32 * *",
+		"0 0 * 13 *",
+		"0 0 * * 8",
+		"0 0 * * funday",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"30-10 * * * *",
+		"0 0 * * fri-mon",
+		"@fortnightly",
+	} {
+		if _, err := ParseSchedule(expr); !errors.Is(err, ErrBadSchedule) {
+			t.Errorf("ParseSchedule(%q) got error %v, want ErrBadSchedule", expr, err)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// times are given with their offset so it's clear which 1:30 they are when the clocks go back
+	parse := func(s string) time.Time {
+		if len(s) == 0 {
+			return time.Time{}
+		}
+		when, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return when.In(london)
+	}
+
+	tests := []struct {
+		name       string
+		expr       string
+		from, want string
+	}{
+		{"weekdays", "0 7 * * mon-fri", "2024-05-03T07:00:00+01:00", "2024-05-06T07:00:00+01:00"},
+		{"later the same day", "0 7 * * mon-fri", "2024-05-06T06:59:30+01:00", "2024-05-06T07:00:00+01:00"},
+		{"hour range", "0 9-17 * * *", "2024-05-06T17:00:00+01:00", "2024-05-07T09:00:00+01:00"},
+		{"minute step", "*/15 * * * *", "2024-05-06T10:07:00+01:00", "2024-05-06T10:15:00+01:00"},
+		{"step from a start", "5/20 * * * *", "2024-05-06T10:26:00+01:00", "2024-05-06T10:45:00+01:00"},
+		{"step over a range", "0 0-12/6 * * *", "2024-05-06T06:00:00+01:00", "2024-05-06T12:00:00+01:00"},
+		{"list", "0,30 8 * * *", "2024-05-06T08:00:00+01:00", "2024-05-06T08:30:00+01:00"},
+		{"month names", "0 0 1 jan,jul *", "2024-05-06T10:00:00+01:00", "2024-07-01T00:00:00+01:00"},
+		{"sunday as 7", "0 0 * * 7", "2024-05-06T10:00:00+01:00", "2024-05-12T00:00:00+01:00"},
+		{"macro", "@monthly", "2024-05-06T10:00:00+01:00", "2024-06-01T00:00:00+01:00"},
+		// when both days are given either one runs, but a * day doesn't mean every day
+		{"day of month or week", "0 0 13 * fri", "2024-09-01T00:00:00+01:00", "2024-09-06T00:00:00+01:00"},
+		{"day of month or week again", "0 0 13 * fri", "2024-09-06T00:00:00+01:00", "2024-09-13T00:00:00+01:00"},
+		{"day of week only", "0 0 * * fri", "2024-09-06T00:00:00+01:00", "2024-09-13T00:00:00+01:00"},
+		{"day of month only", "0 0 13 * *", "2024-09-01T00:00:00+01:00", "2024-09-13T00:00:00+01:00"},
+		{"short months", "0 0 31 * *", "2024-04-01T00:00:00+01:00", "2024-05-31T00:00:00+01:00"},
+		{"leap day", "0 0 29 2 *", "2024-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"never", "0 0 31 2 *", "2024-03-01T00:00:00Z", ""},
+		// the clocks go forward from 1:00 to 2:00 on the 31st of March 2024
+		{"skipped by the clocks", "30 1 * * *", "2024-03-30T12:00:00Z", "2024-03-31T02:00:00+01:00"},
+		{"after being skipped", "30 1 * * *", "2024-03-31T02:00:00+01:00", "2024-04-01T01:30:00+01:00"},
+		{"hourly going forward", "0 * * * *", "2024-03-31T00:00:00Z", "2024-03-31T02:00:00+01:00"},
+		// and back from 2:00 to 1:00 on the 27th of October 2024
+		{"first 1:30", "30 1 * * *", "2024-10-26T12:00:00+01:00", "2024-10-27T01:30:00+01:00"},
+		{"not the second 1:30", "30 1 * * *", "2024-10-27T01:30:00+01:00", "2024-10-28T01:30:00Z"},
+		{"hourly going back", "0 * * * *", "2024-10-27T01:00:00+01:00", "2024-10-27T01:00:00Z"},
+	}
+	for _, test := range tests {
+		schedule, err := ParseSchedule(test.expr)
+		if err != nil {
+			t.Errorf("%s: ParseSchedule(%q) failed: %v", test.name, test.expr, err)
+			continue
+		}
+		if got, want := schedule.Next(parse(test.from)), parse(test.want); !got.Equal(want) {
+			t.Errorf("%s: %q after %s got %s, want %s", test.name, test.expr, test.from, got, want)
+		}
+	}
+}
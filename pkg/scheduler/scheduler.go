@@ -0,0 +1,334 @@
+// Package scheduler runs jobs at the times given by cron expressions, such as playing a playlist in the
+// kitchen every weekday morning. Jobs are kept in schedules.dat in the library folder and every run is
+// recorded in schedule_runs.jsonl next to it. What a job does is up to the function the scheduler is
+// created with, and the time comes from a Clock so tests don't have to wait for it.
+package scheduler
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBadJob is returned for jobs without a room or with a bad schedule.
+	ErrBadJob   = errors.New("bad job")
+	ErrNotFound = errors.New("not found")
+)
+
+// the longest the scheduler sleeps for before looking at the clock again, in case it jumps
+const maxWait = time.Minute
+
+// Job is something to do in a room on a schedule. Action is the JSON of a sonos action, the same as a
+// POST to /api/sonos/<room>/action, and FadeMinutes turns the volume up from nothing to the Volume of
+// the action over that many minutes.
+type Job struct {
+	ID          int
+	Name        string
+	Schedule    string
+	Room        string
+	Action      json.RawMessage
+	FadeMinutes int `json:",omitempty"`
+	Enabled     bool
+}
+
+// JobStatus is a job with when it will next run, which is nil if it is disabled or never runs.
+type JobStatus struct {
+	Job
+	Next *time.Time `json:",omitempty"`
+}
+
+// Run is a job having run, with the error it failed with if it did.
+type Run struct {
+	JobID int
+	Name  string
+	Room  string
+	Time  time.Time
+	Error string `json:",omitempty"`
+}
+
+type jobData struct {
+	NextID int
+	Jobs   []Job
+}
+
+// entry is a parsed schedule of a job and the next time it runs.
+type entry struct {
+	schedule *Schedule
+	next     time.Time
+}
+
+type Scheduler struct {
+	folder string
+	clock  Clock
+	run    func(Job) error
+
+	mu      sync.Mutex
+	data    jobData
+	entries map[int]*entry
+	wake    chan struct{}
+
+	runsMu sync.Mutex
+}
+
+// New loads the jobs kept in folder. Once started, jobs are run with run when they are due.
+func New(folder string, clock Clock, run func(Job) error) (*Scheduler, error) {
+	s := &Scheduler{folder: folder, clock: clock, run: run, entries: make(map[int]*entry), wake: make(chan struct{}, 1)}
+	f, err := os.Open(path.Join(folder, "schedules.dat"))
+	if err == nil {
+		defer f.Close()
+		if err := gob.NewDecoder(f).Decode(&s.data); err != nil {
+			return nil, fmt.Errorf("failed to read schedules: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	now := clock.Now()
+	for _, job := range s.data.Jobs {
+		schedule, err := ParseSchedule(job.Schedule)
+		if err != nil {
+			log.Printf("skipping schedule %s: %v", job.Name, err)
+			continue
+		}
+		s.entries[job.ID] = &entry{schedule: schedule, next: schedule.Next(now)}
+	}
+	return s, nil
+}
+
+// Start runs jobs as they come due until the server stops.
+func (s *Scheduler) Start() {
+	go s.loop()
+}
+
+func (s *Scheduler) loop() {
+	for {
+		now := s.clock.Now()
+		var due []Job
+		wait := maxWait
+		s.mu.Lock()
+		for _, job := range s.data.Jobs {
+			e := s.entries[job.ID]
+			if !job.Enabled || e == nil || e.next.IsZero() {
+				continue
+			}
+			if !e.next.After(now) {
+				due = append(due, job)
+				e.next = e.schedule.Next(now)
+				if e.next.IsZero() {
+					continue
+				}
+			}
+			if e.next.Sub(now) < wait {
+				wait = e.next.Sub(now)
+			}
+		}
+		s.mu.Unlock()
+		for _, job := range due {
+			go s.runJob(job, now)
+		}
+		select {
+		case <-s.clock.After(wait):
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *Scheduler) runJob(job Job, at time.Time) (*Run, error) {
+	err := s.run(job)
+	run := Run{JobID: job.ID, Name: job.Name, Room: job.Room, Time: at}
+	if err != nil {
+		log.Printf("schedule %s failed: %v", job.Name, err)
+		run.Error = err.Error()
+	}
+	if err := s.appendRun(&run); err != nil {
+		log.Printf("failed to record schedule %s running: %v", job.Name, err)
+	}
+	return &run, err
+}
+
+func (s *Scheduler) appendRun(run *Run) error {
+	line, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+	f, err := os.OpenFile(path.Join(s.folder, "schedule_runs.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Runs returns the latest runs of jobs, newest first.
+func (s *Scheduler) Runs(limit int) ([]Run, error) {
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+	runs := []Run{}
+	f, err := os.Open(path.Join(s.folder, "schedule_runs.jsonl"))
+	if os.IsNotExist(err) {
+		return runs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var run Run
+		if err := json.Unmarshal(scanner.Bytes(), &run); err != nil {
+			// skip a line that was only partly written
+			continue
+		}
+		runs = append(runs, run)
+		if len(runs) > limit {
+			runs = runs[1:]
+		}
+	}
+	for i, j := 0, len(runs)-1; i < j; i, j = i+1, j-1 {
+		runs[i], runs[j] = runs[j], runs[i]
+	}
+	return runs, scanner.Err()
+}
+
+// status returns a job with when it next runs. Callers must hold mu.
+func (s *Scheduler) status(job Job) JobStatus {
+	status := JobStatus{Job: job}
+	if e := s.entries[job.ID]; job.Enabled && e != nil && !e.next.IsZero() {
+		next := e.next
+		status.Next = &next
+	}
+	return status
+}
+
+// Jobs returns every job in the order they were added.
+func (s *Scheduler) Jobs() []JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]JobStatus, len(s.data.Jobs))
+	for idx, job := range s.data.Jobs {
+		jobs[idx] = s.status(job)
+	}
+	return jobs
+}
+
+// Job returns the job with an id.
+func (s *Scheduler) Job(id int) (*JobStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.data.Jobs {
+		if job.ID == id {
+			status := s.status(job)
+			return &status, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: schedule %d", ErrNotFound, id)
+}
+
+// save writes the jobs to schedules.dat and wakes the loop to look at them. Callers must hold mu.
+func (s *Scheduler) save() error {
+	f, err := os.Create(path.Join(s.folder, "schedules.dat"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := gob.NewEncoder(f).Encode(&s.data); err != nil {
+		return err
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// parseJob checks a job can be scheduled and returns its schedule.
+func parseJob(job *Job) (*Schedule, error) {
+	if len(job.Room) == 0 {
+		return nil, fmt.Errorf("%w: no room", ErrBadJob)
+	}
+	if job.FadeMinutes < 0 {
+		return nil, fmt.Errorf("%w: can't fade over %d minutes", ErrBadJob, job.FadeMinutes)
+	}
+	schedule, err := ParseSchedule(job.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadJob, err)
+	}
+	if len(job.Name) == 0 {
+		job.Name = job.Schedule
+	}
+	return schedule, nil
+}
+
+// AddJob adds a job, giving it a new id.
+func (s *Scheduler) AddJob(job Job) (*JobStatus, error) {
+	schedule, err := parseJob(&job)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.ID = s.data.NextID
+	s.data.NextID++
+	s.data.Jobs = append(s.data.Jobs, job)
+	s.entries[job.ID] = &entry{schedule: schedule, next: schedule.Next(s.clock.Now())}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	status := s.status(job)
+	return &status, nil
+}
+
+// UpdateJob replaces the job with the same id.
+func (s *Scheduler) UpdateJob(job Job) (*JobStatus, error) {
+	schedule, err := parseJob(&job)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for idx := range s.data.Jobs {
+		if s.data.Jobs[idx].ID == job.ID {
+			s.data.Jobs[idx] = job
+			s.entries[job.ID] = &entry{schedule: schedule, next: schedule.Next(s.clock.Now())}
+			if err := s.save(); err != nil {
+				return nil, err
+			}
+			status := s.status(job)
+			return &status, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: schedule %d", ErrNotFound, job.ID)
+}
+
+// DeleteJob removes a job.
+func (s *Scheduler) DeleteJob(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for idx := range s.data.Jobs {
+		if s.data.Jobs[idx].ID == id {
+			s.data.Jobs = append(s.data.Jobs[:idx], s.data.Jobs[idx+1:]...)
+			delete(s.entries, id)
+			return s.save()
+		}
+	}
+	return fmt.Errorf("%w: schedule %d", ErrNotFound, id)
+}
+
+// RunJob runs a job now, whether or not it is enabled, and records it in the run log. It returns the
+// run along with the error the job failed with, if it did.
+func (s *Scheduler) RunJob(id int) (*Run, error) {
+	status, err := s.Job(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.runJob(status.Job, s.clock.Now())
+}
@@ -0,0 +1,181 @@
+package scheduler
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when a test moves it.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+	// waiting gets a value each time something waits on the clock
+	waiting chan struct{}
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, waiting: make(chan struct{}, 100)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), c: ch})
+	c.waiting <- struct{}{}
+	return ch
+}
+
+// Advance moves the clock on, waking anything waiting for a time it has reached.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+		} else {
+			w.c <- c.now
+		}
+	}
+	c.waiters = waiters
+}
+
+// waitFor waits for the scheduler loop to go back to sleep.
+func (c *fakeClock) waitFor(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the scheduler to wait for the clock")
+	}
+}
+
+func TestSchedulerLoop(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 5, 6, 6, 58, 0, 0, time.UTC))
+	ran := make(chan Job, 10)
+	s, err := New(t.TempDir(), clock, func(job Job) error {
+		ran <- job
+		if job.Room == "Nowhere" {
+			return errors.New("no sonos in Nowhere")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	morning, err := s.AddJob(Job{Name: "Morning", Schedule: "0 7 * * mon-fri", Room: "Kitchen", Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddJob(Job{Name: "Off", Schedule: "* * * * *", Room: "Kitchen"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 5, 6, 7, 0, 0, 0, time.UTC); morning.Next == nil || !morning.Next.Equal(want) {
+		t.Errorf("got next run %v, want %s", morning.Next, want)
+	}
+	s.Start()
+	clock.waitFor(t)
+
+	// nothing is due a minute early, and disabled jobs never are
+	clock.Advance(time.Minute)
+	clock.waitFor(t)
+	select {
+	case job := <-ran:
+		t.Fatalf("%s ran early", job.Name)
+	default:
+	}
+	clock.Advance(time.Minute)
+	clock.waitFor(t)
+	select {
+	case job := <-ran:
+		if job.Name != "Morning" {
+			t.Errorf("%s ran instead of Morning", job.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Morning to run")
+	}
+	status, err := s.Job(morning.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 5, 7, 7, 0, 0, 0, time.UTC); status.Next == nil || !status.Next.Equal(want) {
+		t.Errorf("got next run %v after running, want %s", status.Next, want)
+	}
+
+	// a job added while the loop sleeps wakes it up
+	if _, err := s.AddJob(Job{Name: "Soon", Schedule: "5 7 * * *", Room: "Nowhere", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	clock.waitFor(t)
+	clock.Advance(5 * time.Minute)
+	clock.waitFor(t)
+	select {
+	case job := <-ran:
+		if job.Name != "Soon" {
+			t.Errorf("%s ran instead of Soon", job.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Soon to run")
+	}
+
+	// the run is recorded once the job has finished
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		runs, err := s.Runs(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) == 2 {
+			if runs[0].Name != "Soon" || runs[0].Error != "no sonos in Nowhere" || !runs[0].Time.Equal(clock.Now()) {
+				t.Errorf("got latest run %+v", runs[0])
+			}
+			if runs[1].Name != "Morning" || runs[1].Error != "" {
+				t.Errorf("got first run %+v", runs[1])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got runs %+v, want 2", runs)
+		}
+	}
+}
+
+func TestRunJob(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC))
+	s, err := New(t.TempDir(), clock, func(job Job) error {
+		return errors.New("no sonos in " + job.Room)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := s.AddJob(Job{Schedule: "@daily", Room: "Kitchen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// disabled jobs still run when asked to, returning the run they made
+	run, err := s.RunJob(job.ID)
+	if err == nil || err.Error() != "no sonos in Kitchen" {
+		t.Errorf("got error %v, want no sonos in Kitchen", err)
+	}
+	if run == nil || run.JobID != job.ID || run.Name != "@daily" || run.Error != "no sonos in Kitchen" || !run.Time.Equal(clock.Now()) {
+		t.Errorf("got run %+v", run)
+	}
+	if _, err := s.RunJob(job.ID + 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("running a missing job got error %v, want ErrNotFound", err)
+	}
+}
@@ -72,27 +72,35 @@ type DIDLLite struct {
 	Upnp    string   `xml:"upnp,attr"`
 	R       string   `xml:"r,attr"`
 	Xmlns   string   `xml:"xmlns,attr"`
-	Item    struct {
-		Text       string `xml:",chardata"`
-		ID         string `xml:"id,attr"`
-		ParentID   string `xml:"parentID,attr"`
-		Restricted string `xml:"restricted,attr"`
-		Res        struct {
-			Text         string `xml:",chardata"`
-			ProtocolInfo string `xml:"protocolInfo,attr"`
-			Duration     string `xml:"duration,attr"`
-		} `xml:"res"`
-		StreamContent       string `xml:"streamContent"`
-		RadioShowMd         string `xml:"radioShowMd"`
-		StreamInfo          string `xml:"streamInfo"`
-		AlbumArtURI         string `xml:"albumArtURI"`
-		Title               string `xml:"title"`
-		Class               string `xml:"class"`
-		Creator             string `xml:"creator"`
-		Album               string `xml:"album"`
-		OriginalTrackNumber string `xml:"originalTrackNumber"`
-		AlbumArtist         string `xml:"albumArtist"`
-	} `xml:"item"`
+	Item    DIDLItem `xml:"item"`
+}
+
+// DIDLLiteList is a DIDL-Lite document with several items, such as the result of browsing a queue.
+type DIDLLiteList struct {
+	XMLName xml.Name   `xml:"DIDL-Lite"`
+	Items   []DIDLItem `xml:"item"`
+}
+
+type DIDLItem struct {
+	Text       string `xml:",chardata"`
+	ID         string `xml:"id,attr"`
+	ParentID   string `xml:"parentID,attr"`
+	Restricted string `xml:"restricted,attr"`
+	Res        struct {
+		Text         string `xml:",chardata"`
+		ProtocolInfo string `xml:"protocolInfo,attr"`
+		Duration     string `xml:"duration,attr"`
+	} `xml:"res"`
+	StreamContent       string `xml:"streamContent"`
+	RadioShowMd         string `xml:"radioShowMd"`
+	StreamInfo          string `xml:"streamInfo"`
+	AlbumArtURI         string `xml:"albumArtURI"`
+	Title               string `xml:"title"`
+	Class               string `xml:"class"`
+	Creator             string `xml:"creator"`
+	Album               string `xml:"album"`
+	OriginalTrackNumber string `xml:"originalTrackNumber"`
+	AlbumArtist         string `xml:"albumArtist"`
 }
 
 type RenderingControlEvent struct {
@@ -163,3 +171,19 @@ type RenderingControlEvent struct {
 		} `xml:"PresetNameList"`
 	} `xml:"InstanceID"`
 }
+
+// ZoneGroupState is the group topology from ZoneGroupTopology GetZoneGroupState. Older players
+// return the ZoneGroups element on its own.
+type ZoneGroupState struct {
+	XMLName    xml.Name `xml:"ZoneGroupState"`
+	ZoneGroups []struct {
+		Coordinator     string `xml:"Coordinator,attr"`
+		ID              string `xml:"ID,attr"`
+		ZoneGroupMember []struct {
+			UUID      string `xml:"UUID,attr"`
+			Location  string `xml:"Location,attr"`
+			ZoneName  string `xml:"ZoneName,attr"`
+			Invisible string `xml:"Invisible,attr"`
+		} `xml:"ZoneGroupMember"`
+	} `xml:"ZoneGroups>ZoneGroup"`
+}
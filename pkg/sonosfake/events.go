@@ -0,0 +1,183 @@
+package sonosfake
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// subscriber is a GENA subscription to the events of one service of a player.
+type subscriber struct {
+	service  string
+	callback *url.URL
+	seq      int
+}
+
+// notification is an event waiting to be sent to a subscriber.
+type notification struct {
+	callback *url.URL
+	sid      string
+	seq      int
+	body     string
+}
+
+func propertySet(name, value string) string {
+	return fmt.Sprintf(`<e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0"><e:property><%s>%s</%s></e:property></e:propertyset>`, name, escape(value), name)
+}
+
+// event describes the state of a service of the player, or is empty if the service has no events.
+// Callers must hold mu.
+func (p *ZonePlayer) event(service string) string {
+	switch service {
+	case "AVTransport":
+		track := p.currentTrack()
+		return propertySet("LastChange", fmt.Sprintf(`<Event xmlns="urn:schemas-upnp-org:metadata-1-0/AVT/" xmlns:r="urn:schemas-rinconnetworks-com:metadata-1-0/"><InstanceID val="0"><TransportState val="%s"/><CurrentPlayMode val="%s"/><CurrentCrossfadeMode val="%s"/><NumberOfTracks val="%d"/><CurrentTrack val="%d"/><CurrentTrackURI val="%s"/><CurrentTrackDuration val="%s"/><CurrentTrackMetaData val="%s"/><AVTransportURI val="%s"/></InstanceID></Event>`,
+			p.state, p.playMode, boolOut(p.crossfade), len(p.queue), p.track, escape(track.URI), trackDuration(track), escape(track.MetaData), escape(p.transportURI)))
+	case "RenderingControl":
+		return propertySet("LastChange", fmt.Sprintf(`<Event xmlns="urn:schemas-upnp-org:metadata-1-0/RCS/"><InstanceID val="0"><Volume channel="Master" val="%d"/><Mute channel="Master" val="%s"/><Bass val="%d"/><Treble val="%d"/><Loudness channel="Master" val="%s"/></InstanceID></Event>`,
+			p.volume, boolOut(p.muted), p.bass, p.treble, boolOut(p.loudness)))
+	case "ZoneGroupTopology":
+		return propertySet("ZoneGroupState", p.network.zoneGroupState())
+	}
+	return ""
+}
+
+// notify sends the state of a service to everything subscribed to it. Callers must hold mu.
+func (p *ZonePlayer) notify(service string) {
+	if p.closed {
+		return
+	}
+	body := p.event(service)
+	if len(body) == 0 {
+		return
+	}
+	for sid, sub := range p.subs {
+		if sub.service != service {
+			continue
+		}
+		p.queueEvent(notification{callback: sub.callback, sid: sid, seq: sub.seq, body: body})
+		sub.seq++
+	}
+}
+
+// queueEvent adds an event to the ones waiting to be sent. They are only sent once mu is released, as
+// subscribers handling an event may call the player back. Callers must hold mu.
+func (p *ZonePlayer) queueEvent(ev notification) {
+	p.pending = append(p.pending, ev)
+	select {
+	case p.wake <- struct{}{}:
+	default:
+		// sendEvents is already going to send it
+	}
+}
+
+func (p *ZonePlayer) notifyTransport() {
+	p.notify("AVTransport")
+}
+
+func (p *ZonePlayer) notifyVolume() {
+	p.notify("RenderingControl")
+}
+
+// sendEvents sends events to subscribers one at a time so they arrive in order.
+func (p *ZonePlayer) sendEvents() {
+	client := http.Client{Timeout: 5 * time.Second}
+	for range p.wake {
+		p.network.mu.Lock()
+		pending := p.pending
+		p.pending = nil
+		p.network.mu.Unlock()
+		for idx := range pending {
+			p.sendEvent(&client, &pending[idx])
+		}
+	}
+}
+
+// sendEvent sends an event to a subscriber.
+func (p *ZonePlayer) sendEvent(client *http.Client, ev *notification) {
+	req, err := http.NewRequest("NOTIFY", ev.callback.String(), strings.NewReader(ev.body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("NT", "upnp:event")
+	req.Header.Set("NTS", "upnp:propchange")
+	req.Header.Set("SID", ev.sid)
+	req.Header.Set("SEQ", strconv.Itoa(ev.seq))
+	res, err := client.Do(req)
+	if err != nil {
+		log.Printf("failed to send event from %s to %s: %v", p.Room, ev.callback, err)
+		return
+	}
+	res.Body.Close()
+}
+
+// subscribe handles GENA SUBSCRIBE and UNSUBSCRIBE requests for the events of a service.
+func (p *ZonePlayer) subscribe(w http.ResponseWriter, r *http.Request, service string) {
+	n := p.network
+	sid := r.Header.Get("SID")
+	timeout := r.Header.Get("TIMEOUT")
+	if len(timeout) == 0 {
+		timeout = "Second-1800"
+	}
+	switch r.Method {
+	case "SUBSCRIBE":
+		if len(sid) > 0 {
+			n.mu.Lock()
+			_, ok := p.subs[sid]
+			n.mu.Unlock()
+			if !ok {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			w.Header().Set("SID", sid)
+			w.Header().Set("TIMEOUT", timeout)
+			return
+		}
+		callback, err := url.Parse(strings.Trim(r.Header.Get("CALLBACK"), "<>"))
+		if r.Header.Get("NT") != "upnp:event" || err != nil || len(callback.Host) == 0 {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		// callbacks without an address come from a server that couldn't find its own, so send them to loopback
+		if strings.HasPrefix(callback.Host, ":") {
+			callback.Host = "127.0.0.1" + callback.Host
+		}
+		n.mu.Lock()
+		p.maxSid++
+		sid = fmt.Sprintf("uuid:%s_sub%010d", p.UUID, p.maxSid)
+		p.subs[sid] = &subscriber{service: service, callback: callback}
+		n.mu.Unlock()
+		w.Header().Set("SID", sid)
+		w.Header().Set("TIMEOUT", timeout)
+		w.Header().Set("Server", "Linux UPnP/1.0 Sonos/70.3-35220 (ZPS1)")
+		// a real sonos sends the current state straight away, which can beat the response saying what
+		// the subscription id is, so wait a moment to give the subscriber a chance
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			sub, ok := p.subs[sid]
+			body := p.event(service)
+			if !ok || p.closed || len(body) == 0 {
+				return
+			}
+			p.queueEvent(notification{callback: sub.callback, sid: sid, seq: sub.seq, body: body})
+			sub.seq++
+		}()
+	case "UNSUBSCRIBE":
+		n.mu.Lock()
+		_, ok := p.subs[sid]
+		delete(p.subs, sid)
+		n.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusPreconditionFailed)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,752 @@
+package sonosfake
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zanders3/music/pkg/sonosevs"
+)
+
+// services maps the path of each service to its name.
+var services = map[string]string{
+	"/MediaRenderer/AVTransport":           "AVTransport",
+	"/MediaRenderer/RenderingControl":      "RenderingControl",
+	"/MediaRenderer/GroupRenderingControl": "GroupRenderingControl",
+	"/MediaServer/ContentDirectory":        "ContentDirectory",
+	"/ZoneGroupTopology":                   "ZoneGroupTopology",
+	"/AlarmClock":                          "AlarmClock",
+}
+
+func serviceURN(service string) string {
+	return "urn:schemas-upnp-org:service:" + service + ":1"
+}
+
+// errInvalidArgs is returned as UPnP error 402 when an action is sent arguments it can't use.
+var errInvalidArgs = errors.New("invalid args")
+
+// upnpError is a UPnP error code returned in a SOAP fault.
+type upnpError int
+
+func (e upnpError) Error() string {
+	return fmt.Sprintf("upnp error %d", int(e))
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// readArgs reads the arguments of a SOAP action from a request body.
+func readArgs(body io.Reader, action string) (map[string]string, error) {
+	args := make(map[string]string)
+	dec := xml.NewDecoder(body)
+	inAction := false
+	var name string
+	var value strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s not found in request", action)
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == action {
+				inAction = true
+			} else if inAction {
+				name = t.Name.Local
+				value.Reset()
+			}
+		case xml.CharData:
+			if len(name) > 0 {
+				value.Write(t)
+			}
+		case xml.EndElement:
+			if t.Name.Local == action {
+				return args, nil
+			} else if t.Name.Local == name {
+				args[name] = value.String()
+				name = ""
+			}
+		}
+	}
+}
+
+func (p *ZonePlayer) control(w http.ResponseWriter, r *http.Request, service string) {
+	urn, action, _ := strings.Cut(strings.Trim(r.Header.Get("SOAPAction"), `"`), "#")
+	if urn != serviceURN(service) || r.Method != "POST" {
+		http.Error(w, "bad SOAPAction", http.StatusBadRequest)
+		return
+	}
+	args, err := readArgs(r.Body, action)
+	var out []string
+	if err == nil {
+		out, err = p.do(service, action, args)
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	if err != nil {
+		code := 501
+		var upnpErr upnpError
+		if errors.As(err, &upnpErr) {
+			code = int(upnpErr)
+		} else if errors.Is(err, errInvalidArgs) {
+			code = 402
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code)
+		return
+	}
+	var body strings.Builder
+	for idx := 0; idx+1 < len(out); idx += 2 {
+		fmt.Fprintf(&body, "<%s>%s</%s>", out[idx], escape(out[idx+1]), out[idx])
+	}
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`, action, urn, body.String(), action)
+}
+
+func intArg(args map[string]string, name string) (int, error) {
+	v, err := strconv.Atoi(args[name])
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %v", errInvalidArgs, name, err)
+	}
+	return v, nil
+}
+
+func boolArg(args map[string]string, name string) bool {
+	return args[name] == "1" || args[name] == "true"
+}
+
+func boolOut(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// splitMetaData splits the space separated DIDL-Lite documents sent to AddMultipleURIsToQueue, which
+// have spaces in them too.
+func splitMetaData(metaData string, count int) []string {
+	docs := make([]string, count)
+	parts := strings.Split(metaData, "<DIDL-Lite")
+	idx := 0
+	for _, part := range parts[1:] {
+		if idx < count {
+			docs[idx] = strings.TrimSpace("<DIDL-Lite" + part)
+			idx++
+		}
+	}
+	return docs
+}
+
+// trackItem returns the item element of a track to list in the queue, making one up from the URI if
+// it was queued without metadata.
+func trackItem(track Track, position int) string {
+	start, end := strings.Index(track.MetaData, "<item"), strings.LastIndex(track.MetaData, "</item>")
+	if start == -1 || end == -1 {
+		return fmt.Sprintf(`<item id="Q:0/%d" parentID="Q:0" restricted="true"><res>%s</res><dc:title>%s</dc:title><upnp:class>object.item.audioItem.musicTrack</upnp:class></item>`, position, escape(track.URI), escape(track.URI))
+	}
+	return track.MetaData[start : end+len("</item>")]
+}
+
+// parseTime parses a H:MM:SS duration.
+func parseTime(s string) (time.Duration, error) {
+	var h, m, sec int
+	if _, err := fmt.Sscanf(s, "%d:%d:%d", &h, &m, &sec); err != nil {
+		return 0, fmt.Errorf("%w: %s", errInvalidArgs, s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second, nil
+}
+
+func trackDuration(track Track) string {
+	var didl sonosevs.DIDLLite
+	if err := xml.Unmarshal([]byte(track.MetaData), &didl); err != nil || len(didl.Item.Res.Duration) == 0 {
+		return "0:00:00"
+	}
+	return didl.Item.Res.Duration
+}
+
+// zoneGroupState describes the groups in the network like a real sonos. Callers must hold mu.
+func (n *Network) zoneGroupState() string {
+	var state strings.Builder
+	state.WriteString("<ZoneGroupState><ZoneGroups>")
+	for _, coordinator := range n.players {
+		if coordinator.coordinator != coordinator.UUID {
+			continue
+		}
+		fmt.Fprintf(&state, `<ZoneGroup Coordinator="%s" ID="%s:1">`, coordinator.UUID, coordinator.UUID)
+		for _, member := range coordinator.members() {
+			fmt.Fprintf(&state, `<ZoneGroupMember UUID="%s" Location="%s" ZoneName="%s"/>`, member.UUID, escape(member.URL().String()), escape(member.Room))
+		}
+		state.WriteString("</ZoneGroup>")
+	}
+	state.WriteString("</ZoneGroups><VanishedDevices></VanishedDevices></ZoneGroupState>")
+	return state.String()
+}
+
+// do runs a SOAP action against the player and returns the names and values of its results.
+func (p *ZonePlayer) do(service, action string, args map[string]string) ([]string, error) {
+	n := p.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	p.actions = append(p.actions, service+"#"+action)
+	switch service + "#" + action {
+	case "AVTransport#SetAVTransportURI":
+		uri := args["CurrentURI"]
+		if strings.HasPrefix(uri, "x-rincon:") {
+			other := n.player(strings.TrimPrefix(uri, "x-rincon:"))
+			if other == nil || other.coordinator == p.UUID {
+				return nil, upnpError(800)
+			}
+			p.leaveGroup()
+			p.coordinator = other.coordinator
+			p.transportURI, p.transportMeta = "x-rincon:"+other.coordinator, ""
+			return nil, nil
+		}
+		p.leaveGroup()
+		p.stopEndTimer()
+		p.transportURI, p.transportMeta = uri, args["CurrentURIMetaData"]
+		p.state, p.track, p.relTime = "STOPPED", 1, "0:00:00"
+		p.notifyTransport()
+		return nil, nil
+	case "AVTransport#BecomeCoordinatorOfStandaloneGroup":
+		p.leaveGroup()
+		if strings.HasPrefix(p.transportURI, "x-rincon:") {
+			p.transportURI, p.state = "", "STOPPED"
+		}
+		return []string{"DelegatedGroupCoordinatorID", "", "NewGroupID", p.UUID + ":1"}, nil
+	case "AVTransport#AddURIToQueue", "AVTransport#AddMultipleURIsToQueue":
+		var tracks []Track
+		if action == "AddURIToQueue" {
+			tracks = []Track{{URI: args["EnqueuedURI"], MetaData: args["EnqueuedURIMetaData"]}}
+		} else {
+			uris := strings.Fields(args["EnqueuedURIs"])
+			metaData := splitMetaData(args["EnqueuedURIsMetaData"], len(uris))
+			for idx, uri := range uris {
+				tracks = append(tracks, Track{URI: uri, MetaData: metaData[idx]})
+			}
+		}
+		position, _ := strconv.Atoi(args["DesiredFirstTrackNumberEnqueued"])
+		if position < 1 || position > len(p.queue)+1 {
+			position = len(p.queue) + 1
+		}
+		queue := append([]Track{}, p.queue[:position-1]...)
+		queue = append(queue, tracks...)
+		p.queue = append(queue, p.queue[position-1:]...)
+		if p.track >= position {
+			p.track += len(tracks)
+		}
+		p.notifyTransport()
+		return []string{
+			"FirstTrackNumberEnqueued", strconv.Itoa(position),
+			"NumTracksAdded", strconv.Itoa(len(tracks)),
+			"NewQueueLength", strconv.Itoa(len(p.queue)),
+			"NewUpdateID", strconv.Itoa(len(p.actions)),
+		}, nil
+	case "AVTransport#RemoveAllTracksFromQueue":
+		p.queue, p.track = nil, 0
+		// like a real sonos, emptying the queue it's playing stops it
+		if p.isQueue() {
+			p.state, p.relTime = "STOPPED", "0:00:00"
+		}
+		p.notifyTransport()
+		return nil, nil
+	case "AVTransport#RemoveTrackRangeFromQueue":
+		start, err := intArg(args, "StartingIndex")
+		if err != nil {
+			return nil, err
+		}
+		count, err := intArg(args, "NumberOfTracks")
+		if err != nil {
+			return nil, err
+		}
+		if start < 1 || count < 0 || start-1+count > len(p.queue) {
+			return nil, errInvalidArgs
+		}
+		p.queue = append(p.queue[:start-1], p.queue[start-1+count:]...)
+		if p.track >= start+count {
+			p.track -= count
+		} else if p.track >= start {
+			p.track = start
+		}
+		p.notifyTransport()
+		return []string{"NewUpdateID", strconv.Itoa(len(p.actions))}, nil
+	case "AVTransport#ReorderTracksInQueue":
+		start, err := intArg(args, "StartingIndex")
+		if err != nil {
+			return nil, err
+		}
+		count, err := intArg(args, "NumberOfTracks")
+		if err != nil {
+			return nil, err
+		}
+		before, err := intArg(args, "InsertBefore")
+		if err != nil {
+			return nil, err
+		}
+		if start < 1 || count < 1 || start-1+count > len(p.queue) || before < 1 || before > len(p.queue)+1 {
+			return nil, errInvalidArgs
+		}
+		// move the positions of the tracks along with them, so the playing track stays playing
+		order := make([]int, len(p.queue))
+		for idx := range order {
+			order[idx] = idx
+		}
+		moved := append([]int{}, order[start-1:start-1+count]...)
+		rest := append(append([]int{}, order[:start-1]...), order[start-1+count:]...)
+		if before > start {
+			before -= count
+			if before < start {
+				before = start
+			}
+		}
+		order = append(append(append([]int{}, rest[:before-1]...), moved...), rest[before-1:]...)
+		queue := make([]Track, len(order))
+		playing := p.track - 1
+		for idx, from := range order {
+			queue[idx] = p.queue[from]
+			if from == playing {
+				p.track = idx + 1
+			}
+		}
+		p.queue = queue
+		p.notifyTransport()
+		return nil, nil
+	case "AVTransport#GetMediaInfo":
+		return []string{
+			"NrTracks", strconv.Itoa(len(p.queue)),
+			"MediaDuration", "NOT_IMPLEMENTED",
+			"CurrentURI", p.transportURI,
+			"CurrentURIMetaData", p.transportMeta,
+			"NextURI", "",
+			"NextURIMetaData", "",
+			"PlayMedium", "NETWORK",
+			"RecordMedium", "NOT_IMPLEMENTED",
+			"WriteStatus", "NOT_IMPLEMENTED",
+		}, nil
+	case "AVTransport#GetPositionInfo":
+		track := p.currentTrack()
+		return []string{
+			"Track", strconv.Itoa(p.track),
+			"TrackDuration", trackDuration(track),
+			"TrackMetaData", track.MetaData,
+			"TrackURI", track.URI,
+			"RelTime", p.relTime,
+			"AbsTime", "NOT_IMPLEMENTED",
+			"RelCount", "2147483647",
+			"AbsCount", "2147483647",
+		}, nil
+	case "AVTransport#GetTransportInfo":
+		return []string{"CurrentTransportState", p.state, "CurrentTransportStatus", "OK", "CurrentSpeed", "1"}, nil
+	case "AVTransport#Play":
+		if len(p.transportURI) == 0 || strings.HasPrefix(p.transportURI, "x-rincon:") || (p.isQueue() && len(p.queue) == 0) {
+			return nil, upnpError(701)
+		}
+		if p.track < 1 {
+			p.track = 1
+		}
+		p.state = "PLAYING"
+		p.startEndTimer()
+		p.notifyTransport()
+		return nil, nil
+	case "AVTransport#Pause":
+		if p.state != "PLAYING" {
+			return nil, upnpError(701)
+		}
+		p.stopEndTimer()
+		p.state = "PAUSED_PLAYBACK"
+		p.notifyTransport()
+		return nil, nil
+	case "AVTransport#Stop":
+		p.stopEndTimer()
+		p.state = "STOPPED"
+		p.notifyTransport()
+		return nil, nil
+	case "AVTransport#Next", "AVTransport#Previous":
+		track := p.track + 1
+		if action == "Previous" {
+			track = p.track - 1
+		}
+		if !p.isQueue() || track < 1 || track > len(p.queue) {
+			return nil, upnpError(711)
+		}
+		p.track, p.relTime = track, "0:00:00"
+		p.notifyTransport()
+		return nil, nil
+	case "AVTransport#Seek":
+		switch args["Unit"] {
+		case "TRACK_NR":
+			track, err := intArg(args, "Target")
+			if err != nil {
+				return nil, err
+			}
+			if !p.isQueue() || track < 1 || track > len(p.queue) {
+				return nil, upnpError(711)
+			}
+			p.track, p.relTime = track, "0:00:00"
+		case "REL_TIME":
+			p.relTime = args["Target"]
+		default:
+			return nil, errInvalidArgs
+		}
+		p.notifyTransport()
+		return nil, nil
+	case "AVTransport#SetPlayMode":
+		switch args["NewPlayMode"] {
+		case "NORMAL", "REPEAT_ALL", "REPEAT_ONE", "SHUFFLE_NOREPEAT", "SHUFFLE", "SHUFFLE_REPEAT_ONE":
+			p.playMode = args["NewPlayMode"]
+		default:
+			return nil, upnpError(712)
+		}
+		p.notifyTransport()
+		return nil, nil
+	case "AVTransport#GetTransportSettings":
+		return []string{"PlayMode", p.playMode, "RecQualityMode", "NOT_IMPLEMENTED"}, nil
+	case "AVTransport#SetCrossfadeMode":
+		p.crossfade = boolArg(args, "CrossfadeMode")
+		p.notifyTransport()
+		return nil, nil
+	case "AVTransport#GetCrossfadeMode":
+		return []string{"CrossfadeMode", boolOut(p.crossfade)}, nil
+	case "AVTransport#ConfigureSleepTimer":
+		if p.sleepTimer != nil {
+			p.sleepTimer.Stop()
+			p.sleepTimer, p.sleepEnd = nil, time.Time{}
+		}
+		if sleep := args["NewSleepTimerDuration"]; len(sleep) > 0 {
+			duration, err := parseTime(sleep)
+			if err != nil {
+				return nil, err
+			}
+			p.sleepEnd = time.Now().Add(duration)
+			var timer *time.Timer
+			timer = time.AfterFunc(duration, func() {
+				n.mu.Lock()
+				defer n.mu.Unlock()
+				if p.sleepTimer != timer {
+					return
+				}
+				p.sleepTimer, p.sleepEnd = nil, time.Time{}
+				if p.state == "PLAYING" {
+					p.state = "PAUSED_PLAYBACK"
+				}
+				p.notifyTransport()
+			})
+			p.sleepTimer = timer
+		}
+		p.notifyTransport()
+		return nil, nil
+	case "AVTransport#GetRemainingSleepTimerDuration":
+		var remaining string
+		if !p.sleepEnd.IsZero() {
+			secs := int(time.Until(p.sleepEnd).Seconds())
+			remaining = fmt.Sprintf("%d:%02d:%02d", secs/(60*60), secs/60%60, secs%60)
+		}
+		return []string{"RemainingSleepTimerDuration", remaining, "CurrentSleepTimerGeneration", "1"}, nil
+	case "RenderingControl#RampToVolume":
+		volume, err := intArg(args, "DesiredVolume")
+		if err != nil {
+			return nil, err
+		}
+		// the fake jumps straight to the volume rather than ramping
+		p.setVolume(volume)
+		return []string{"RampTime", "0"}, nil
+	case "RenderingControl#GetVolume":
+		return []string{"CurrentVolume", strconv.Itoa(p.volume)}, nil
+	case "RenderingControl#SetVolume":
+		volume, err := intArg(args, "DesiredVolume")
+		if err != nil {
+			return nil, err
+		}
+		p.setVolume(volume)
+		return nil, nil
+	case "RenderingControl#SetRelativeVolume":
+		adjustment, err := intArg(args, "Adjustment")
+		if err != nil {
+			return nil, err
+		}
+		p.setVolume(p.volume + adjustment)
+		return []string{"NewVolume", strconv.Itoa(p.volume)}, nil
+	case "RenderingControl#GetMute":
+		return []string{"CurrentMute", boolOut(p.muted)}, nil
+	case "RenderingControl#SetMute":
+		p.muted = boolArg(args, "DesiredMute")
+		p.notifyVolume()
+		return nil, nil
+	case "RenderingControl#GetBass":
+		return []string{"CurrentBass", strconv.Itoa(p.bass)}, nil
+	case "RenderingControl#GetTreble":
+		return []string{"CurrentTreble", strconv.Itoa(p.treble)}, nil
+	case "RenderingControl#SetBass", "RenderingControl#SetTreble":
+		level, err := intArg(args, "Desired"+strings.TrimPrefix(action, "Set"))
+		if err != nil {
+			return nil, err
+		}
+		if level < -10 || level > 10 {
+			return nil, errInvalidArgs
+		}
+		if action == "SetBass" {
+			p.bass = level
+		} else {
+			p.treble = level
+		}
+		p.notifyVolume()
+		return nil, nil
+	case "RenderingControl#GetLoudness":
+		return []string{"CurrentLoudness", boolOut(p.loudness)}, nil
+	case "RenderingControl#SetLoudness":
+		p.loudness = boolArg(args, "DesiredLoudness")
+		p.notifyVolume()
+		return nil, nil
+	case "GroupRenderingControl#GetGroupVolume":
+		return []string{"CurrentVolume", strconv.Itoa(p.groupVolume())}, nil
+	case "GroupRenderingControl#SnapshotGroupVolume":
+		return nil, nil
+	case "GroupRenderingControl#SetGroupVolume", "GroupRenderingControl#SetRelativeGroupVolume":
+		if p.coordinator != p.UUID {
+			return nil, upnpError(701)
+		}
+		var adjustment int
+		if action == "SetGroupVolume" {
+			volume, err := intArg(args, "DesiredVolume")
+			if err != nil {
+				return nil, err
+			}
+			adjustment = volume - p.groupVolume()
+		} else {
+			var err error
+			if adjustment, err = intArg(args, "Adjustment"); err != nil {
+				return nil, err
+			}
+		}
+		// rooms keep their volume relative to each other until they hit the top or bottom
+		for _, member := range p.members() {
+			member.setVolume(member.volume + adjustment)
+		}
+		if action == "SetRelativeGroupVolume" {
+			return []string{"NewVolume", strconv.Itoa(p.groupVolume())}, nil
+		}
+		return nil, nil
+	case "GroupRenderingControl#GetGroupMute":
+		muted := true
+		for _, member := range p.members() {
+			muted = muted && member.muted
+		}
+		return []string{"CurrentMute", boolOut(muted)}, nil
+	case "GroupRenderingControl#SetGroupMute":
+		for _, member := range p.members() {
+			member.muted = boolArg(args, "DesiredMute")
+			member.notifyVolume()
+		}
+		return nil, nil
+	case "ContentDirectory#Browse":
+		if args["ObjectID"] != "Q:0" || args["BrowseFlag"] != "BrowseDirectChildren" {
+			return nil, upnpError(701)
+		}
+		start, err := intArg(args, "StartingIndex")
+		if err != nil {
+			return nil, err
+		}
+		count, err := intArg(args, "RequestedCount")
+		if err != nil {
+			return nil, err
+		}
+		if start > len(p.queue) {
+			start = len(p.queue)
+		}
+		if count == 0 || start+count > len(p.queue) {
+			count = len(p.queue) - start
+		}
+		var result strings.Builder
+		result.WriteString(`<DIDL-Lite xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/" xmlns:r="urn:schemas-rinconnetworks-com:metadata-1-0/" xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/">`)
+		for idx, track := range p.queue[start : start+count] {
+			result.WriteString(trackItem(track, start+idx+1))
+		}
+		result.WriteString(`</DIDL-Lite>`)
+		return []string{
+			"Result", result.String(),
+			"NumberReturned", strconv.Itoa(count),
+			"TotalMatches", strconv.Itoa(len(p.queue)),
+			"UpdateID", strconv.Itoa(len(p.actions)),
+		}, nil
+	case "AVTransport#CreateSavedQueue":
+		n.maxQueueID++
+		n.updateID++
+		id := fmt.Sprintf("SQ:%d", n.maxQueueID)
+		n.savedQueues[id] = &savedQueue{title: args["Title"], tracks: []Track{{URI: args["EnqueuedURI"], MetaData: args["EnqueuedURIMetaData"]}}}
+		return []string{"NumTracksAdded", "1", "NewQueueLength", "1", "AssignedObjectID", id, "NewUpdateID", strconv.Itoa(n.updateID)}, nil
+	case "AVTransport#AddURIToSavedQueue":
+		queue, ok := n.savedQueues[args["ObjectID"]]
+		if !ok {
+			return nil, upnpError(701)
+		}
+		if updateID, err := intArg(args, "UpdateID"); err != nil {
+			return nil, err
+		} else if updateID != n.updateID {
+			// the playlist changed since the caller last looked at it
+			return nil, upnpError(712)
+		}
+		queue.tracks = append(queue.tracks, Track{URI: args["EnqueuedURI"], MetaData: args["EnqueuedURIMetaData"]})
+		n.updateID++
+		return []string{"NumTracksAdded", "1", "NewQueueLength", strconv.Itoa(len(queue.tracks)), "NewUpdateID", strconv.Itoa(n.updateID)}, nil
+	case "ContentDirectory#DestroyObject":
+		if _, ok := n.savedQueues[args["ObjectID"]]; !ok {
+			return nil, upnpError(701)
+		}
+		delete(n.savedQueues, args["ObjectID"])
+		n.updateID++
+		return nil, nil
+	case "AlarmClock#ListAlarms":
+		var list strings.Builder
+		list.WriteString("<Alarms>")
+		for _, alarm := range n.alarms {
+			fmt.Fprintf(&list, `<Alarm ID="%d" StartTime="%s" Duration="%s" Recurrence="%s" Enabled="%s" RoomUUID="%s" ProgramURI="%s" ProgramMetaData="%s" PlayMode="%s" Volume="%d" IncludeLinkedZones="%s"/>`,
+				alarm.ID, alarm.StartTime, alarm.Duration, alarm.Recurrence, boolOut(alarm.Enabled), alarm.RoomUUID,
+				escape(alarm.ProgramURI), escape(alarm.ProgramMetaData), alarm.PlayMode, alarm.Volume, boolOut(alarm.IncludeLinkedZones))
+		}
+		list.WriteString("</Alarms>")
+		return []string{"CurrentAlarmList", list.String(), "CurrentAlarmListVersion", fmt.Sprintf("%s:%d", p.UUID, n.maxAlarmID)}, nil
+	case "AlarmClock#CreateAlarm", "AlarmClock#UpdateAlarm":
+		volume, err := intArg(args, "Volume")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parseTime(args["StartLocalTime"]); err != nil {
+			return nil, err
+		}
+		if _, err := parseTime(args["Duration"]); err != nil {
+			return nil, err
+		}
+		if n.player(args["RoomUUID"]) == nil {
+			return nil, errInvalidArgs
+		}
+		alarm := Alarm{
+			StartTime:          args["StartLocalTime"],
+			Duration:           args["Duration"],
+			Recurrence:         args["Recurrence"],
+			Enabled:            boolArg(args, "Enabled"),
+			RoomUUID:           args["RoomUUID"],
+			ProgramURI:         args["ProgramURI"],
+			ProgramMetaData:    args["ProgramMetaData"],
+			PlayMode:           args["PlayMode"],
+			Volume:             volume,
+			IncludeLinkedZones: boolArg(args, "IncludeLinkedZones"),
+		}
+		if action == "CreateAlarm" {
+			n.maxAlarmID++
+			alarm.ID = n.maxAlarmID
+			n.alarms = append(n.alarms, alarm)
+			return []string{"AssignedID", strconv.Itoa(alarm.ID)}, nil
+		}
+		id, err := intArg(args, "ID")
+		if err != nil {
+			return nil, err
+		}
+		for idx := range n.alarms {
+			if n.alarms[idx].ID == id {
+				alarm.ID = id
+				n.alarms[idx] = alarm
+				return nil, nil
+			}
+		}
+		return nil, errInvalidArgs
+	case "AlarmClock#DestroyAlarm":
+		id, err := intArg(args, "ID")
+		if err != nil {
+			return nil, err
+		}
+		for idx := range n.alarms {
+			if n.alarms[idx].ID == id {
+				n.alarms = append(n.alarms[:idx], n.alarms[idx+1:]...)
+				return nil, nil
+			}
+		}
+		return nil, errInvalidArgs
+	case "ZoneGroupTopology#GetZoneGroupState":
+		return []string{"ZoneGroupState", n.zoneGroupState()}, nil
+	}
+	return nil, upnpError(401)
+}
+
+// isQueue returns whether the player is playing its queue. Callers must hold mu.
+func (p *ZonePlayer) isQueue() bool {
+	return strings.HasPrefix(p.transportURI, "x-rincon-queue:")
+}
+
+// startEndTimer stops the player once a single track that isn't from the queue has played to the end,
+// from where it is up to. Callers must hold mu.
+func (p *ZonePlayer) startEndTimer() {
+	p.stopEndTimer()
+	if p.isQueue() {
+		return
+	}
+	duration, err := parseTime(trackDuration(p.currentTrack()))
+	if err != nil || duration == 0 {
+		return
+	}
+	if played, err := parseTime(p.relTime); err == nil {
+		duration -= played
+	}
+	n := p.network
+	var timer *time.Timer
+	timer = time.AfterFunc(duration, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if p.endTimer != timer {
+			return
+		}
+		p.endTimer = nil
+		p.state, p.relTime = "STOPPED", "0:00:00"
+		p.notifyTransport()
+	})
+	p.endTimer = timer
+}
+
+// stopEndTimer stops a single track being stopped at its end. Callers must hold mu.
+func (p *ZonePlayer) stopEndTimer() {
+	if p.endTimer != nil {
+		p.endTimer.Stop()
+		p.endTimer = nil
+	}
+}
+
+// currentTrack returns the track the player is on. Callers must hold mu.
+func (p *ZonePlayer) currentTrack() Track {
+	if p.isQueue() {
+		if p.track >= 1 && p.track <= len(p.queue) {
+			return p.queue[p.track-1]
+		}
+		return Track{}
+	}
+	return Track{URI: p.transportURI, MetaData: p.transportMeta}
+}
+
+// setVolume sets the volume of the player between 0 and 100. Callers must hold mu.
+func (p *ZonePlayer) setVolume(volume int) {
+	if volume < 0 {
+		volume = 0
+	} else if volume > 100 {
+		volume = 100
+	}
+	p.volume = volume
+	p.notifyVolume()
+}
+
+// groupVolume is the average volume of the rooms in the group a player coordinates. Callers must hold mu.
+func (p *ZonePlayer) groupVolume() int {
+	members := p.members()
+	if len(members) == 0 {
+		return p.volume
+	}
+	total := 0
+	for _, member := range members {
+		total += member.volume
+	}
+	return total / len(members)
+}
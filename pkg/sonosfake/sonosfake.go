@@ -0,0 +1,361 @@
+// Package sonosfake is a pretend network of sonos players for testing the sonos features without any
+// speakers. Each player serves its device description, the SOAP services music box uses and GENA events
+// on its own port, and keeps its queue, transport and volume in memory. A test can start one and point
+// the server at it like this:
+//
+//	network := sonosfake.NewNetwork()
+//	defer network.Close()
+//	office, _ := network.Add("Office")
+//	sonos := music.NewSonos()
+//	sonos.AddPlayer(office.URL())
+package sonosfake
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ssdpAddr         = "239.255.255.250:1900"
+	ssdpZonePlayerST = "urn:schemas-upnp-org:device:ZonePlayer:1"
+)
+
+// Track is a track in the queue of a fake player with its DIDL-Lite metadata.
+type Track struct {
+	URI, MetaData string
+}
+
+// Network is a set of fake players that can see each other, so they can be grouped together. Like a
+// real household the alarms and saved queues are shared by every player.
+type Network struct {
+	mu      sync.Mutex
+	players []*ZonePlayer
+	ssdp    *net.UDPConn
+
+	// guarded by mu
+	alarms      []Alarm
+	maxAlarmID  int
+	savedQueues map[string]*savedQueue
+	maxQueueID  int
+	updateID    int
+}
+
+// Alarm is an alarm kept by the network, with the same fields as a sonos lists them.
+type Alarm struct {
+	ID                                    int
+	StartTime, Duration, Recurrence       string
+	Enabled                               bool
+	RoomUUID, ProgramURI, ProgramMetaData string
+	PlayMode                              string
+	Volume                                int
+	IncludeLinkedZones                    bool
+}
+
+// savedQueue is a sonos playlist, which is what alarms play music from.
+type savedQueue struct {
+	title  string
+	tracks []Track
+}
+
+// numPlayers counts the players started by every network, so players in different networks never share
+// an id, and neither do their event subscriptions.
+var numPlayers atomic.Int32
+
+func NewNetwork() *Network {
+	return &Network{savedQueues: make(map[string]*savedQueue)}
+}
+
+// ZonePlayer is a fake sonos in one room.
+type ZonePlayer struct {
+	Room, UUID string
+
+	network  *Network
+	listener net.Listener
+	server   *http.Server
+	// wake tells sendEvents there are events waiting to be sent
+	wake chan struct{}
+
+	// guarded by network.mu
+	coordinator   string
+	volume        int
+	muted         bool
+	bass, treble  int
+	loudness      bool
+	queue         []Track
+	transportURI  string
+	transportMeta string
+	state         string
+	track         int
+	relTime       string
+	playMode      string
+	crossfade     bool
+	sleepEnd      time.Time
+	sleepTimer    *time.Timer
+	endTimer      *time.Timer
+	subs          map[string]*subscriber
+	maxSid        int
+	pending       []notification
+	actions       []string
+	closed        bool
+}
+
+// Add starts a player for a room listening on a free port of the loopback address.
+func (n *Network) Add(room string) (*ZonePlayer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	p := &ZonePlayer{
+		Room:     room,
+		UUID:     fmt.Sprintf("RINCON_FA4E50000%03d01400", numPlayers.Add(1)),
+		network:  n,
+		listener: listener,
+		wake:     make(chan struct{}, 1),
+		volume:   20,
+		loudness: true,
+		state:    "STOPPED",
+		relTime:  "0:00:00",
+		playMode: "NORMAL",
+		subs:     make(map[string]*subscriber),
+	}
+	p.coordinator = p.UUID
+	n.players = append(n.players, p)
+	n.mu.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/xml/device_description.xml", p.deviceDescription)
+	for path, service := range services {
+		service := service
+		mux.HandleFunc(path+"/Control", func(w http.ResponseWriter, r *http.Request) { p.control(w, r, service) })
+		mux.HandleFunc(path+"/Event", func(w http.ResponseWriter, r *http.Request) { p.subscribe(w, r, service) })
+	}
+	p.server = &http.Server{Handler: mux}
+	go p.server.Serve(listener)
+	go p.sendEvents()
+	return p, nil
+}
+
+// Players returns the players in the network.
+func (n *Network) Players() []*ZonePlayer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]*ZonePlayer{}, n.players...)
+}
+
+// Close switches every player off and stops answering searches.
+func (n *Network) Close() {
+	for _, p := range n.Players() {
+		p.Close()
+	}
+	n.mu.Lock()
+	if n.ssdp != nil {
+		n.ssdp.Close()
+	}
+	n.mu.Unlock()
+}
+
+// ListenSSDP answers SSDP searches for zone players with every player in the network.
+func (n *Network) ListenSSDP() error {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.ssdp = conn
+	n.mu.Unlock()
+	go func() {
+		buf := make([]byte, 8192)
+		for {
+			size, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			search := string(buf[:size])
+			if !strings.HasPrefix(search, "M-SEARCH") || !(strings.Contains(search, ssdpZonePlayerST) || strings.Contains(search, "ssdp:all")) {
+				continue
+			}
+			for _, p := range n.Players() {
+				res := fmt.Sprintf("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age = 1800\r\nEXT:\r\nLOCATION: %s\r\nSERVER: Linux UPnP/1.0 Sonos/70.3-35220 (ZPS1)\r\nST: %s\r\nUSN: uuid:%s::%s\r\n\r\n", p.URL(), ssdpZonePlayerST, p.UUID, ssdpZonePlayerST)
+				if _, err := conn.WriteToUDP([]byte(res), from); err != nil {
+					log.Printf("failed to answer sonos search from %s: %v", from, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// URL returns the address of the device description of the player, which is what SSDP searches find.
+func (p *ZonePlayer) URL() *url.URL {
+	return &url.URL{Scheme: "http", Host: p.listener.Addr().String(), Path: "/xml/device_description.xml"}
+}
+
+// Close switches the player off, taking it out of the network and its group.
+func (p *ZonePlayer) Close() {
+	n := p.network
+	n.mu.Lock()
+	for idx, other := range n.players {
+		if other == p {
+			n.players = append(n.players[:idx], n.players[idx+1:]...)
+			break
+		}
+	}
+	p.leaveGroup()
+	if !p.closed {
+		p.closed = true
+		close(p.wake)
+	}
+	n.mu.Unlock()
+	p.server.Close()
+}
+
+// Actions returns the SOAP actions the player has been sent, such as "AVTransport#Play".
+func (p *ZonePlayer) Actions() []string {
+	p.network.mu.Lock()
+	defer p.network.mu.Unlock()
+	return append([]string{}, p.actions...)
+}
+
+// Queue returns the tracks in the queue of the player.
+func (p *ZonePlayer) Queue() []Track {
+	p.network.mu.Lock()
+	defer p.network.mu.Unlock()
+	return append([]Track{}, p.queue...)
+}
+
+// State returns the transport state of the player, such as PLAYING, and the track it is on.
+func (p *ZonePlayer) State() (string, int) {
+	p.network.mu.Lock()
+	defer p.network.mu.Unlock()
+	return p.state, p.track
+}
+
+// Media returns the URI the player is playing from, such as its queue or a single track, and how far it is
+// into the track.
+func (p *ZonePlayer) Media() (string, string) {
+	p.network.mu.Lock()
+	defer p.network.mu.Unlock()
+	return p.transportURI, p.relTime
+}
+
+// Volume returns the volume of the player and whether it is muted.
+func (p *ZonePlayer) Volume() (int, bool) {
+	p.network.mu.Lock()
+	defer p.network.mu.Unlock()
+	return p.volume, p.muted
+}
+
+// PlayMode returns the play mode of the player, such as SHUFFLE, and whether it crossfades between tracks.
+func (p *ZonePlayer) PlayMode() (string, bool) {
+	p.network.mu.Lock()
+	defer p.network.mu.Unlock()
+	return p.playMode, p.crossfade
+}
+
+// EQ returns the bass and treble of the player and whether loudness is on.
+func (p *ZonePlayer) EQ() (int, int, bool) {
+	p.network.mu.Lock()
+	defer p.network.mu.Unlock()
+	return p.bass, p.treble, p.loudness
+}
+
+// Coordinator returns the player coordinating the group this player is in.
+func (p *ZonePlayer) Coordinator() *ZonePlayer {
+	p.network.mu.Lock()
+	defer p.network.mu.Unlock()
+	return p.network.player(p.coordinator)
+}
+
+// Network returns the network the player is in, which has the alarms and saved queues.
+func (p *ZonePlayer) Network() *Network {
+	return p.network
+}
+
+// Alarms returns the alarms set on the network.
+func (n *Network) Alarms() []Alarm {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Alarm{}, n.alarms...)
+}
+
+// SavedQueue returns the tracks in a saved queue, such as SQ:1, or nil if there isn't one.
+func (n *Network) SavedQueue(id string) []Track {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if queue, ok := n.savedQueues[id]; ok {
+		return append([]Track{}, queue.tracks...)
+	}
+	return nil
+}
+
+// player returns the player with a RINCON_ id. Callers must hold mu.
+func (n *Network) player(uuid string) *ZonePlayer {
+	for _, p := range n.players {
+		if p.UUID == uuid {
+			return p
+		}
+	}
+	return nil
+}
+
+// members returns the players in the group a player coordinates. Callers must hold mu.
+func (p *ZonePlayer) members() []*ZonePlayer {
+	var members []*ZonePlayer
+	for _, other := range p.network.players {
+		if other.coordinator == p.UUID {
+			members = append(members, other)
+		}
+	}
+	return members
+}
+
+// leaveGroup makes the player play on its own, handing its group over to another member if it was
+// the coordinator. Callers must hold mu.
+func (p *ZonePlayer) leaveGroup() {
+	if p.coordinator == p.UUID {
+		var next *ZonePlayer
+		for _, member := range p.members() {
+			if member == p {
+				continue
+			}
+			if next == nil {
+				next = member
+				next.queue, next.transportURI, next.transportMeta = p.queue, p.transportURI, p.transportMeta
+				next.state, next.track, next.relTime = p.state, p.track, p.relTime
+			}
+			member.coordinator = next.UUID
+		}
+	}
+	p.coordinator = p.UUID
+}
+
+func (p *ZonePlayer) deviceDescription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>%s</deviceType>
+<friendlyName>%s - Fake</friendlyName>
+<manufacturer>Sonos, Inc.</manufacturer>
+<modelNumber>S0</modelNumber>
+<modelName>Fake</modelName>
+<softwareVersion>70.3-35220</softwareVersion>
+<UDN>uuid:%s</UDN>
+<roomName>%s</roomName>
+<displayName>Fake</displayName>
+</device>
+</root>`, ssdpZonePlayerST, escape(p.Room), p.UUID, escape(p.Room))
+}
@@ -40,6 +40,9 @@
       el("player-curtime").innerText = formatTime(parseFloat(el("player-range").value));
     }
     if (audio.currentTime >= audio.duration) {
+      if (playlistIdx < playlist.length) {
+        reportplay(playlist[playlistIdx], "complete");
+      }
       nexttrack();
     }
   };
@@ -53,11 +56,12 @@
   audio.onvolumechange = function() {
     console.log(audio.volume);
     el("player-volume").value = (audio.volume * 100).toString();
-    el("player-mute").innerHTML = `<i class="material-icons">${audio.volume > 0 ? "volume_up" : "volume_mute"}</i>`;
+    showmute();
   };
   var sonosRoom = "";
   var playlist = [];
   var playlistIdx = 0;
+  var playlistSource = {};
   function nexttrack() {
     if (playlistIdx < playlist.length && sonosRoom.length == 0) {
       playlistIdx++;
@@ -88,6 +92,11 @@
     }
     req.send(JSON.stringify(actionReq));
   }
+  function reportplay(song, event) {
+    var req = new XMLHttpRequest();
+    req.open("POST", "/api/history/");
+    req.send(JSON.stringify({ SongId: song.SongId, Event: event }));
+  }
   function playsong() {
     if (playlistIdx < 0 || playlist.length == 0 || playlistIdx >= playlist.length) {
       audio.pause();
@@ -99,6 +108,7 @@
       audio.src = song.Audio;
       audio.load();
       audio.play();
+      reportplay(song, "start");
       el("player-info").innerHTML = `<a href="#artists/${song.Artist}">${song.Artist}</a><br/><a href="#albums/${song.Album}">${song.Album}</a><br/>${song.Name}`;
       el("player-albumcover").innerHTML = song.Image.length > 0 ? `<img class="easeload" onload="this.style.opacity=1" src="${song.Image}">` : ``;
       if ("mediaSession" in navigator) {
@@ -124,13 +134,47 @@
       }
     } else {
       audio.pause();
-      let songIds = [];
-      for (let idx = playlistIdx; idx < playlist.length; idx++) {
-        songIds.push(playlist[idx].SongId);
+      if (playlistSource.Album || playlistSource.Artist) {
+        sonoscommand({ Album: playlistSource.Album, Artist: playlistSource.Artist, FromTrack: playlistIdx + 1 });
+      } else {
+        sonoscommand({ SongIDs: playlist.map((song) => song.SongId), FromTrack: playlistIdx + 1 });
       }
-      sonoscommand({ SongIDs: songIds });
     }
   }
+  function ratingicon(result, stars) {
+    if (stars == 0) {
+      return result.Favourite ? "favorite" : "favorite_border";
+    }
+    return stars <= (result.Rating ?? 0) ? "star" : "star_border";
+  }
+  function ratinghtml(result, idx) {
+    let html = `<span class="rating" data-idx="${idx}">`;
+    for (let stars = 0; stars <= 5; stars++) {
+      html += `<i class="material-icons" data-stars="${stars}">${ratingicon(result, stars)}</i>`;
+    }
+    return html + `</span>`;
+  }
+  function rate(node, result, stars) {
+    let rating = { Stars: result.Rating ?? 0, Favourite: result.Favourite ?? false };
+    if (stars == 0) {
+      rating.Favourite = !rating.Favourite;
+    } else {
+      rating.Stars = rating.Stars == stars ? 0 : stars;
+    }
+    var req = new XMLHttpRequest();
+    req.open("PUT", result.Type == "Song" ? "/api/ratings/songs/" + result.SongId : "/api/ratings/albums/" + encodeURIComponent(result.Album));
+    req.onload = function() {
+      if (JSON.parse(req.response).Code) {
+        return;
+      }
+      result.Rating = rating.Stars;
+      result.Favourite = rating.Favourite;
+      for (let icon of node.querySelectorAll("i")) {
+        icon.innerHTML = ratingicon(result, parseInt(icon.dataset.stars));
+      }
+    };
+    req.send(JSON.stringify(rating));
+  }
   var prevApi = "";
   var cachedScrolls = {};
   function getmusic(api) {
@@ -150,7 +194,7 @@
     req.onload = function() {
       let res = JSON.parse(req.response);
       let html = "";
-      if (api == "albums") {
+      if (api == "albums" || api == "recent") {
         html += `<div class="albumcontainer">`;
         for (let result of res.Results) {
           html += `<div class="album"><a href="#${result.Link}">`;
@@ -168,7 +212,7 @@
           let result = res.Results[idx];
           if (result.Type == "Song") {
             html += `<div class="song ${first ? "firstpad" : ""}">
-                        <a class="play" data-idx="${idx}">${result.Name}</a>
+                        <a class="play" data-idx="${idx}">${result.Name}</a>${ratinghtml(result, idx)}
                     </div>`;
           } else if (result.Type == "AlbumHeader") {
             html += `<div class="albumheader ${first ? "" : "albumheaderpad"}"><div>`;
@@ -177,7 +221,7 @@
             } else {
               html += `<div class="albumbox"></div>`;
             }
-            html += `</div><div><h1>${result.Name}</h1><a href="#artists/${result.Artist}">${result.Artist}</a></div></div>`;
+            html += `</div><div><h1>${result.Name}</h1><a href="#artists/${result.Artist}">${result.Artist}</a><br/>${ratinghtml(result, idx)}</div></div>`;
           } else {
             let icon = "folder";
             if (result.Type == "Artist" || result.Name == "Artists") {
@@ -186,6 +230,8 @@
               icon = "album";
             } else if (result.Name == "Songs") {
               icon = "music_note";
+            } else if (result.Name == "Recently Added") {
+              icon = "new_releases";
             }
             html += `<div class="folder ${first ? "firstpad" : ""}"><a href="#${result.Link}"><i class="material-icons">${icon}</i><span>${result.Name}</span></a></div>`;
           }
@@ -197,6 +243,13 @@
         let idx = parseInt(node.dataset.idx);
         node.onclick = function() {
           playlist = [];
+          if (api.startsWith("albums/")) {
+            playlistSource = { Album: decodeURIComponent(api.slice("albums/".length)) };
+          } else if (api.startsWith("artists/")) {
+            playlistSource = { Artist: decodeURIComponent(api.slice("artists/".length)) };
+          } else {
+            playlistSource = {};
+          }
           for (let rx in res.Results) {
             let ridx = parseInt(rx);
             if (res.Results[ridx].Type == "Song") {
@@ -209,6 +262,14 @@
           playsong();
         };
       }
+      for (let node of document.querySelectorAll(".rating")) {
+        let result = res.Results[parseInt(node.dataset.idx)];
+        for (let icon of node.querySelectorAll("i")) {
+          icon.onclick = function() {
+            rate(node, result, parseInt(icon.dataset.stars));
+          };
+        }
+      }
       if (cachedScrolls[api]) {
         el("results").scrollTop = cachedScrolls[api];
       }
@@ -224,6 +285,84 @@
     }
     return html;
   }
+  var sonosPlayMode = "NORMAL";
+  var sonosCrossfade = false;
+  function playmode(shuffle, repeat) {
+    if (shuffle) {
+      return repeat == "all" ? "SHUFFLE" : repeat == "one" ? "SHUFFLE_REPEAT_ONE" : "SHUFFLE_NOREPEAT";
+    }
+    return repeat == "all" ? "REPEAT_ALL" : repeat == "one" ? "REPEAT_ONE" : "NORMAL";
+  }
+  function isshuffle(mode) {
+    return mode.startsWith("SHUFFLE");
+  }
+  function repeatmode(mode) {
+    if (mode.endsWith("REPEAT_ONE")) {
+      return "one";
+    }
+    return mode == "REPEAT_ALL" || mode == "SHUFFLE" ? "all" : "";
+  }
+  function showplaymode(show) {
+    for (let id of ["player-shuffle", "player-repeat", "player-crossfade", "player-sleep", "player-eq"]) {
+      el(id).style.display = show ? "" : "none";
+    }
+    let repeat = repeatmode(sonosPlayMode);
+    el("player-shuffle").innerHTML = `<i class="material-icons ${isshuffle(sonosPlayMode) ? "selected" : ""}">shuffle</i>`;
+    el("player-repeat").innerHTML = `<i class="material-icons ${repeat.length > 0 ? "selected" : ""}">${repeat == "one" ? "repeat_one" : "repeat"}</i>`;
+    el("player-crossfade").innerHTML = `<i class="material-icons ${sonosCrossfade ? "selected" : ""}">swap_horiz</i>`;
+  }
+  var sonosSleepSecs = 0;
+  function showsleep() {
+    el("player-sleep").innerHTML = `<span class="valign-wrapper"><i class="material-icons ${sonosSleepSecs > 0 ? "selected" : ""}">bedtime</i>${sonosSleepSecs > 0 ? formatTime(sonosSleepSecs) : ""}</span>`;
+  }
+  function sleephtml() {
+    let html = "";
+    for (let minutes of [0, 15, 30, 45, 60, 90]) {
+      html += `<div onclick="setsleep(this)" data-minutes="${minutes}">${minutes == 0 ? "Off" : minutes + " minutes"}</div>`;
+    }
+    return html;
+  }
+  window.setsleep = function(elem) {
+    let minutes = parseInt(elem.dataset.minutes);
+    var req = new XMLHttpRequest();
+    req.open(minutes > 0 ? "PUT" : "DELETE", "/api/sonos/" + sonosRoom + "/sleep");
+    req.onload = function() {
+      let remaining = JSON.parse(req.response).Remaining;
+      sonosSleepSecs = remaining ? parseTime(remaining) : 0;
+      showsleep();
+    };
+    req.send(JSON.stringify({ Minutes: minutes, Fade: true }));
+  };
+  var sonosMuted = false;
+  function showmute() {
+    let muted = sonosRoom.length > 0 ? sonosMuted : audio.volume == 0;
+    el("player-mute").innerHTML = `<i class="material-icons ${sonosRoom.length > 0 && muted ? "selected" : ""}">${muted ? "volume_off" : "volume_up"}</i>`;
+  }
+  var sonosBass = 0, sonosTreble = 0, sonosLoudness = true;
+  function eqhtml() {
+    return `<div><label>Bass</label><input id="eq-bass" type="range" min="-10" max="10" value="0" oninput="seteq(this)" data-eq="Bass" /></div><div><label>Treble</label><input id="eq-treble" type="range" min="-10" max="10" value="0" oninput="seteq(this)" data-eq="Treble" /></div><div id="eq-loudness" onclick="setloudness()"></div>`;
+  }
+  function showeq() {
+    el("eq-bass").value = sonosBass.toString();
+    el("eq-treble").value = sonosTreble.toString();
+    el("eq-loudness").innerHTML = `<span class="valign-wrapper"><i class="material-icons ${sonosLoudness ? "selected" : ""}">${sonosLoudness ? "check_box" : "check_box_outline_blank"}</i> Loudness</span>`;
+  }
+  window.seteq = function(elem) {
+    let input = elem;
+    let level = parseInt(input.value);
+    sonoscommand(input.dataset.eq == "Bass" ? { Bass: level } : { Treble: level });
+  };
+  window.setloudness = function() {
+    sonoscommand({ Loudness: !sonosLoudness });
+  };
+  function showmenu(menu, button, e) {
+    let style = el(menu).style;
+    let rect = el(button).getBoundingClientRect();
+    style.left = Math.min(window.innerWidth - 210, rect.x) + "px";
+    style.bottom = window.innerHeight - rect.y + 15 + "px";
+    style.display = "block";
+    e.stopPropagation();
+  }
   var evts = null;
   var sonosTimeSecs = 0;
   var sonosTickId = 0;
@@ -237,6 +376,10 @@
       el("player-range").value = sonosTimeSecs.toString();
     }
     sonosTimeSecs++;
+    if (sonosSleepSecs > 0) {
+      sonosSleepSecs--;
+      showsleep();
+    }
   }
   window.setspeaker = function(elem) {
     setspeaker(elem.dataset.room);
@@ -273,6 +416,9 @@
             sonosTickId = setInterval(tickSonosTime, 1e3);
           }
           el("player-info").innerHTML = `<a href="#artists/${res.Sonos.Artist ?? ""}">${res.Sonos.Artist ?? ""}</a><br/><a href="#albums/${res.Sonos.Album ?? ""}">${res.Sonos.Album ?? ""}</a><br/>${res.Sonos.Track ?? ""}`;
+          if (res.Sonos.Queueing) {
+            el("player-info").innerHTML += `<br/>queueing ${res.Sonos.Queueing.Queued} of ${res.Sonos.Queueing.Total}`;
+          }
           let newArt = res.Sonos.AlbumArtURI ? `<img class="easeload" onload="this.style.opacity=1" src="${res.Sonos.AlbumArtURI}">` : ``;
           if (el("player-albumcover").innerHTML != newArt) {
             el("player-albumcover").innerHTML = newArt;
@@ -281,18 +427,44 @@
         if (res.Sonos.Volume && enable_volume_update) {
           el("player-volume").value = res.Sonos.Volume.toString();
         }
+        if (res.Sonos.PlayMode) {
+          sonosPlayMode = res.Sonos.PlayMode;
+          sonosCrossfade = res.Sonos.Crossfade ?? false;
+          showplaymode(true);
+        }
+        if (res.Sonos.SleepTimer) {
+          sonosSleepSecs = res.Sonos.SleepTimer.Remaining ? parseTime(res.Sonos.SleepTimer.Remaining) : 0;
+          showsleep();
+        }
+        if (res.Sonos.Muted !== void 0) {
+          sonosMuted = res.Sonos.Muted;
+          showmute();
+        }
+        if (res.Sonos.Bass !== void 0 || res.Sonos.Treble !== void 0 || res.Sonos.Loudness !== void 0) {
+          sonosBass = res.Sonos.Bass ?? sonosBass;
+          sonosTreble = res.Sonos.Treble ?? sonosTreble;
+          sonosLoudness = res.Sonos.Loudness ?? sonosLoudness;
+          showeq();
+        }
       };
       evts.onerror = () => {
         console.log("connection lost - connecting to " + room + " in 1 second");
         setspeaker("");
         setTimeout(() => {
+          if (sonosRooms.indexOf(room) == -1) {
+            console.log(room + " has gone");
+            return;
+          }
           console.log("attempting reconnect to " + room);
           setspeaker(room);
         }, 1e3);
       };
     } else {
       el("player-speakers").innerHTML = `<span class="valign-wrapper"><i class="material-icons">speaker</i></span>`;
+      sonosRoom = "";
       el("player-right").classList.add("player-right-volume");
+      showplaymode(false);
+      showmute();
       el("player-albumcover").innerHTML = "";
       el("player-info").innerHTML = "";
       el("player-range").max = "1";
@@ -308,20 +480,24 @@
       sonosRooms = JSON.parse(req.response).Rooms ?? [];
       el("sonos-list").innerHTML = sonosroomhtml(sonosRoom);
       el("player-speakers").onclick = (e) => {
-        let style = el("sonos-list").style;
-        let button = el("player-speakers").getBoundingClientRect();
-        style.left = Math.min(window.innerWidth - 210, button.x) + "px";
-        style.bottom = window.innerHeight - button.y + 15 + "px";
-        style.display = "block";
-        e.stopPropagation();
+        showmenu("sonos-list", "player-speakers", e);
       };
       document.body.onclick = function() {
         el("sonos-list").style.display = "none";
+        el("sleep-list").style.display = "none";
+        el("eq-list").style.display = "none";
       };
     };
     el("sonos-list").innerHTML = "";
     req.send();
   }
+  function watchsonos() {
+    let roomEvts = new EventSource("/api/sonos/events");
+    roomEvts.onmessage = (event) => {
+      sonosRooms = JSON.parse(event.data).Rooms ?? [];
+      el("sonos-list").innerHTML = sonosroomhtml(sonosRoom);
+    };
+  }
   window.onhashchange = function() {
     getmusic(window.location.hash.slice(1));
   };
@@ -337,6 +513,7 @@
     };
     getmusic(window.location.hash.slice(1));
     refreshsonos();
+    watchsonos();
     el("player-play").onclick = function() {
       if (is_playing) {
         if (sonosRoom.length > 0) {
@@ -368,7 +545,9 @@
       }
     };
     el("player-mute").onclick = function() {
-      if (audio.volume == 0) {
+      if (sonosRoom.length > 0) {
+        sonoscommand({ Mute: !sonosMuted });
+      } else if (audio.volume == 0) {
         audio.volume = unmute_volume;
       } else {
         unmute_volume = audio.volume;
@@ -395,6 +574,28 @@
     el("player-next").onclick = function() {
       nexttrack();
     };
+    el("player-shuffle").onclick = function() {
+      sonoscommand({ PlayMode: playmode(!isshuffle(sonosPlayMode), repeatmode(sonosPlayMode)) });
+    };
+    el("player-repeat").onclick = function() {
+      let repeat = repeatmode(sonosPlayMode);
+      sonoscommand({ PlayMode: playmode(isshuffle(sonosPlayMode), repeat == "" ? "all" : repeat == "all" ? "one" : "") });
+    };
+    el("player-crossfade").onclick = function() {
+      sonoscommand({ Crossfade: !sonosCrossfade });
+    };
+    el("sleep-list").innerHTML = sleephtml();
+    el("player-sleep").onclick = (e) => {
+      showmenu("sleep-list", "player-sleep", e);
+    };
+    el("eq-list").innerHTML = eqhtml();
+    showeq();
+    el("eq-list").onclick = (e) => {
+      e.stopPropagation();
+    };
+    el("player-eq").onclick = (e) => {
+      showmenu("eq-list", "player-eq", e);
+    };
   };
 })();
 //# sourceMappingURL=music.js.map